@@ -1,39 +1,81 @@
 package api
 
 import (
+	"crypto/subtle"
 	"errors"
-	"io"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/nethesis/matrix2acrobits/db"
 	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/matrix"
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/nethesis/matrix2acrobits/service"
+	"maunium.net/go/mautrix/id"
 )
 
 const adminTokenHeader = "X-Super-Admin-Token"
 
+// Dead push deliveries listed when no limit is given
+const defaultDeadPushDeliveries = 100
+
+// IPExtractor returns the client address extractor: X-Forwarded-For is only trusted when the connection comes
+// from one of the trusted proxies, otherwise the address of the connection is used. Echo trusts the forwarded
+// headers of any client by default, which would let anyone pass the localhost and push gateway address checks.
+func IPExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, n := range trustedProxies {
+		options = append(options, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 // RegisterRoutes wires API endpoints to Echo handlers.
-func RegisterRoutes(e *echo.Echo, svc *service.MessageService, pushSvc *service.PushService, adminToken string, pushTokenDB *db.Database) {
-	h := handler{svc: svc, pushSvc: pushSvc, adminToken: adminToken, pushTokenDB: pushTokenDB}
+// hsToken is the token the homeserver uses to authenticate on the Application Service endpoints.
+func RegisterRoutes(e *echo.Echo, svc *service.MessageService, pushSvc *service.PushService, adminToken, hsToken string, pushTokenDB *db.Database) {
+	h := handler{svc: svc, pushSvc: pushSvc, adminToken: adminToken, hsToken: hsToken, pushTokenDB: pushTokenDB}
 	e.POST("/api/client/send_message", h.sendMessage)
 	e.POST("/api/client/fetch_messages", h.fetchMessages)
 	e.POST("/api/client/push_token_report", h.pushTokenReport)
+	e.POST("/api/client/account_removal_report", h.accountRemovalReport)
+	e.POST("/api/client/mark_displayed", h.markDisplayed)
+	e.POST("/api/client/push_settings_report", h.pushSettingsReport)
+	e.GET("/api/client/media/:server/:mediaId", h.downloadMedia)
 	e.GET("/api/internal/push_tokens", h.getPushTokens)
 	e.DELETE("/api/internal/push_tokens", h.resetPushTokens)
+	e.GET("/api/internal/push_gateway_failures", h.getPushGatewayFailures)
+	e.GET("/api/internal/push_deliveries", h.getDeadPushDeliveries)
+	e.GET("/api/internal/push_settings", h.getPushSettings)
+	e.PUT("/api/internal/push_settings", h.setPushSettings)
+	e.GET("/api/internal/recorded_pushes", h.getRecordedPushes)
+	e.DELETE("/api/internal/recorded_pushes", h.clearRecordedPushes)
+	e.POST("/api/internal/reconcile_pushers", h.reconcilePushers)
 
 	// Matrix Push Gateway API
 	e.POST("/_matrix/push/v1/notify", h.matrixPushNotify)
-	// Matrix Application Service transactions (push events to AS)
-	e.PUT("/_matrix/app/v1/transactions/:txnId", h.matrixAppTransaction)
+	// Matrix Application Service API, authenticated with the hs_token
+	appService := e.Group("/_matrix/app/v1", h.requireHSToken)
+	// Transactions (push events to AS)
+	appService.PUT("/transactions/:txnId", h.matrixAppTransaction)
+	// User and room alias queries, used to provision extension users and direct rooms on the fly
+	appService.GET("/users/:userId", h.matrixAppUserQuery)
+	appService.GET("/rooms/:roomAlias", h.matrixAppRoomQuery)
 }
 
 type handler struct {
 	svc         *service.MessageService
 	pushSvc     *service.PushService
 	adminToken  string
+	hsToken     string
 	pushTokenDB *db.Database
 }
 
@@ -52,7 +94,7 @@ func (h handler) sendMessage(c echo.Context) error {
 		logger.Error().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Err(err).Msg("failed to send message")
 		// Add extra context to help debugging recipient resolution
 		logger.Debug().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Msg("send_message handler returning error to client; check mapping store and AS configuration")
-		return mapServiceError(err)
+		return mapServiceError(c, err)
 	}
 
 	logger.Info().Str("endpoint", "send_message").Str("from", req.From).Str("to", req.To).Str("message_id", resp.ID).Msg("message sent successfully")
@@ -71,7 +113,7 @@ func (h handler) fetchMessages(c echo.Context) error {
 	resp, err := h.svc.FetchMessages(c.Request().Context(), &req)
 	if err != nil {
 		logger.Error().Str("endpoint", "fetch_messages").Str("username", req.Username).Err(err).Msg("failed to fetch messages")
-		return mapServiceError(err)
+		return mapServiceError(c, err)
 	}
 
 	logger.Info().Str("endpoint", "fetch_messages").Str("username", req.Username).Int("received", len(resp.ReceivedSMSs)).Int("sent", len(resp.SentSMSs)).Msg("messages fetched successfully")
@@ -91,25 +133,162 @@ func (h handler) pushTokenReport(c echo.Context) error {
 	resp, err := h.svc.ReportPushToken(c.Request().Context(), &req)
 	if err != nil {
 		logger.Error().Str("endpoint", "push_token_report").Str("selector", req.Selector).Err(err).Msg("failed to report push token")
-		return mapServiceError(err)
+		return mapServiceError(c, err)
 	}
 
 	logger.Info().Str("endpoint", "push_token_report").Str("selector", req.Selector).Msg("push token reported successfully")
 	return c.JSON(http.StatusOK, resp)
 }
 
+func (h handler) accountRemovalReport(c echo.Context) error {
+	var req models.AccountRemovalRequest
+	if err := c.Bind(&req); err != nil {
+		logger.Warn().Str("endpoint", "account_removal_report").Err(err).Msg("invalid request payload")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+
+	logger.Debug().Str("endpoint", "account_removal_report").Str("username", req.UserName).Str("selector", req.Selector).Msg("processing account removal request")
+
+	resp, err := h.svc.ReportAccountRemoval(c.Request().Context(), &req)
+	if err != nil {
+		logger.Error().Str("endpoint", "account_removal_report").Str("selector", req.Selector).Err(err).Msg("failed to process account removal")
+		return mapServiceError(c, err)
+	}
+
+	logger.Info().Str("endpoint", "account_removal_report").Str("selector", req.Selector).Msg("account removal processed successfully")
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h handler) pushSettingsReport(c echo.Context) error {
+	var req models.PushSettingsReportRequest
+	if err := c.Bind(&req); err != nil {
+		logger.Warn().Str("endpoint", "push_settings_report").Err(err).Msg("invalid request payload")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+
+	resp, err := h.svc.ReportPushSettings(c.Request().Context(), &req)
+	if err != nil {
+		logger.Error().Str("endpoint", "push_settings_report").Str("username", req.UserName).Err(err).Msg("failed to report push settings")
+		return mapServiceError(c, err)
+	}
+
+	logger.Info().Str("endpoint", "push_settings_report").Str("user_id", resp.UserID).Bool("hide_content", resp.HideContent).Msg("push settings reported successfully")
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h handler) markDisplayed(c echo.Context) error {
+	var req models.MarkDisplayedRequest
+	if err := c.Bind(&req); err != nil {
+		logger.Warn().Str("endpoint", "mark_displayed").Err(err).Msg("invalid request payload")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+
+	logger.Debug().Str("endpoint", "mark_displayed").Str("username", req.UserName).Str("stream_id", req.StreamID).Str("sms_id", req.SMSID).Msg("processing mark displayed request")
+
+	resp, err := h.svc.MarkDisplayed(c.Request().Context(), &req)
+	if err != nil {
+		logger.Error().Str("endpoint", "mark_displayed").Str("username", req.UserName).Str("sms_id", req.SMSID).Err(err).Msg("failed to mark message as displayed")
+		return mapServiceError(c, err)
+	}
+
+	logger.Info().Str("endpoint", "mark_displayed").Str("username", req.UserName).Str("sms_id", req.SMSID).Msg("message marked as displayed")
+	return c.JSON(http.StatusOK, resp)
+}
+
+// downloadMedia streams a Matrix media file to the app.
+// Links are generated by fetch_messages and carry a signature, so no credentials are required.
+func (h handler) downloadMedia(c echo.Context) error {
+	server := c.Param("server")
+	mediaID := c.Param("mediaId")
+
+	logger.Debug().Str("endpoint", "download_media").Str("server", server).Str("media_id", mediaID).Msg("processing media download request")
+
+	resp, err := h.svc.DownloadMedia(c.Request().Context(), server, mediaID, c.QueryParam("sig"), c.QueryParam("exp"), c.QueryParam("key"))
+	if err != nil {
+		logger.Warn().Str("endpoint", "download_media").Str("server", server).Str("media_id", mediaID).Err(err).Msg("failed to download media")
+		return mapServiceError(c, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	header := c.Response().Header()
+	for _, name := range []string{echo.HeaderContentLength, "Cache-Control"} {
+		if v := resp.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	// The files are uploaded by any Matrix user: they are downloaded, never rendered by a browser as a page
+	header.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	header.Set(echo.HeaderContentDisposition, mediaContentDisposition(resp.Header.Get(echo.HeaderContentDisposition)))
+
+	logger.Info().Str("endpoint", "download_media").Str("server", server).Str("media_id", mediaID).Msg("streaming media")
+	return c.Stream(http.StatusOK, mediaContentType(resp.Header.Get(echo.HeaderContentType)), resp.Body)
+}
+
+// inlineMediaTypes are the media types passed to the app as is: images, audio and video cannot run scripts.
+// SVG images can, so they are not listed.
+var inlineMediaTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/heic":      true,
+	"audio/aac":       true,
+	"audio/amr":       true,
+	"audio/mp4":       true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wav":       true,
+	"audio/webm":      true,
+	"video/3gpp":      true,
+	"video/mp4":       true,
+	"video/quicktime": true,
+	"video/webm":      true,
+}
+
+// mediaContentType returns the content type of a media file: the upstream type when it is an inline-safe one,
+// application/octet-stream otherwise.
+func mediaContentType(upstream string) string {
+	mediaType, _, err := mime.ParseMediaType(upstream)
+	if err != nil || !inlineMediaTypes[mediaType] {
+		return echo.MIMEOctetStream
+	}
+	return mediaType
+}
+
+// mediaContentDisposition returns an attachment disposition keeping the file name of the upstream one.
+func mediaContentDisposition(upstream string) string {
+	_, params, err := mime.ParseMediaType(upstream)
+	if err != nil || params["filename"] == "" {
+		return "attachment"
+	}
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": params["filename"]}); disposition != "" {
+		return disposition
+	}
+	return "attachment"
+}
+
 func (h handler) getPushTokens(c echo.Context) error {
 	if err := h.ensureAdminAccess(c); err != nil {
 		return err
 	}
 
-	logger.Debug().Str("endpoint", "get_push_tokens").Msg("fetching all push tokens")
-
 	if err := h.ensurePushTokenDB("get_push_tokens"); err != nil {
 		return err
 	}
 
-	tokens, err := h.pushTokenDB.ListPushTokens()
+	// Support can list the devices receiving the pushes of a single user
+	userID := strings.TrimSpace(c.QueryParam("user_id"))
+	var tokens []*db.PushToken
+	var err error
+	if userID != "" {
+		logger.Debug().Str("endpoint", "get_push_tokens").Str("user_id", userID).Msg("fetching push tokens of user")
+		tokens, err = h.pushTokenDB.ListPushTokensByUser(userID)
+	} else {
+		logger.Debug().Str("endpoint", "get_push_tokens").Msg("fetching all push tokens")
+		tokens, err = h.pushTokenDB.ListPushTokens()
+	}
 	if err != nil {
 		logger.Error().Str("endpoint", "get_push_tokens").Err(err).Msg("failed to list push tokens")
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -139,6 +318,143 @@ func (h handler) resetPushTokens(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"status": "reset"})
 }
 
+func (h handler) getPushGatewayFailures(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+
+	if h.pushSvc == nil {
+		logger.Error().Str("endpoint", "get_push_gateway_failures").Msg("push service not initialized")
+		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
+	}
+
+	return c.JSON(http.StatusOK, h.pushSvc.GatewayFailures())
+}
+
+// getDeadPushDeliveries lists the latest pushes dropped after too many failed attempts, up to the limit query parameter.
+func (h handler) getDeadPushDeliveries(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+
+	if h.pushSvc == nil {
+		logger.Error().Str("endpoint", "get_push_deliveries").Msg("push service not initialized")
+		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
+	}
+
+	limit := defaultDeadPushDeliveries
+	if v := c.QueryParam("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		limit = parsed
+	}
+
+	deliveries, err := h.pushSvc.DeadPushDeliveries(limit)
+	if err != nil {
+		logger.Error().Str("endpoint", "get_push_deliveries").Err(err).Msg("failed to list dead push deliveries")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	logger.Info().Str("endpoint", "get_push_deliveries").Int("count", len(deliveries)).Msg("dead push deliveries listed successfully")
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+func (h handler) getRecordedPushes(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+	if h.pushSvc == nil {
+		logger.Error().Str("endpoint", "get_recorded_pushes").Msg("push service not initialized")
+		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
+	}
+
+	pushes, err := h.pushSvc.RecordedPushes()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, pushes)
+}
+
+func (h handler) clearRecordedPushes(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+	if h.pushSvc == nil {
+		logger.Error().Str("endpoint", "clear_recorded_pushes").Msg("push service not initialized")
+		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
+	}
+
+	if err := h.pushSvc.ClearRecordedPushes(); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	logger.Info().Str("endpoint", "clear_recorded_pushes").Msg("recorded pushes cleared")
+	return c.JSON(http.StatusOK, map[string]string{"status": "cleared"})
+}
+
+func (h handler) reconcilePushers(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+
+	report, err := h.svc.ReconcilePushers(c.Request().Context())
+	if errors.Is(err, service.ErrPusherReconcileUnavailable) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		logger.Error().Str("endpoint", "reconcile_pushers").Err(err).Msg("failed to reconcile pushers")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+func (h handler) getPushSettings(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+	if err := h.ensurePushTokenDB("get_push_settings"); err != nil {
+		return err
+	}
+
+	userID := strings.TrimSpace(c.QueryParam("user_id"))
+	if userID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id is required")
+	}
+	hide, err := h.pushTokenDB.GetPushHideContent(userID)
+	if err != nil {
+		logger.Error().Str("endpoint", "get_push_settings").Str("user_id", userID).Err(err).Msg("failed to get push settings")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, models.PushSettings{UserID: userID, HideContent: hide})
+}
+
+func (h handler) setPushSettings(c echo.Context) error {
+	if err := h.ensureAdminAccess(c); err != nil {
+		return err
+	}
+	if err := h.ensurePushTokenDB("set_push_settings"); err != nil {
+		return err
+	}
+
+	var req models.PushSettings
+	if err := c.Bind(&req); err != nil {
+		logger.Warn().Str("endpoint", "set_push_settings").Err(err).Msg("invalid request payload")
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
+	}
+	req.UserID = strings.TrimSpace(req.UserID)
+	if !strings.HasPrefix(req.UserID, "@") {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id must be a Matrix user ID")
+	}
+	if err := h.pushTokenDB.SetPushHideContent(req.UserID, req.HideContent); err != nil {
+		logger.Error().Str("endpoint", "set_push_settings").Str("user_id", req.UserID).Err(err).Msg("failed to save push settings")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	logger.Info().Str("endpoint", "set_push_settings").Str("user_id", req.UserID).Bool("hide_content", req.HideContent).Msg("push settings saved")
+	return c.JSON(http.StatusOK, req)
+}
+
 func (h handler) ensureAdminAccess(c echo.Context) error {
 	if h.adminToken == "" {
 		return echo.NewHTTPError(http.StatusInternalServerError, "admin token not configured")
@@ -153,6 +469,26 @@ func (h handler) ensureAdminAccess(c echo.Context) error {
 	return nil
 }
 
+// requireHSToken authenticates the homeserver on the Application Service API. The hs_token is accepted
+// as an Authorization Bearer header or as the legacy access_token query parameter.
+func (h handler) requireHSToken(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := c.QueryParam("access_token")
+		if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			logger.Warn().Str("path", c.Path()).Str("remote_ip", c.RealIP()).Msg("application service request without hs_token")
+			return c.JSON(http.StatusUnauthorized, models.MatrixError{ErrCode: "M_UNAUTHORIZED", Error: "missing hs_token"})
+		}
+		if h.hsToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.hsToken)) != 1 {
+			logger.Warn().Str("path", c.Path()).Str("remote_ip", c.RealIP()).Msg("application service request with invalid hs_token")
+			return c.JSON(http.StatusForbidden, models.MatrixError{ErrCode: "M_FORBIDDEN", Error: "invalid hs_token"})
+		}
+		return next(c)
+	}
+}
+
 // ensurePushTokenDB validates that the push token database is initialized
 func (h handler) ensurePushTokenDB(endpoint string) error {
 	if h.pushTokenDB == nil {
@@ -162,14 +498,25 @@ func (h handler) ensurePushTokenDB(endpoint string) error {
 	return nil
 }
 
-func mapServiceError(err error) error {
+func mapServiceError(c echo.Context, err error) error {
+	var rateLimited *matrix.RateLimitError
 	switch {
+	case errors.As(err, &rateLimited):
+		// Tell the app how long to back off, in whole seconds
+		retryAfter := int(math.Ceil(rateLimited.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return echo.NewHTTPError(http.StatusTooManyRequests, err.Error())
 	case errors.Is(err, service.ErrAuthentication):
 		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
-	case errors.Is(err, service.ErrInvalidRecipient):
+	case errors.Is(err, service.ErrInvalidRecipient), errors.Is(err, service.ErrInvalidAttachment), errors.Is(err, service.ErrInvalidMessage):
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-	case errors.Is(err, service.ErrMappingNotFound):
+	case errors.Is(err, service.ErrMappingNotFound), errors.Is(err, service.ErrMediaNotFound):
 		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrInvalidMediaSignature), errors.Is(err, service.ErrMediaLinkExpired), errors.Is(err, service.ErrPushTokenOwnership):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
 	default:
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -190,20 +537,26 @@ func (h handler) isLocalhost(ip string) bool {
 }
 
 func (h handler) matrixPushNotify(c echo.Context) error {
+	if h.pushSvc == nil {
+		logger.Error().Str("endpoint", "matrix_push_notify").Msg("push service not initialized")
+		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
+	}
+
+	// The pusher URL registered by ReportPushToken carries the notified user and its signature
+	userID, err := h.pushSvc.AuthorizeGateway(c.RealIP(), c.QueryParam("user"), c.QueryParam("sig"))
+	if err != nil {
+		return c.JSON(http.StatusForbidden, models.MatrixError{ErrCode: "M_FORBIDDEN", Error: err.Error()})
+	}
+
 	var req models.MatrixPushNotifyRequest
 	if err := c.Bind(&req); err != nil {
 		logger.Warn().Str("endpoint", "matrix_push_notify").Err(err).Msg("invalid request payload")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
 
-	logger.Debug().Str("endpoint", "matrix_push_notify").Int("device_count", len(req.Notification.Devices)).Str("event_id", req.Notification.EventID).Msg("processing matrix push notification")
-
-	if h.pushSvc == nil {
-		logger.Error().Str("endpoint", "matrix_push_notify").Msg("push service not initialized")
-		return echo.NewHTTPError(http.StatusInternalServerError, "push service not available")
-	}
+	logger.Debug().Str("endpoint", "matrix_push_notify").Str("user_id", userID).Int("device_count", len(req.Notification.Devices)).Str("event_id", req.Notification.EventID).Msg("processing matrix push notification")
 
-	resp, err := h.pushSvc.HandleMatrixPushNotification(c.Request().Context(), &req)
+	resp, err := h.pushSvc.HandleMatrixPushNotification(c.Request().Context(), userID, &req)
 	if err != nil {
 		logger.Error().Str("endpoint", "matrix_push_notify").Err(err).Msg("failed to handle matrix push notification")
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -214,18 +567,62 @@ func (h handler) matrixPushNotify(c echo.Context) error {
 }
 
 // matrixAppTransaction handles incoming Application Service transactions from homeservers.
-// It logs the received payload for debugging and returns HTTP 200 as required by the spec.
+// Events are fed to the message service; errors make the homeserver retry the transaction later.
 func (h handler) matrixAppTransaction(c echo.Context) error {
 	txnId := c.Param("txnId")
-	// Read raw body
-	bodyBytes, err := io.ReadAll(c.Request().Body)
-	if err != nil {
-		logger.Error().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Err(err).Msg("failed to read request body")
+	var txn models.AppServiceTransaction
+	if err := c.Bind(&txn); err != nil {
+		logger.Error().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Err(err).Msg("invalid transaction payload")
 		return echo.NewHTTPError(http.StatusBadRequest, "invalid payload")
 	}
 
-	logger.Debug().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Str("payload", string(bodyBytes)).Msg("received application service transaction")
+	logger.Debug().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Int("events", len(txn.Events)).Msg("received application service transaction")
+
+	if err := h.svc.HandleTransaction(c.Request().Context(), txnId, &txn); err != nil {
+		logger.Error().Str("endpoint", "matrix_app_transaction").Str("txn_id", txnId).Err(err).Msg("failed to process application service transaction")
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to process transaction")
+	}
+	// Calls answered, rejected or hung up stop ringing the devices of the callee
+	if h.pushSvc != nil {
+		h.pushSvc.HandleCallEvents(txn.Events)
+	}
 
 	// As per spec, acknowledge with an empty JSON object and 200 OK.
 	return c.JSON(http.StatusOK, map[string]interface{}{})
 }
+
+// matrixAppUserQuery answers the homeserver asking whether a user of the Application Service namespace exists.
+func (h handler) matrixAppUserQuery(c echo.Context) error {
+	userID, err := url.PathUnescape(c.Param("userId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.MatrixError{ErrCode: "M_INVALID_PARAM", Error: "invalid user ID"})
+	}
+
+	exists, err := h.svc.QueryUser(c.Request().Context(), id.UserID(userID))
+	if err != nil {
+		logger.Error().Str("endpoint", "matrix_app_user_query").Str("user_id", userID).Err(err).Msg("failed to provision user")
+		return c.JSON(http.StatusInternalServerError, models.MatrixError{ErrCode: "M_UNKNOWN", Error: "failed to provision user"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, models.MatrixError{ErrCode: "M_NOT_FOUND", Error: "user not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{})
+}
+
+// matrixAppRoomQuery answers the homeserver asking whether a room alias of the Application Service namespace exists.
+func (h handler) matrixAppRoomQuery(c echo.Context) error {
+	alias, err := url.PathUnescape(c.Param("roomAlias"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, models.MatrixError{ErrCode: "M_INVALID_PARAM", Error: "invalid room alias"})
+	}
+
+	exists, err := h.svc.QueryRoomAlias(c.Request().Context(), id.RoomAlias(alias))
+	if err != nil {
+		logger.Error().Str("endpoint", "matrix_app_room_query").Str("room_alias", alias).Err(err).Msg("failed to provision room")
+		return c.JSON(http.StatusInternalServerError, models.MatrixError{ErrCode: "M_UNKNOWN", Error: "failed to provision room"})
+	}
+	if !exists {
+		return c.JSON(http.StatusNotFound, models.MatrixError{ErrCode: "M_NOT_FOUND", Error: "room alias not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{})
+}
@@ -2,14 +2,21 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/matrix"
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/nethesis/matrix2acrobits/service"
 	"github.com/stretchr/testify/assert"
@@ -101,6 +108,96 @@ func TestPushTokenReport(t *testing.T) {
 	})
 }
 
+func TestAccountRemovalReport(t *testing.T) {
+	e := echo.New()
+	svc := service.NewMessageService(nil, nil, service.NewTestConfig())
+
+	t.Run("no database", func(t *testing.T) {
+		reqBody := models.AccountRemovalRequest{
+			UserName: "201",
+			Password: "secret",
+			Selector: "12869E0E6E553673C54F29105A0647204C416A2A:7C3A0D14",
+		}
+
+		body, _ := json.Marshal(reqBody)
+		req := httptest.NewRequest(http.MethodPost, "/api/client/account_removal_report", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+
+		h := handler{svc: svc}
+		err := h.accountRemovalReport(c)
+
+		assert.Error(t, err)
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusInternalServerError, echoErr.Code)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/client/account_removal_report", bytes.NewBufferString("invalid json"))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+
+		h := handler{svc: svc}
+		err := h.accountRemovalReport(c)
+
+		assert.Error(t, err)
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusBadRequest, echoErr.Code)
+	})
+}
+
+func TestMarkDisplayed(t *testing.T) {
+	e := echo.New()
+	svc := service.NewMessageService(nil, nil, service.NewTestConfig())
+
+	t.Run("invalid message", func(t *testing.T) {
+		reqBody := models.MarkDisplayedRequest{
+			UserName: "201",
+			Password: "secret",
+			StreamID: "201",
+			SMSID:    "$event",
+		}
+
+		body, _ := json.Marshal(reqBody)
+		req := httptest.NewRequest(http.MethodPost, "/api/client/mark_displayed", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+
+		h := handler{svc: svc}
+		err := h.markDisplayed(c)
+
+		assert.Error(t, err)
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusBadRequest, echoErr.Code)
+	})
+
+	t.Run("missing password", func(t *testing.T) {
+		body, _ := json.Marshal(models.MarkDisplayedRequest{UserName: "201", StreamID: "!room:example.com", SMSID: "$event"})
+		req := httptest.NewRequest(http.MethodPost, "/api/client/mark_displayed", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+
+		h := handler{svc: svc}
+		err := h.markDisplayed(c)
+
+		assert.Error(t, err)
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusUnauthorized, echoErr.Code)
+	})
+}
+
 func TestGetPushTokens(t *testing.T) {
 	tmpFile, err := os.CreateTemp("", "test_routes_*.db")
 	require.NoError(t, err)
@@ -113,6 +210,8 @@ func TestGetPushTokens(t *testing.T) {
 	// Insert test data
 	err = pushTokenDB.SavePushToken(
 		"selector1",
+		"@user1:example.com",
+		"",
 		"token_msgs_1",
 		"app_msgs_1",
 		"token_calls_1",
@@ -122,6 +221,8 @@ func TestGetPushTokens(t *testing.T) {
 
 	err = pushTokenDB.SavePushToken(
 		"selector2",
+		"@user2:example.com",
+		"",
 		"token_msgs_2",
 		"app_msgs_2",
 		"token_calls_2",
@@ -162,6 +263,24 @@ func TestGetPushTokens(t *testing.T) {
 		assert.True(t, selectors["selector2"])
 	})
 
+	t.Run("get push tokens of a user", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/internal/push_tokens?user_id=@user2:example.com", nil)
+		req.Header.Set("X-Super-Admin-Token", "test-admin-token")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+		c.Request().RemoteAddr = "127.0.0.1:12345"
+
+		h := handler{svc: svc, adminToken: "test-admin-token", pushTokenDB: pushTokenDB}
+		require.NoError(t, h.getPushTokens(c))
+
+		var tokens []*db.PushToken
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "selector2", tokens[0].Selector)
+		assert.Equal(t, "@user2:example.com", tokens[0].UserID)
+	})
+
 	t.Run("get push tokens without admin token", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/api/internal/push_tokens", nil)
 		// Missing X-Super-Admin-Token header
@@ -270,9 +389,9 @@ func TestResetPushTokens(t *testing.T) {
 	defer pushTokenDB.Close()
 
 	// Insert test data
-	err = pushTokenDB.SavePushToken("selector1", "token1", "app1", "token_call1", "app_call1")
+	err = pushTokenDB.SavePushToken("selector1", "", "", "token1", "app1", "token_call1", "app_call1")
 	require.NoError(t, err)
-	err = pushTokenDB.SavePushToken("selector2", "token2", "app2", "token_call2", "app_call2")
+	err = pushTokenDB.SavePushToken("selector2", "", "", "token2", "app2", "token_call2", "app_call2")
 	require.NoError(t, err)
 
 	e := echo.New()
@@ -305,7 +424,7 @@ func TestResetPushTokens(t *testing.T) {
 
 	t.Run("reset push tokens without admin token", func(t *testing.T) {
 		// Re-insert data for this test
-		err := pushTokenDB.SavePushToken("selector3", "token3", "app3", "token_call3", "app_call3")
+		err := pushTokenDB.SavePushToken("selector3", "", "", "token3", "app3", "token_call3", "app_call3")
 		require.NoError(t, err)
 
 		req := httptest.NewRequest(http.MethodDelete, "/api/internal/push_tokens", nil)
@@ -380,3 +499,316 @@ func TestResetPushTokens(t *testing.T) {
 		assert.Equal(t, http.StatusInternalServerError, echoErr.Code)
 	})
 }
+
+func TestDownloadMedia(t *testing.T) {
+	e := echo.New()
+	svc := service.NewMessageService(nil, nil, service.NewTestConfig())
+
+	t.Run("invalid signature", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/client/media/example.com/abc?sig=bad", nil)
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+		c.SetParamNames("server", "mediaId")
+		c.SetParamValues("example.com", "abc")
+
+		h := handler{svc: svc}
+		err := h.downloadMedia(c)
+
+		assert.Error(t, err)
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusForbidden, echoErr.Code)
+	})
+
+	t.Run("invalid media id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/client/media/example.com/", nil)
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+		c.SetParamNames("server", "mediaId")
+		c.SetParamValues("example.com", "")
+
+		h := handler{svc: svc}
+		err := h.downloadMedia(c)
+
+		assert.Error(t, err)
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusNotFound, echoErr.Code)
+	})
+}
+
+func TestMediaContentType(t *testing.T) {
+	tests := map[string]string{
+		"image/jpeg":               "image/jpeg",
+		"video/mp4; codecs=avc1":   "video/mp4",
+		"AUDIO/MPEG":               "audio/mpeg",
+		"text/html; charset=utf-8": "application/octet-stream",
+		"image/svg+xml":            "application/octet-stream",
+		"application/pdf":          "application/octet-stream",
+		"":                         "application/octet-stream",
+		"not a type":               "application/octet-stream",
+	}
+	for upstream, expected := range tests {
+		assert.Equal(t, expected, mediaContentType(upstream), upstream)
+	}
+}
+
+func TestMediaContentDisposition(t *testing.T) {
+	tests := map[string]string{
+		`inline; filename="photo.jpg"`:         `attachment; filename=photo.jpg`,
+		`attachment; filename="my file.pdf"`:   `attachment; filename="my file.pdf"`,
+		`inline`:                               `attachment`,
+		``:                                     `attachment`,
+		`inline; filename*=utf-8''f%C3%A9.png`: `attachment; filename*=utf-8''f%C3%A9.png`,
+	}
+	for upstream, expected := range tests {
+		assert.Equal(t, expected, mediaContentDisposition(upstream), upstream)
+	}
+}
+
+func TestMatrixPushNotify_GatewayProtection(t *testing.T) {
+	cfg := service.NewTestConfig()
+	cfg.PushGatewayAllowedNets = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}}
+	cfg.PushGatewaySecret = "secret"
+	pushSvc := service.NewPushService(nil, nil, cfg)
+	e := echo.New()
+	e.IPExtractor = IPExtractor(nil)
+	RegisterRoutes(e, nil, pushSvc, "admin", "hs", nil)
+
+	notify := func(remoteAddr, query string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/push/v1/notify"+query, strings.NewReader(`{"notification":{"devices":[]}}`))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := notify("203.0.113.1:5000", "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "M_FORBIDDEN")
+
+	// Forwarded headers sent by the client do not pass the allowlist
+	rec = notify("203.0.113.1:5000", "", map[string]string{"X-Forwarded-For": "10.0.0.2", "X-Real-IP": "10.0.0.2"})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = notify("10.0.0.2:5000", "?user=%40alice%3Aexample.com&sig=bad", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	failures := pushSvc.GatewayFailures()
+	assert.Equal(t, uint64(2), failures[service.PushFailureAddressNotAllowed])
+	assert.Equal(t, uint64(1), failures[service.PushFailureInvalidSignature])
+}
+
+func TestIPExtractor(t *testing.T) {
+	newRequest := func(remoteAddr string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "127.0.0.1")
+		req.Header.Set("X-Real-IP", "127.0.0.1")
+		return req
+	}
+
+	direct := IPExtractor(nil)
+	assert.Equal(t, "203.0.113.1", direct(newRequest("203.0.113.1:5000")))
+	assert.Equal(t, "10.0.0.5", direct(newRequest("10.0.0.5:5000")))
+
+	behindProxy := IPExtractor([]*net.IPNet{{IP: net.IPv4(10, 0, 0, 5).To4(), Mask: net.CIDRMask(32, 32)}})
+	assert.Equal(t, "127.0.0.1", behindProxy(newRequest("10.0.0.5:5000")))
+	// Other private addresses are not trusted
+	assert.Equal(t, "10.0.0.6", behindProxy(newRequest("10.0.0.6:5000")))
+}
+
+func TestMapServiceError_RateLimited(t *testing.T) {
+	e := echo.New()
+
+	for name, tc := range map[string]struct {
+		retryAfter time.Duration
+		header     string
+	}{
+		"retry after":         {retryAfter: 2500 * time.Millisecond, header: "3"},
+		"unknown retry after": {header: "1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodPost, "/api/client/send_message", nil), rec)
+
+			err := mapServiceError(c, fmt.Errorf("send message: %w", &matrix.RateLimitError{RetryAfter: tc.retryAfter, Err: errors.New("M_LIMIT_EXCEEDED")}))
+
+			echoErr, ok := err.(*echo.HTTPError)
+			require.True(t, ok)
+			assert.Equal(t, http.StatusTooManyRequests, echoErr.Code)
+			assert.Equal(t, tc.header, rec.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestPushSettings(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+
+	e := echo.New()
+	h := handler{adminToken: "test-admin-token", pushTokenDB: pushTokenDB}
+	newContext := func(method, target, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Super-Admin-Token", "test-admin-token")
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rec := httptest.NewRecorder()
+		return e.NewContext(req, rec), rec
+	}
+
+	c, rec := newContext(http.MethodPut, "/api/internal/push_settings", `{"user_id":"@alice:example.com","hide_content":true}`)
+	require.NoError(t, h.setPushSettings(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	c, rec = newContext(http.MethodGet, "/api/internal/push_settings?user_id=@alice:example.com", "")
+	require.NoError(t, h.getPushSettings(c))
+	var settings models.PushSettings
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &settings))
+	assert.Equal(t, models.PushSettings{UserID: "@alice:example.com", HideContent: true}, settings)
+
+	c, _ = newContext(http.MethodPut, "/api/internal/push_settings", `{"user_id":"alice","hide_content":true}`)
+	err = h.setPushSettings(c)
+	echoErr, ok := err.(*echo.HTTPError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, echoErr.Code)
+
+	c, _ = newContext(http.MethodGet, "/api/internal/push_settings?user_id=@alice:example.com", "")
+	c.Request().Header.Del("X-Super-Admin-Token")
+	err = h.getPushSettings(c)
+	echoErr, ok = err.(*echo.HTTPError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, echoErr.Code)
+
+	// Users change their own settings with their credentials, without the admin token
+	h.svc = service.NewMessageService(nil, pushTokenDB, service.NewTestConfig())
+	c, _ = newContext(http.MethodPost, "/api/client/push_settings_report", `{"username":"201","hide_content":false}`)
+	c.Request().Header.Del("X-Super-Admin-Token")
+	err = h.pushSettingsReport(c)
+	echoErr, ok = err.(*echo.HTTPError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, echoErr.Code)
+}
+
+func TestRecordedPushes(t *testing.T) {
+	e := echo.New()
+	newContext := func(method string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(method, "/api/internal/recorded_pushes", nil)
+		req.Header.Set("X-Super-Admin-Token", "test-admin-token")
+		req.RemoteAddr = "127.0.0.1:12345"
+		rec := httptest.NewRecorder()
+		return e.NewContext(req, rec), rec
+	}
+
+	t.Run("record mode disabled", func(t *testing.T) {
+		h := handler{adminToken: "test-admin-token", pushSvc: service.NewPushService(nil, nil, service.NewTestConfig())}
+		c, _ := newContext(http.MethodGet)
+		err := h.getRecordedPushes(c)
+		echoErr, ok := err.(*echo.HTTPError)
+		require.True(t, ok)
+		assert.Equal(t, http.StatusNotFound, echoErr.Code)
+	})
+
+	t.Run("record mode enabled", func(t *testing.T) {
+		pushTokenDB, err := db.NewDatabase(":memory:")
+		require.NoError(t, err)
+		defer pushTokenDB.Close()
+		require.NoError(t, pushTokenDB.SavePushToken("selector", "@bob:example.com", "", "pushkey", "com.acrobits.app", "", ""))
+
+		cfg := service.NewTestConfig()
+		cfg.PushRecordMode = service.PushRecordMemory
+		pushSvc := service.NewPushService(nil, pushTokenDB, cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pushSvc.Start(ctx)
+		_, err = pushSvc.HandleMatrixPushNotification(ctx, "@bob:example.com", &models.MatrixPushNotifyRequest{
+			Notification: models.MatrixNotification{
+				EventID: "$ev",
+				Content: map[string]interface{}{"body": "Hello"},
+				Devices: []models.MatrixDevice{{AppID: "com.acrobits.app", Pushkey: "pushkey"}},
+			},
+		})
+		require.NoError(t, err)
+
+		h := handler{adminToken: "test-admin-token", pushSvc: pushSvc}
+		var pushes []models.RecordedPush
+		require.Eventually(t, func() bool {
+			c, rec := newContext(http.MethodGet)
+			require.NoError(t, h.getRecordedPushes(c))
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pushes))
+			return len(pushes) == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "Hello", pushes[0].Request.Message)
+
+		c, _ := newContext(http.MethodDelete)
+		require.NoError(t, h.clearRecordedPushes(c))
+		c, rec := newContext(http.MethodGet)
+		require.NoError(t, h.getRecordedPushes(c))
+		assert.JSONEq(t, `[]`, rec.Body.String())
+	})
+}
+
+func TestReconcilePushers(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/api/internal/reconcile_pushers", nil)
+	req.Header.Set("X-Super-Admin-Token", "test-admin-token")
+	req.RemoteAddr = "127.0.0.1:12345"
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	// Without a Matrix client and a database there is nothing to reconcile
+	h := handler{svc: service.NewMessageService(nil, nil, service.NewTestConfig()), adminToken: "test-admin-token"}
+	err := h.reconcilePushers(c)
+	echoErr, ok := err.(*echo.HTTPError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, echoErr.Code)
+
+	req.Header.Del("X-Super-Admin-Token")
+	err = h.reconcilePushers(e.NewContext(req, httptest.NewRecorder()))
+	echoErr, ok = err.(*echo.HTTPError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, echoErr.Code)
+}
+
+func TestGetDeadPushDeliveries(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+	_, err = pushTokenDB.EnqueuePushDelivery(&db.PushDelivery{Kind: "NotifyTextMessage", EventID: "$ev", Pushkey: "pushkey", Request: `{}`})
+	require.NoError(t, err)
+	claimed, err := pushTokenDB.ClaimPushDeliveries(time.Now(), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.NoError(t, pushTokenDB.UpdatePushDelivery(claimed[0].ID, db.PushDeliveryDead, 8, time.Now(), "pnm unavailable"))
+
+	e := echo.New()
+	h := handler{adminToken: "test-admin-token", pushSvc: service.NewPushService(nil, pushTokenDB, service.NewTestConfig())}
+	newContext := func(target string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Super-Admin-Token", "test-admin-token")
+		req.RemoteAddr = "127.0.0.1:12345"
+		rec := httptest.NewRecorder()
+		return e.NewContext(req, rec), rec
+	}
+
+	c, rec := newContext("/api/internal/push_deliveries")
+	require.NoError(t, h.getDeadPushDeliveries(c))
+	var deliveries []db.PushDelivery
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "$ev", deliveries[0].EventID)
+	assert.Equal(t, db.PushDeliveryDead, deliveries[0].Status)
+	assert.Equal(t, "pnm unavailable", deliveries[0].LastError)
+
+	c, _ = newContext("/api/internal/push_deliveries?limit=0")
+	err = h.getDeadPushDeliveries(c)
+	echoErr, ok := err.(*echo.HTTPError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, echoErr.Code)
+}
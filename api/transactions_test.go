@@ -1,31 +1,183 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/nethesis/matrix2acrobits/service"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMatrixAppTransaction(t *testing.T) {
 	e := echo.New()
+	h := handler{svc: service.NewMessageService(nil, nil, service.NewTestConfig())}
 
-	// Minimal valid-ish transaction body (we don't parse it, only log)
-	payload := `{"events":[], "other": "value"}`
-	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn123", strings.NewReader(payload))
+	t.Run("valid transaction", func(t *testing.T) {
+		payload := `{"events":[{"type":"m.room.name","room_id":"!room:example.com","state_key":"","content":{"name":"Team"}}], "other": "value"}`
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn123", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+		c.SetParamNames("txnId")
+		c.SetParamValues("txn123")
+
+		err := h.matrixAppTransaction(c)
+
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{}`, rec.Body.String())
+	})
+
+	t.Run("invalid payload", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn124", strings.NewReader(`{"events":"nope"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+
+		c := e.NewContext(req, rec)
+		c.SetParamNames("txnId")
+		c.SetParamValues("txn124")
+
+		err := h.matrixAppTransaction(c)
+
+		echoErr, ok := err.(*echo.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusBadRequest, echoErr.Code)
+	})
+}
+
+func TestMatrixAppTransaction_CallHangup(t *testing.T) {
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+	require.NoError(t, pushTokenDB.SavePushToken("selector", "@bob:example.com", "", "pushkey", "com.acrobits.msgs", "calls-token", "com.acrobits.calls"))
+
+	cfg := service.NewTestConfig()
+	cfg.PushRecordMode = service.PushRecordMemory
+	pushSvc := service.NewPushService(nil, pushTokenDB, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pushSvc.Start(ctx)
+	_, err = pushSvc.HandleMatrixPushNotification(context.Background(), "@bob:example.com", &models.MatrixPushNotifyRequest{
+		Notification: models.MatrixNotification{
+			Type:    "m.call.invite",
+			EventID: "$invite",
+			RoomID:  "!room:example.com",
+			Sender:  "@alice:example.com",
+			Content: map[string]interface{}{"call_id": "call1", "lifetime": 60000},
+			Devices: []models.MatrixDevice{{AppID: "com.acrobits.msgs", Pushkey: "pushkey"}},
+		},
+	})
+	require.NoError(t, err)
+	recorded := func(count int) bool {
+		pushes, err := pushSvc.RecordedPushes()
+		return err == nil && len(pushes) == count
+	}
+	require.Eventually(t, func() bool { return recorded(1) }, 2*time.Second, 10*time.Millisecond)
+
+	e := echo.New()
+	h := handler{svc: service.NewMessageService(nil, nil, cfg), pushSvc: pushSvc}
+	payload := `{"events":[{"type":"m.call.hangup","room_id":"!room:example.com","sender":"@alice:example.com","event_id":"$hangup","content":{"call_id":"call1","version":"1"}}]}`
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn1", strings.NewReader(payload))
 	req.Header.Set("Content-Type", "application/json")
 	rec := httptest.NewRecorder()
-
 	c := e.NewContext(req, rec)
 	c.SetParamNames("txnId")
-	c.SetParamValues("txn123")
+	c.SetParamValues("txn1")
+	require.NoError(t, h.matrixAppTransaction(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
 
-	h := handler{}
-	err := h.matrixAppTransaction(c)
+	require.Eventually(t, func() bool { return recorded(2) }, 2*time.Second, 10*time.Millisecond)
+	pushes, err := pushSvc.RecordedPushes()
+	require.NoError(t, err)
+	assert.Equal(t, "NotifyIncomingCall", pushes[0].Request.Verb)
+	assert.Equal(t, "NotifyCancelCall", pushes[1].Request.Verb)
+	assert.Equal(t, "calls-token", pushes[1].Request.DeviceToken)
+}
 
-	assert.NoError(t, err)
-	assert.Equal(t, http.StatusOK, rec.Code)
+func TestMatrixAppTransaction_HSToken(t *testing.T) {
+	e := echo.New()
+	RegisterRoutes(e, service.NewMessageService(nil, nil, service.NewTestConfig()), nil, "admin", "hs-secret", nil)
+
+	send := func(target, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, target, strings.NewReader(`{"events":[]}`))
+		req.Header.Set("Content-Type", "application/json")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		rec := send("/_matrix/app/v1/transactions/txn1", "Bearer hs-secret")
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("legacy query parameter", func(t *testing.T) {
+		rec := send("/_matrix/app/v1/transactions/txn2?access_token=hs-secret", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		rec := send("/_matrix/app/v1/transactions/txn3", "")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.JSONEq(t, `{"errcode":"M_UNAUTHORIZED","error":"missing hs_token"}`, rec.Body.String())
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		rec := send("/_matrix/app/v1/transactions/txn4", "Bearer admin")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.JSONEq(t, `{"errcode":"M_FORBIDDEN","error":"invalid hs_token"}`, rec.Body.String())
+
+		rec = send("/_matrix/app/v1/transactions/txn5?access_token=wrong", "")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("unconfigured token rejects everything", func(t *testing.T) {
+		e := echo.New()
+		RegisterRoutes(e, service.NewMessageService(nil, nil, service.NewTestConfig()), nil, "admin", "", nil)
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/txn6", strings.NewReader(`{"events":[]}`))
+		req.Header.Set("Authorization", "Bearer anything")
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+}
+
+func TestMatrixAppQueries(t *testing.T) {
+	e := echo.New()
+	svc := service.NewMessageService(nil, nil, service.NewTestConfig())
+	RegisterRoutes(e, svc, nil, "admin", "hs-secret", nil)
+
+	query := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer hs-secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := query("/_matrix/app/v1/users/%40carol%3Aexample.com")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"errcode":"M_NOT_FOUND","error":"user not found"}`, rec.Body.String())
+
+	rec = query("/_matrix/app/v1/rooms/%23general%3Aexample.com")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"errcode":"M_NOT_FOUND","error":"room alias not found"}`, rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/app/v1/users/%40carol%3Aexample.com", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
 }
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// Mapping represents a stored extension mapping: a main number, its sub-numbers and the Matrix user they belong to.
+type Mapping struct {
+	Number     int
+	MatrixID   string
+	UserName   string
+	SubNumbers []int
+	UpdatedAt  time.Time
+}
+
+// createMappingsSchema creates the mappings and mapping_sub_numbers tables if they don't exist.
+func (d *Database) createMappingsSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS mappings (
+		number INTEGER PRIMARY KEY,
+		matrix_id TEXT NOT NULL,
+		user_name TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS mapping_sub_numbers (
+		sub_number INTEGER PRIMARY KEY,
+		number INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_mapping_sub_numbers_number ON mapping_sub_numbers(number);
+	`
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create mappings tables: %w", err)
+	}
+	return nil
+}
+
+// SaveMapping saves or updates a mapping by number, replacing its sub-numbers in the same transaction.
+// A sub-number already assigned to another mapping is moved to this one.
+func (d *Database) SaveMapping(m *Mapping) error {
+	return d.SaveMappings([]*Mapping{m})
+}
+
+// SaveMappings saves or updates several mappings in a single transaction, see SaveMapping.
+func (d *Database) SaveMappings(mappings []*Mapping) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin mapping transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	query := `
+	INSERT INTO mappings (number, matrix_id, user_name, updated_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(number) DO UPDATE SET
+		matrix_id = excluded.matrix_id,
+		user_name = excluded.user_name,
+		updated_at = excluded.updated_at;
+	`
+	for _, m := range mappings {
+		if _, err = tx.Exec(query, m.Number, m.MatrixID, m.UserName, m.UpdatedAt.UTC()); err != nil {
+			return fmt.Errorf("failed to save mapping: %w", err)
+		}
+		if _, err = tx.Exec(`DELETE FROM mapping_sub_numbers WHERE number = ?;`, m.Number); err != nil {
+			return fmt.Errorf("failed to clear mapping sub-numbers: %w", err)
+		}
+		for _, sub := range m.SubNumbers {
+			if _, err = tx.Exec(`INSERT OR REPLACE INTO mapping_sub_numbers (sub_number, number) VALUES (?, ?);`, sub, m.Number); err != nil {
+				return fmt.Errorf("failed to save mapping sub-number: %w", err)
+			}
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit mapping: %w", err)
+	}
+
+	for _, m := range mappings {
+		logger.Debug().Int("number", m.Number).Str("matrix_id", m.MatrixID).Msg("mapping saved")
+	}
+	return nil
+}
+
+// ListMappings returns all stored mappings with their sorted sub-numbers, least recently updated first.
+func (d *Database) ListMappings() ([]*Mapping, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	query := `
+	SELECT m.number, m.matrix_id, COALESCE(m.user_name, ''), m.updated_at, s.sub_number
+	FROM mappings m
+	LEFT JOIN mapping_sub_numbers s ON s.number = m.number
+	ORDER BY m.updated_at ASC, m.number ASC, s.sub_number ASC;
+	`
+
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query mappings: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var mappings []*Mapping
+	var last *Mapping
+	for rows.Next() {
+		var m Mapping
+		var sub sql.NullInt64
+		if err := rows.Scan(&m.Number, &m.MatrixID, &m.UserName, &m.UpdatedAt, &sub); err != nil {
+			return nil, fmt.Errorf("failed to scan mapping: %w", err)
+		}
+		if last == nil || last.Number != m.Number {
+			last = &m
+			mappings = append(mappings, last)
+		}
+		if sub.Valid {
+			last.SubNumbers = append(last.SubNumbers, int(sub.Int64))
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating mappings: %w", err)
+	}
+
+	return mappings, nil
+}
+
+// DeleteMappings removes all the mappings, and their sub-numbers, pointing to the given Matrix ID.
+func (d *Database) DeleteMappings(matrixID string) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin mapping transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(`DELETE FROM mapping_sub_numbers WHERE number IN (SELECT number FROM mappings WHERE matrix_id = ? COLLATE NOCASE);`, matrixID); err != nil {
+		return fmt.Errorf("failed to delete mapping sub-numbers: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM mappings WHERE matrix_id = ? COLLATE NOCASE;`, matrixID); err != nil {
+		return fmt.Errorf("failed to delete mappings: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit mapping deletion: %w", err)
+	}
+
+	logger.Debug().Str("matrix_id", matrixID).Msg("mappings deleted")
+	return nil
+}
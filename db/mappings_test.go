@@ -0,0 +1,98 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveAndListMappings(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_mappings_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 201, MatrixID: "@alice:example.com", UserName: "alice", SubNumbers: []int{91201, 3344}, UpdatedAt: now}))
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 202, MatrixID: "@bob:example.com", UserName: "bob", UpdatedAt: now.Add(time.Second)}))
+	require.NoError(t, db.Close())
+
+	// Mappings survive reopening the database
+	db, err = NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	mappings, err := db.ListMappings()
+	require.NoError(t, err)
+	require.Len(t, mappings, 2)
+	assert.Equal(t, 201, mappings[0].Number)
+	assert.Equal(t, "@alice:example.com", mappings[0].MatrixID)
+	assert.Equal(t, "alice", mappings[0].UserName)
+	assert.Equal(t, []int{3344, 91201}, mappings[0].SubNumbers)
+	assert.True(t, now.Equal(mappings[0].UpdatedAt))
+	assert.Equal(t, 202, mappings[1].Number)
+	assert.Empty(t, mappings[1].SubNumbers)
+}
+
+func TestSaveMappingReplacesSubNumbers(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 201, MatrixID: "@alice:example.com", SubNumbers: []int{91201, 3344}, UpdatedAt: time.Now()}))
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 201, MatrixID: "@alice:example.com", SubNumbers: []int{91201}, UpdatedAt: time.Now()}))
+	// 3344 moves to another mapping
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 202, MatrixID: "@bob:example.com", SubNumbers: []int{3344}, UpdatedAt: time.Now()}))
+
+	mappings, err := db.ListMappings()
+	require.NoError(t, err)
+	require.Len(t, mappings, 2)
+	assert.Equal(t, []int{91201}, mappings[0].SubNumbers)
+	assert.Equal(t, []int{3344}, mappings[1].SubNumbers)
+}
+
+func TestSaveMappings(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveMappings([]*Mapping{
+		{Number: 201, MatrixID: "@alice:example.com", SubNumbers: []int{91201}, UpdatedAt: time.Now()},
+		{Number: 202, MatrixID: "@bob:example.com", SubNumbers: []int{91202}, UpdatedAt: time.Now()},
+	}))
+	// Sub-numbers move between the mappings of the same batch
+	require.NoError(t, db.SaveMappings([]*Mapping{
+		{Number: 201, MatrixID: "@alice:example.com", UpdatedAt: time.Now()},
+		{Number: 202, MatrixID: "@bob:example.com", SubNumbers: []int{91201, 91202}, UpdatedAt: time.Now()},
+	}))
+
+	mappings, err := db.ListMappings()
+	require.NoError(t, err)
+	require.Len(t, mappings, 2)
+	assert.Empty(t, mappings[0].SubNumbers)
+	assert.Equal(t, []int{91201, 91202}, mappings[1].SubNumbers)
+}
+
+func TestDeleteMappings(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 201, MatrixID: "@alice:example.com", SubNumbers: []int{91201}, UpdatedAt: time.Now()}))
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 202, MatrixID: "@bob:example.com", UpdatedAt: time.Now()}))
+
+	require.NoError(t, db.DeleteMappings("@Alice:example.com"))
+
+	mappings, err := db.ListMappings()
+	require.NoError(t, err)
+	require.Len(t, mappings, 1)
+	assert.Equal(t, 202, mappings[0].Number)
+
+	// The sub-number is free again
+	require.NoError(t, db.SaveMapping(&Mapping{Number: 203, MatrixID: "@carol:example.com", SubNumbers: []int{91201}, UpdatedAt: time.Now()}))
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Push delivery states
+const (
+	// PushDeliveryPending deliveries are waiting for their next attempt
+	PushDeliveryPending = "pending"
+	// PushDeliveryDelivered deliveries were accepted by the Acrobits PNM
+	PushDeliveryDelivered = "delivered"
+	// PushDeliveryDead deliveries failed too many times and are no longer attempted
+	PushDeliveryDead = "dead"
+	// PushDeliveryRejected deliveries were refused by the Acrobits PNM because the device token is no longer valid
+	PushDeliveryRejected = "rejected"
+	// PushDeliveryCancelled deliveries were no longer worth sending: superseded, cancelled call or expired
+	PushDeliveryCancelled = "cancelled"
+)
+
+// PushDeliveryNotification is the kind of the deliveries holding a notification received from the homeserver,
+// turned into pushes by the delivery workers. The kind of the pushes is their Acrobits verb.
+const PushDeliveryNotification = "notification"
+
+// PushDelivery is a notification or a push queued for delivery to the Acrobits PNM.
+// Request is the JSON encoded notification or Acrobits push request, depending on Kind.
+type PushDelivery struct {
+	ID            int64      `json:"id"`
+	Kind          string     `json:"kind"`
+	EventID       string     `json:"event_id"`
+	Pushkey       string     `json:"pushkey"`
+	Request       string     `json:"request"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// createPushDeliveriesSchema creates the push_deliveries table if it doesn't exist.
+// A delivery is queued once per kind, event and pushkey: event_id is NULL for deliveries without an event,
+// which are not deduplicated.
+func (d *Database) createPushDeliveriesSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS push_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		event_id TEXT,
+		pushkey TEXT NOT NULL,
+		request TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		expires_at DATETIME,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (kind, event_id, pushkey)
+	);
+	CREATE INDEX IF NOT EXISTS idx_push_deliveries_due ON push_deliveries (status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_push_deliveries_pushkey ON push_deliveries (pushkey, id);
+	`
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create push_deliveries table: %w", err)
+	}
+	return nil
+}
+
+const pushDeliveryColumns = `id, kind, COALESCE(event_id, ''), pushkey, request, status, attempts, next_attempt_at, expires_at, last_error, created_at, updated_at`
+
+func scanPushDelivery(row interface{ Scan(...any) error }) (*PushDelivery, error) {
+	var pd PushDelivery
+	var expiresAt sql.NullTime
+	if err := row.Scan(&pd.ID, &pd.Kind, &pd.EventID, &pd.Pushkey, &pd.Request, &pd.Status, &pd.Attempts, &pd.NextAttemptAt, &expiresAt, &pd.LastError, &pd.CreatedAt, &pd.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		pd.ExpiresAt = &expiresAt.Time
+	}
+	return &pd, nil
+}
+
+// nullableEventID stores the deliveries without an event as NULL, so they are not deduplicated.
+func nullableEventID(eventID string) sql.NullString {
+	return sql.NullString{String: eventID, Valid: eventID != ""}
+}
+
+// EnqueuePushDelivery queues the kind, event, pushkey, request and optional expiry of delivery, due at once.
+// It returns false when a delivery of the same kind and event was already queued for the pushkey.
+func (d *Database) EnqueuePushDelivery(delivery *PushDelivery) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var expiresAt sql.NullTime
+	if delivery.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: delivery.ExpiresAt.UTC(), Valid: true}
+	}
+	now := time.Now().UTC()
+	result, err := d.db.Exec(`
+	INSERT OR IGNORE INTO push_deliveries (kind, event_id, pushkey, request, status, attempts, next_attempt_at, expires_at, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?);
+	`, delivery.Kind, nullableEventID(delivery.EventID), delivery.Pushkey, delivery.Request, PushDeliveryPending, now, expiresAt, now, now)
+	if err != nil {
+		return false, fmt.Errorf("failed to enqueue push delivery: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// ClaimPushDeliveries returns up to limit pending deliveries due at now, oldest first, and postpones them by lease
+// so other workers do not take them. A delivery not updated before the lease expires, e.g. after a crash, is due again.
+func (d *Database) ClaimPushDeliveries(now time.Time, limit int, lease time.Duration) ([]*PushDelivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	rows, err := d.db.Query(`SELECT `+pushDeliveryColumns+` FROM push_deliveries
+	WHERE status = ? AND next_attempt_at <= ?
+	ORDER BY next_attempt_at, id
+	LIMIT ?;`, PushDeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due push deliveries: %w", err)
+	}
+	var deliveries []*PushDelivery
+	for rows.Next() {
+		pd, err := scanPushDelivery(rows)
+		if err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("failed to scan push delivery: %w", err)
+		}
+		deliveries = append(deliveries, pd)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("error iterating push deliveries: %w", err)
+	}
+
+	leaseEnd := now.Add(lease).UTC()
+	for _, pd := range deliveries {
+		if _, err := d.db.Exec(`UPDATE push_deliveries SET next_attempt_at = ? WHERE id = ?;`, leaseEnd, pd.ID); err != nil {
+			return nil, fmt.Errorf("failed to claim push delivery: %w", err)
+		}
+		pd.NextAttemptAt = leaseEnd
+	}
+	return deliveries, nil
+}
+
+// UpdatePushDelivery records the outcome of a delivery attempt: its new status, the attempts made so far,
+// when to try again for pending deliveries, and the last error.
+func (d *Database) UpdatePushDelivery(id int64, status string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+	UPDATE push_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, updated_at = ?
+	WHERE id = ?;
+	`, status, attempts, nextAttemptAt.UTC(), lastError, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update push delivery: %w", err)
+	}
+	return nil
+}
+
+// CancelPushDeliveries cancels the pending deliveries of the given kind and event to pushkey, an empty event
+// matching the deliveries without one, and returns how many were cancelled.
+func (d *Database) CancelPushDeliveries(kind, eventID, pushkey string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`
+	UPDATE push_deliveries SET status = ?, updated_at = ?
+	WHERE kind = ? AND event_id IS ? AND pushkey = ? AND status = ?;
+	`, PushDeliveryCancelled, time.Now().UTC(), kind, nullableEventID(eventID), pushkey, PushDeliveryPending)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel push deliveries: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected, nil
+}
+
+// PushkeyRejected reports whether the latest push sent to pushkey since the given time was rejected by the Acrobits PNM.
+// Passing the time the token was last reported lets a device report again a token it had lost.
+func (d *Database) PushkeyRejected(pushkey string, since time.Time) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var status string
+	err := d.db.QueryRow(`
+	SELECT status FROM push_deliveries WHERE pushkey = ? AND kind != ? AND status IN (?, ?) AND updated_at >= ?
+	ORDER BY id DESC LIMIT 1;
+	`, pushkey, PushDeliveryNotification, PushDeliveryDelivered, PushDeliveryRejected, since.UTC()).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to look up push deliveries: %w", err)
+	}
+	return status == PushDeliveryRejected, nil
+}
+
+// ListPushDeliveries returns up to limit deliveries with the given status, most recent first.
+func (d *Database) ListPushDeliveries(status string, limit int) ([]*PushDelivery, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT `+pushDeliveryColumns+` FROM push_deliveries WHERE status = ? ORDER BY id DESC LIMIT ?;`, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query push deliveries: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	deliveries := []*PushDelivery{}
+	for rows.Next() {
+		pd, err := scanPushDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan push delivery: %w", err)
+		}
+		deliveries = append(deliveries, pd)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating push deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// PrunePushDeliveries removes the finished deliveries last updated before the given time and returns how many were removed.
+func (d *Database) PrunePushDeliveries(before time.Time) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM push_deliveries WHERE status != ? AND updated_at < ?;`, PushDeliveryPending, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune push deliveries: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected, nil
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushDeliveries(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	enqueue := func(kind, eventID, pushkey, request string) bool {
+		queued, err := db.EnqueuePushDelivery(&PushDelivery{Kind: kind, EventID: eventID, Pushkey: pushkey, Request: request})
+		require.NoError(t, err)
+		return queued
+	}
+
+	assert.True(t, enqueue("NotifyTextMessage", "$ev1", "key1", `{"verb":"NotifyTextMessage"}`))
+	// The same event is queued once per kind and pushkey
+	assert.False(t, enqueue("NotifyTextMessage", "$ev1", "key1", `{}`))
+	assert.True(t, enqueue("NotifyTextMessage", "$ev1", "key2", `{}`))
+	assert.True(t, enqueue(PushDeliveryNotification, "$ev1", "key1", `{}`))
+	// Deliveries without an event are not deduplicated
+	for i := 0; i < 2; i++ {
+		assert.True(t, enqueue("NotifyBadge", "", "key1", `{}`))
+	}
+
+	now := time.Now()
+	claimed, err := db.ClaimPushDeliveries(now.Add(time.Second), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 5)
+	assert.Equal(t, "NotifyTextMessage", claimed[0].Kind)
+	assert.Equal(t, "$ev1", claimed[0].EventID)
+	assert.Equal(t, "key1", claimed[0].Pushkey)
+	assert.Equal(t, `{"verb":"NotifyTextMessage"}`, claimed[0].Request)
+	assert.Equal(t, PushDeliveryPending, claimed[0].Status)
+	assert.Nil(t, claimed[0].ExpiresAt)
+	assert.Equal(t, PushDeliveryNotification, claimed[2].Kind)
+	assert.Empty(t, claimed[3].EventID)
+
+	// Claimed deliveries are not due until the lease expires
+	again, err := db.ClaimPushDeliveries(now.Add(time.Second), 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, again)
+	again, err = db.ClaimPushDeliveries(now.Add(2*time.Minute), 1, time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, again, 1)
+
+	require.NoError(t, db.UpdatePushDelivery(claimed[0].ID, PushDeliveryDelivered, 1, now, ""))
+	require.NoError(t, db.UpdatePushDelivery(claimed[1].ID, PushDeliveryDead, 8, now, "pnm unavailable"))
+	require.NoError(t, db.UpdatePushDelivery(claimed[2].ID, PushDeliveryDelivered, 1, now, ""))
+	require.NoError(t, db.UpdatePushDelivery(claimed[3].ID, PushDeliveryPending, 2, now.Add(time.Hour), "timeout"))
+
+	dead, err := db.ListPushDeliveries(PushDeliveryDead, 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, "key2", dead[0].Pushkey)
+	assert.Equal(t, 8, dead[0].Attempts)
+	assert.Equal(t, "pnm unavailable", dead[0].LastError)
+
+	pruned, err := db.PrunePushDeliveries(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), pruned)
+	pending, err := db.ListPushDeliveries(PushDeliveryPending, 10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+}
+
+func TestCancelPushDeliveries(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Second)
+	for _, delivery := range []*PushDelivery{
+		{Kind: "NotifyIncomingCall", EventID: "$invite", Pushkey: "calls", Request: `{}`, ExpiresAt: &expiresAt},
+		{Kind: "NotifyIncomingCall", EventID: "$other", Pushkey: "calls", Request: `{}`},
+		{Kind: "NotifyBadge", Pushkey: "msgs", Request: `{}`},
+		{Kind: "NotifyBadge", Pushkey: "msgs", Request: `{}`},
+	} {
+		_, err := db.EnqueuePushDelivery(delivery)
+		require.NoError(t, err)
+	}
+
+	cancelled, err := db.CancelPushDeliveries("NotifyIncomingCall", "$invite", "calls")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), cancelled)
+	// An empty event matches the deliveries without one
+	cancelled, err = db.CancelPushDeliveries("NotifyBadge", "", "msgs")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), cancelled)
+
+	pending, err := db.ListPushDeliveries(PushDeliveryPending, 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "$other", pending[0].EventID)
+
+	cancelledDeliveries, err := db.ListPushDeliveries(PushDeliveryCancelled, 10)
+	require.NoError(t, err)
+	require.Len(t, cancelledDeliveries, 3)
+	require.NotNil(t, cancelledDeliveries[2].ExpiresAt)
+	assert.True(t, expiresAt.Equal(*cancelledDeliveries[2].ExpiresAt))
+}
+
+func TestPushkeyRejected(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	start := time.Now()
+
+	rejected, err := db.PushkeyRejected("key1", start)
+	require.NoError(t, err)
+	assert.False(t, rejected)
+
+	_, err = db.EnqueuePushDelivery(&PushDelivery{Kind: "NotifyTextMessage", EventID: "$ev1", Pushkey: "key1", Request: `{}`})
+	require.NoError(t, err)
+	claimed, err := db.ClaimPushDeliveries(time.Now(), 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.NoError(t, db.UpdatePushDelivery(claimed[0].ID, PushDeliveryRejected, 1, time.Now(), "push token not found"))
+
+	rejected, err = db.PushkeyRejected("key1", start)
+	require.NoError(t, err)
+	assert.True(t, rejected)
+	// The rejections before the token was reported again are ignored
+	rejected, err = db.PushkeyRejected("key1", time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.False(t, rejected)
+
+	// Notifications turned into pushes do not clear the rejection, a later push accepted by the PNM does
+	for _, kind := range []string{PushDeliveryNotification, "NotifyTextMessage"} {
+		_, err = db.EnqueuePushDelivery(&PushDelivery{Kind: kind, EventID: "$ev2", Pushkey: "key1", Request: `{}`})
+		require.NoError(t, err)
+		claimed, err = db.ClaimPushDeliveries(time.Now(), 10, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		require.NoError(t, db.UpdatePushDelivery(claimed[0].ID, PushDeliveryDelivered, 1, time.Now(), ""))
+		rejected, err = db.PushkeyRejected("key1", start)
+		require.NoError(t, err)
+		assert.Equal(t, kind == PushDeliveryNotification, rejected)
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// createPushSettingsSchema creates the push_settings table if it doesn't exist.
+func (d *Database) createPushSettingsSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS push_settings (
+		user_id TEXT PRIMARY KEY,
+		hide_content INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create push_settings table: %w", err)
+	}
+	return nil
+}
+
+// SetPushHideContent sets whether the push notifications of a Matrix user show a generic text
+// instead of the message content and sender.
+func (d *Database) SetPushHideContent(userID string, hide bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query := `
+	INSERT INTO push_settings (user_id, hide_content, updated_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		hide_content = excluded.hide_content,
+		updated_at = excluded.updated_at;
+	`
+	if _, err := d.db.Exec(query, userID, hide, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save push settings: %w", err)
+	}
+	return nil
+}
+
+// GetPushHideContent reports whether the push notifications of a Matrix user hide the message content.
+// Users without settings get the message content.
+func (d *Database) GetPushHideContent(userID string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var hide bool
+	err := d.db.QueryRow(`SELECT hide_content FROM push_settings WHERE user_id = ?;`, userID).Scan(&hide)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get push settings: %w", err)
+	}
+	return hide, nil
+}
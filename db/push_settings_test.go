@@ -0,0 +1,31 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushHideContent(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	hide, err := db.GetPushHideContent("@alice:example.com")
+	require.NoError(t, err)
+	assert.False(t, hide)
+
+	require.NoError(t, db.SetPushHideContent("@alice:example.com", true))
+	hide, err = db.GetPushHideContent("@alice:example.com")
+	require.NoError(t, err)
+	assert.True(t, hide)
+	hide, err = db.GetPushHideContent("@bob:example.com")
+	require.NoError(t, err)
+	assert.False(t, hide)
+
+	require.NoError(t, db.SetPushHideContent("@alice:example.com", false))
+	hide, err = db.GetPushHideContent("@alice:example.com")
+	require.NoError(t, err)
+	assert.False(t, hide)
+}
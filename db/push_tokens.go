@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -10,10 +11,16 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// ErrPushTokenOwnedByOtherUser is returned when a selector, or one of its device tokens, is reported by a user
+// other than the one owning it.
+var ErrPushTokenOwnedByOtherUser = errors.New("push token belongs to another user")
+
 // PushToken represents a stored push token record.
 type PushToken struct {
 	ID         int
 	Selector   string
+	UserID     string
+	DeviceID   string
 	TokenMsgs  string
 	AppIDMsgs  string
 	TokenCalls string
@@ -22,7 +29,7 @@ type PushToken struct {
 	UpdatedAt  time.Time
 }
 
-// Database manages push token persistence using SQLite.
+// Database manages push token, mapping and sync token persistence using SQLite.
 type Database struct {
 	db *sql.DB
 	mu sync.RWMutex
@@ -39,6 +46,8 @@ func NewDatabase(dbPath string) (*Database, error) {
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping sqlite database: %w", err)
 	}
+	// SQLite allows a single writer: serialize access, and keep in-memory databases on one connection
+	db.SetMaxOpenConns(1)
 
 	d := &Database{db: db}
 
@@ -50,11 +59,11 @@ func NewDatabase(dbPath string) (*Database, error) {
 		return nil, err
 	}
 
-	logger.Info().Str("path", dbPath).Msg("push token database initialized")
+	logger.Info().Str("path", dbPath).Msg("database initialized")
 	return d, nil
 }
 
-// createSchema creates the push_tokens table if it doesn't exist.
+// createSchema creates the push_tokens, mappings, sync_tokens, push_settings, push_deliveries and as_transactions tables if they don't exist.
 func (d *Database) createSchema() error {
 	query := `
 	CREATE TABLE IF NOT EXISTS push_tokens (
@@ -72,51 +81,164 @@ func (d *Database) createSchema() error {
 	if err != nil {
 		return fmt.Errorf("failed to create push_tokens table: %w", err)
 	}
+	// Databases created before tokens were bound to a Matrix user lack the user_id column
+	if err := d.addColumnIfMissing("push_tokens", "user_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := d.addColumnIfMissing("push_tokens", "device_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := d.db.Exec(`CREATE INDEX IF NOT EXISTS idx_push_tokens_user_id ON push_tokens (user_id);`); err != nil {
+		return fmt.Errorf("failed to create push_tokens user index: %w", err)
+	}
+	if err := d.createMappingsSchema(); err != nil {
+		return err
+	}
+	if err := d.createSyncTokensSchema(); err != nil {
+		return err
+	}
+	if err := d.createPushSettingsSchema(); err != nil {
+		return err
+	}
+	if err := d.createPushDeliveriesSchema(); err != nil {
+		return err
+	}
+	if err := d.createReadReceiptsSchema(); err != nil {
+		return err
+	}
+	return d.createTransactionsSchema()
+}
+
+// addColumnIfMissing adds a column to an existing table, used to migrate databases created by older versions.
+func (d *Database) addColumnIfMissing(table, column, definition string) error {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s columns: %w", table, err)
+	}
+	found := false
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			ctype      string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &defaultVal, &pk); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed to scan %s columns: %w", table, err)
+		}
+		if name == column {
+			found = true
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("failed to read %s columns: %w", table, err)
+	}
+	if found {
+		return nil
+	}
+	if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	logger.Info().Str("table", table).Str("column", column).Msg("database column added")
 	return nil
 }
 
+// pushTokenColumns are the push_tokens columns read by scanPushToken.
+const pushTokenColumns = `id, selector, user_id, device_id, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at`
+
+// scanPushToken reads a push token selected with pushTokenColumns.
+func scanPushToken(row interface{ Scan(...any) error }) (*PushToken, error) {
+	var pt PushToken
+	if err := row.Scan(&pt.ID, &pt.Selector, &pt.UserID, &pt.DeviceID, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &pt, nil
+}
+
 // SavePushToken saves or updates a push token record by selector.
-func (d *Database) SavePushToken(selector, tokenMsgs, appIDMsgs, tokenCalls, appIDCalls string) error {
+// userID is the Matrix user owning the token, notifications for other users are not delivered to it.
+// The token is bound to the first user reporting it: updates by another user are refused with
+// ErrPushTokenOwnedByOtherUser, tokens saved without a user are bound to the next one.
+// The device tokens are bound to their user too: a pushkey already stored by another user's selector is refused.
+// deviceID identifies the app installation reporting the token, a user can have several.
+func (d *Database) SavePushToken(selector, userID, deviceID, tokenMsgs, appIDMsgs, tokenCalls, appIDCalls string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	owned, err := d.pushkeyOwnedByOtherUser(selector, userID, tokenMsgs, tokenCalls)
+	if err != nil {
+		return err
+	}
+	if owned {
+		return ErrPushTokenOwnedByOtherUser
+	}
+
 	now := time.Now().UTC()
 
 	query := `
-	INSERT INTO push_tokens (selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO push_tokens (selector, user_id, device_id, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(selector) DO UPDATE SET
+		user_id = excluded.user_id,
+		device_id = excluded.device_id,
 		token_msgs = excluded.token_msgs,
 		appid_msgs = excluded.appid_msgs,
 		token_calls = excluded.token_calls,
 		appid_calls = excluded.appid_calls,
-		updated_at = excluded.updated_at;
+		updated_at = excluded.updated_at
+	WHERE push_tokens.user_id = '' OR push_tokens.user_id = excluded.user_id;
 	`
 
-	_, err := d.db.Exec(query, selector, tokenMsgs, appIDMsgs, tokenCalls, appIDCalls, now, now)
+	result, err := d.db.Exec(query, selector, userID, deviceID, tokenMsgs, appIDMsgs, tokenCalls, appIDCalls, now, now)
 	if err != nil {
 		return fmt.Errorf("failed to save push token: %w", err)
 	}
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if saved == 0 {
+		return ErrPushTokenOwnedByOtherUser
+	}
 
 	logger.Debug().Str("selector", selector).Msg("push token saved")
 	return nil
 }
 
+// pushkeyOwnedByOtherUser reports whether one of the non-empty pushkeys is stored by the selector of a user
+// other than userID. The caller holds d.mu.
+func (d *Database) pushkeyOwnedByOtherUser(selector, userID string, pushkeys ...string) (bool, error) {
+	for _, pushkey := range pushkeys {
+		if pushkey == "" {
+			continue
+		}
+		query := `
+		SELECT COUNT(*) FROM push_tokens
+		WHERE selector != ? AND user_id != '' AND user_id != ? AND (token_msgs = ? OR token_calls = ?);
+		`
+		var count int
+		if err := d.db.QueryRow(query, selector, userID, pushkey, pushkey).Scan(&count); err != nil {
+			return false, fmt.Errorf("failed to look up pushkey owner: %w", err)
+		}
+		if count > 0 {
+			logger.Warn().Str("selector", selector).Str("user_id", userID).Msg("pushkey already reported by another user")
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // GetPushToken retrieves a push token by selector.
 func (d *Database) GetPushToken(selector string) (*PushToken, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var pt PushToken
-	query := `
-	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at
-	FROM push_tokens
-	WHERE selector = ?;
-	`
+	query := `SELECT ` + pushTokenColumns + ` FROM push_tokens WHERE selector = ?;`
 
-	err := d.db.QueryRow(query, selector).Scan(
-		&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt,
-	)
+	pt, err := scanPushToken(d.db.QueryRow(query, selector))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -124,25 +246,24 @@ func (d *Database) GetPushToken(selector string) (*PushToken, error) {
 		return nil, fmt.Errorf("failed to get push token: %w", err)
 	}
 
-	return &pt, nil
+	return pt, nil
 }
 
 // GetPushTokenByPushkey retrieves a push token by the actual device token (pushkey).
-// The pushkey can be either token_msgs or token_calls.
-func (d *Database) GetPushTokenByPushkey(pushkey string) (*PushToken, error) {
+// The pushkey can be either token_msgs or token_calls. When several selectors store it, the token of userID
+// is preferred, then a token without a user, then the most recently updated one.
+func (d *Database) GetPushTokenByPushkey(pushkey, userID string) (*PushToken, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	var pt PushToken
 	query := `
-	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at
-	FROM push_tokens
-	WHERE token_msgs = ? OR token_calls = ?;
+	SELECT ` + pushTokenColumns + ` FROM push_tokens
+	WHERE token_msgs = ? OR token_calls = ?
+	ORDER BY CASE WHEN user_id = ? THEN 0 WHEN user_id = '' THEN 1 ELSE 2 END, updated_at DESC
+	LIMIT 1;
 	`
 
-	err := d.db.QueryRow(query, pushkey, pushkey).Scan(
-		&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt,
-	)
+	pt, err := scanPushToken(d.db.QueryRow(query, pushkey, pushkey, userID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -150,7 +271,27 @@ func (d *Database) GetPushTokenByPushkey(pushkey string) (*PushToken, error) {
 		return nil, fmt.Errorf("failed to get push token by pushkey: %w", err)
 	}
 
-	return &pt, nil
+	return pt, nil
+}
+
+// BindPushToken binds a token saved without a user, by an older version, to the Matrix user owning its pusher.
+// It reports whether the token was bound: tokens already owned by a user are left unchanged.
+func (d *Database) BindPushToken(selector, userID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`UPDATE push_tokens SET user_id = ? WHERE selector = ? AND user_id = '';`, userID, selector)
+	if err != nil {
+		return false, fmt.Errorf("failed to bind push token: %w", err)
+	}
+	bound, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if bound > 0 {
+		logger.Info().Str("selector", selector).Str("user_id", userID).Msg("push token bound to its user")
+	}
+	return bound > 0, nil
 }
 
 // DeletePushToken removes a push token by selector.
@@ -173,13 +314,22 @@ func (d *Database) ListPushTokens() ([]*PushToken, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	query := `
-	SELECT id, selector, token_msgs, appid_msgs, token_calls, appid_calls, created_at, updated_at
-	FROM push_tokens
-	ORDER BY updated_at DESC;
-	`
+	query := `SELECT ` + pushTokenColumns + ` FROM push_tokens ORDER BY updated_at DESC;`
+	return d.queryPushTokens(query)
+}
+
+// ListPushTokensByUser returns the push tokens of every device of a Matrix user, most recently updated first.
+func (d *Database) ListPushTokensByUser(userID string) ([]*PushToken, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	query := `SELECT ` + pushTokenColumns + ` FROM push_tokens WHERE user_id = ? ORDER BY updated_at DESC;`
+	return d.queryPushTokens(query, userID)
+}
 
-	rows, err := d.db.Query(query)
+// queryPushTokens runs a query selecting pushTokenColumns. The caller holds d.mu.
+func (d *Database) queryPushTokens(query string, args ...any) ([]*PushToken, error) {
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query push tokens: %w", err)
 	}
@@ -189,11 +339,11 @@ func (d *Database) ListPushTokens() ([]*PushToken, error) {
 
 	var tokens []*PushToken
 	for rows.Next() {
-		var pt PushToken
-		if err := rows.Scan(&pt.ID, &pt.Selector, &pt.TokenMsgs, &pt.AppIDMsgs, &pt.TokenCalls, &pt.AppIDCalls, &pt.CreatedAt, &pt.UpdatedAt); err != nil {
+		pt, err := scanPushToken(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan push token: %w", err)
 		}
-		tokens = append(tokens, &pt)
+		tokens = append(tokens, pt)
 	}
 
 	if err = rows.Err(); err != nil {
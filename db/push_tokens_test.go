@@ -1,6 +1,7 @@
 package db
 
 import (
+	"database/sql"
 	"os"
 	"testing"
 	"time"
@@ -38,7 +39,7 @@ func TestSavePushToken(t *testing.T) {
 	tokenCalls := "Udl99X2JFP1bWwS5gR/wGeLE1hmAB2CMpr1Ej0wxkrY="
 	appIDCalls := "com.cloudsoftphone.app.pushkit"
 
-	err = db.SavePushToken(selector, tokenMsgs, appIDMsgs, tokenCalls, appIDCalls)
+	err = db.SavePushToken(selector, "@alice:example.com", "", tokenMsgs, appIDMsgs, tokenCalls, appIDCalls)
 	assert.NoError(t, err)
 
 	// Verify it was saved
@@ -46,6 +47,7 @@ func TestSavePushToken(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, token)
 	assert.Equal(t, selector, token.Selector)
+	assert.Equal(t, "@alice:example.com", token.UserID)
 	assert.Equal(t, tokenMsgs, token.TokenMsgs)
 	assert.Equal(t, appIDMsgs, token.AppIDMsgs)
 	assert.Equal(t, tokenCalls, token.TokenCalls)
@@ -66,11 +68,11 @@ func TestUpdatePushToken(t *testing.T) {
 	tokenMsgs2 := "token_v2"
 
 	// Save first version
-	err = db.SavePushToken(selector, tokenMsgs1, "app1", "", "")
+	err = db.SavePushToken(selector, "", "", tokenMsgs1, "app1", "", "")
 	assert.NoError(t, err)
 
 	// Update with new token
-	err = db.SavePushToken(selector, tokenMsgs2, "app1", "", "")
+	err = db.SavePushToken(selector, "", "", tokenMsgs2, "app1", "", "")
 	assert.NoError(t, err)
 
 	// Verify it was updated
@@ -106,7 +108,7 @@ func TestDeletePushToken(t *testing.T) {
 	selector := "12869E0E6E553673C54F29105A0647204C416A2A:7C3A0D14"
 
 	// Save a token
-	err = db.SavePushToken(selector, "token123", "app1", "", "")
+	err = db.SavePushToken(selector, "", "", "token123", "app1", "", "")
 	assert.NoError(t, err)
 
 	// Delete it
@@ -136,7 +138,7 @@ func TestListPushTokens(t *testing.T) {
 	}
 
 	for _, sel := range selectors {
-		err = db.SavePushToken(sel, "token_"+sel, "app", "", "")
+		err = db.SavePushToken(sel, "", "", "token_"+sel, "app", "", "")
 		assert.NoError(t, err)
 	}
 
@@ -166,3 +168,165 @@ func TestListPushTokensEmpty(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Len(t, tokens, 0)
 }
+
+func TestPushTokensUserIDMigration(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_push_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	// Schema created by versions that did not bind tokens to a user
+	old, err := sql.Open("sqlite", tmpFile.Name())
+	require.NoError(t, err)
+	_, err = old.Exec(`CREATE TABLE push_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		selector TEXT NOT NULL UNIQUE,
+		token_msgs TEXT,
+		appid_msgs TEXT,
+		token_calls TEXT,
+		appid_calls TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO push_tokens (selector, token_msgs, appid_msgs, token_calls, appid_calls) VALUES ('sel', 'tok', 'app', '', '');`)
+	require.NoError(t, err)
+	require.NoError(t, old.Close())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	token, err := db.GetPushTokenByPushkey("tok", "@alice:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	assert.Equal(t, "", token.UserID)
+	assert.Equal(t, "", token.DeviceID)
+
+	require.NoError(t, db.SavePushToken("sel", "@alice:example.com", "install1", "tok", "app", "", ""))
+	token, err = db.GetPushToken("sel")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", token.UserID)
+	assert.Equal(t, "install1", token.DeviceID)
+}
+
+func TestBindPushToken(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("legacy", "", "", "tok1", "app", "", ""))
+	require.NoError(t, db.SavePushToken("owned", "@bob:example.com", "", "tok2", "app", "", ""))
+
+	bound, err := db.BindPushToken("legacy", "@alice:example.com")
+	require.NoError(t, err)
+	assert.True(t, bound)
+	// Tokens owned by a user are never bound to another one
+	for _, selector := range []string{"legacy", "owned"} {
+		bound, err = db.BindPushToken(selector, "@carol:example.com")
+		require.NoError(t, err)
+		assert.False(t, bound)
+	}
+
+	token, err := db.GetPushToken("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", token.UserID)
+	token, err = db.GetPushToken("owned")
+	require.NoError(t, err)
+	assert.Equal(t, "@bob:example.com", token.UserID)
+}
+
+func TestSavePushTokenOwnership(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("sel", "@alice:example.com", "install1", "alice-token", "app", "", ""))
+
+	// Another user cannot take over the selector
+	err = db.SavePushToken("sel", "@mallory:example.com", "install9", "mallory-token", "app", "", "")
+	assert.ErrorIs(t, err, ErrPushTokenOwnedByOtherUser)
+	token, err := db.GetPushToken("sel")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", token.UserID)
+	assert.Equal(t, "alice-token", token.TokenMsgs)
+
+	// The owner can still update it
+	require.NoError(t, db.SavePushToken("sel", "@alice:example.com", "install1", "alice-token-2", "app", "", ""))
+	token, err = db.GetPushToken("sel")
+	require.NoError(t, err)
+	assert.Equal(t, "alice-token-2", token.TokenMsgs)
+
+	// Tokens saved without a user are bound to the next one reporting them
+	require.NoError(t, db.SavePushToken("legacy", "", "", "legacy-token", "app", "", ""))
+	require.NoError(t, db.SavePushToken("legacy", "@bob:example.com", "", "legacy-token", "app", "", ""))
+	assert.ErrorIs(t, db.SavePushToken("legacy", "", "", "legacy-token", "app", "", ""), ErrPushTokenOwnedByOtherUser)
+}
+
+func TestSavePushTokenPushkeyOwnership(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("alice-sel", "@alice:example.com", "install1", "alice-msgs", "app", "alice-calls", "app.calls"))
+
+	// Another user cannot store the device tokens of alice on their own selector
+	for _, tokens := range [][2]string{{"alice-msgs", ""}, {"", "alice-msgs"}, {"mallory-msgs", "alice-calls"}} {
+		err = db.SavePushToken("mallory-sel", "@mallory:example.com", "install9", tokens[0], "app", tokens[1], "app.calls")
+		assert.ErrorIs(t, err, ErrPushTokenOwnedByOtherUser)
+	}
+	token, err := db.GetPushToken("mallory-sel")
+	require.NoError(t, err)
+	assert.Nil(t, token)
+
+	// The owner can move them to another selector, and empty tokens are never shared
+	require.NoError(t, db.SavePushToken("alice-sel-2", "@alice:example.com", "install1", "alice-msgs", "app", "", ""))
+	require.NoError(t, db.SavePushToken("bob-sel", "@bob:example.com", "install2", "bob-msgs", "app", "", ""))
+}
+
+func TestGetPushTokenByPushkeyPrefersUser(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Older databases can hold the same pushkey on the selectors of several users
+	_, err = db.db.Exec(`
+	INSERT INTO push_tokens (selector, user_id, token_msgs, appid_msgs, token_calls, appid_calls, updated_at) VALUES
+		('bob', '@bob:example.com', 'shared', 'app', '', '', '2026-01-03 00:00:00'),
+		('legacy', '', 'shared', 'app', '', '', '2026-01-02 00:00:00'),
+		('alice', '@alice:example.com', '', '', 'shared', 'app.calls', '2026-01-01 00:00:00');`)
+	require.NoError(t, err)
+
+	for userID, selector := range map[string]string{
+		"@alice:example.com": "alice",
+		"@bob:example.com":   "bob",
+		"@carol:example.com": "legacy",
+	} {
+		token, err := db.GetPushTokenByPushkey("shared", userID)
+		require.NoError(t, err)
+		require.NotNil(t, token)
+		assert.Equal(t, selector, token.Selector, userID)
+	}
+
+	token, err := db.GetPushTokenByPushkey("unknown", "@alice:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, token)
+}
+
+func TestListPushTokensByUser(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SavePushToken("mobile", "@alice:example.com", "install1", "tok1", "app", "call1", "app.calls"))
+	require.NoError(t, db.SavePushToken("desk", "@alice:example.com", "install2", "", "", "call2", "app.calls"))
+	require.NoError(t, db.SavePushToken("other", "@bob:example.com", "install3", "tok3", "app", "", ""))
+
+	tokens, err := db.ListPushTokensByUser("@alice:example.com")
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	devices := []string{tokens[0].DeviceID, tokens[1].DeviceID}
+	assert.ElementsMatch(t, []string{"install1", "install2"}, devices)
+
+	tokens, err = db.ListPushTokensByUser("@carol:example.com")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ReadReceipt is the latest read receipt of a reader in a room: the event it points to and when it was sent.
+type ReadReceipt struct {
+	RoomID  string
+	Reader  string
+	EventID string
+	// TS is the receipt timestamp, in milliseconds
+	TS int64
+}
+
+// createReadReceiptsSchema creates the read_receipts table if it doesn't exist.
+func (d *Database) createReadReceiptsSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS read_receipts (
+		room_id TEXT NOT NULL,
+		reader TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		ts INTEGER NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (room_id, reader)
+	);
+	`
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create read_receipts table: %w", err)
+	}
+	return nil
+}
+
+// SaveReadReceipt stores the receipt of a reader in a room, unless the stored one is more recent.
+// It reports whether the receipt was stored.
+func (d *Database) SaveReadReceipt(receipt ReadReceipt) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query := `
+	INSERT INTO read_receipts (room_id, reader, event_id, ts, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(room_id, reader) DO UPDATE SET
+		event_id = excluded.event_id,
+		ts = excluded.ts,
+		updated_at = excluded.updated_at
+	WHERE excluded.ts >= read_receipts.ts;
+	`
+	result, err := d.db.Exec(query, receipt.RoomID, receipt.Reader, receipt.EventID, receipt.TS, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to save read receipt: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// GetReadReceipt retrieves the latest receipt of a reader in a room, or nil if there is none.
+func (d *Database) GetReadReceipt(roomID, reader string) (*ReadReceipt, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	receipt := ReadReceipt{RoomID: roomID, Reader: reader}
+	err := d.db.QueryRow(`SELECT event_id, ts FROM read_receipts WHERE room_id = ? AND reader = ?;`, roomID, reader).Scan(&receipt.EventID, &receipt.TS)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get read receipt: %w", err)
+	}
+	return &receipt, nil
+}
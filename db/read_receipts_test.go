@@ -0,0 +1,38 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadReceipts(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	receipt, err := db.GetReadReceipt("!room:example.com", "@bob:example.com")
+	require.NoError(t, err)
+	assert.Nil(t, receipt)
+
+	saved, err := db.SaveReadReceipt(ReadReceipt{RoomID: "!room:example.com", Reader: "@bob:example.com", EventID: "$2", TS: 2000})
+	require.NoError(t, err)
+	assert.True(t, saved)
+	// The same receipt is stored again, an older one is not
+	saved, err = db.SaveReadReceipt(ReadReceipt{RoomID: "!room:example.com", Reader: "@bob:example.com", EventID: "$2", TS: 2000})
+	require.NoError(t, err)
+	assert.True(t, saved)
+	saved, err = db.SaveReadReceipt(ReadReceipt{RoomID: "!room:example.com", Reader: "@bob:example.com", EventID: "$1", TS: 1000})
+	require.NoError(t, err)
+	assert.False(t, saved)
+	saved, err = db.SaveReadReceipt(ReadReceipt{RoomID: "!other:example.com", Reader: "@bob:example.com", EventID: "$9", TS: 500})
+	require.NoError(t, err)
+	assert.True(t, saved)
+
+	receipt, err = db.GetReadReceipt("!room:example.com", "@bob:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, receipt)
+	assert.Equal(t, "$2", receipt.EventID)
+	assert.Equal(t, int64(2000), receipt.TS)
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+// createSyncTokensSchema creates the sync_tokens table if it doesn't exist.
+func (d *Database) createSyncTokensSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS sync_tokens (
+		user_id TEXT NOT NULL,
+		device TEXT NOT NULL DEFAULT '',
+		token TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, device)
+	);
+	`
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create sync_tokens table: %w", err)
+	}
+	return nil
+}
+
+// SaveSyncToken saves or updates the next_batch token of a user's device.
+func (d *Database) SaveSyncToken(userID, device, token string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query := `
+	INSERT INTO sync_tokens (user_id, device, token, updated_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(user_id, device) DO UPDATE SET
+		token = excluded.token,
+		updated_at = excluded.updated_at;
+	`
+	if _, err := d.db.Exec(query, userID, device, token, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to save sync token: %w", err)
+	}
+	return nil
+}
+
+// GetSyncToken retrieves the next_batch token of a user's device, or an empty string if there is none.
+func (d *Database) GetSyncToken(userID, device string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var token string
+	err := d.db.QueryRow(`SELECT token FROM sync_tokens WHERE user_id = ? AND device = ?;`, userID, device).Scan(&token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get sync token: %w", err)
+	}
+	return token, nil
+}
+
+// DeleteSyncToken removes the next_batch token of a user's device.
+func (d *Database) DeleteSyncToken(userID, device string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.db.Exec(`DELETE FROM sync_tokens WHERE user_id = ? AND device = ?;`, userID, device); err != nil {
+		return fmt.Errorf("failed to delete sync token: %w", err)
+	}
+	return nil
+}
+
+// DeleteSyncTokens removes the next_batch tokens of all the devices of a user.
+func (d *Database) DeleteSyncTokens(userID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.db.Exec(`DELETE FROM sync_tokens WHERE user_id = ?;`, userID); err != nil {
+		return fmt.Errorf("failed to delete sync tokens: %w", err)
+	}
+	logger.Debug().Str("user_id", userID).Msg("sync tokens deleted")
+	return nil
+}
+
+// PruneSyncTokens removes the tokens not updated since the given time and returns how many were removed.
+func (d *Database) PruneSyncTokens(before time.Time) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM sync_tokens WHERE updated_at < ?;`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune sync tokens: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected, nil
+}
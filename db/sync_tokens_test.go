@@ -0,0 +1,73 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncTokens(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_sync_tokens_*.db")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	db, err := NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+
+	require.NoError(t, db.SaveSyncToken("@alice:example.com", "", "s1"))
+	require.NoError(t, db.SaveSyncToken("@alice:example.com", "phone", "s2"))
+	require.NoError(t, db.SaveSyncToken("@alice:example.com", "phone", "s3"))
+	require.NoError(t, db.SaveSyncToken("@bob:example.com", "phone", "s4"))
+	require.NoError(t, db.Close())
+
+	// Tokens survive reopening the database
+	db, err = NewDatabase(tmpFile.Name())
+	require.NoError(t, err)
+	defer db.Close()
+
+	token, err := db.GetSyncToken("@alice:example.com", "")
+	require.NoError(t, err)
+	assert.Equal(t, "s1", token)
+	token, err = db.GetSyncToken("@alice:example.com", "phone")
+	require.NoError(t, err)
+	assert.Equal(t, "s3", token)
+	token, err = db.GetSyncToken("@alice:example.com", "tablet")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	require.NoError(t, db.DeleteSyncToken("@alice:example.com", ""))
+	token, err = db.GetSyncToken("@alice:example.com", "")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+
+	require.NoError(t, db.DeleteSyncTokens("@alice:example.com"))
+	token, err = db.GetSyncToken("@alice:example.com", "phone")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+	token, err = db.GetSyncToken("@bob:example.com", "phone")
+	require.NoError(t, err)
+	assert.Equal(t, "s4", token)
+}
+
+func TestPruneSyncTokens(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSyncToken("@alice:example.com", "phone", "s1"))
+
+	pruned, err := db.PruneSyncTokens(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), pruned)
+
+	pruned, err = db.PruneSyncTokens(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), pruned)
+
+	token, err := db.GetSyncToken("@alice:example.com", "phone")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// createTransactionsSchema creates the as_transactions table if it doesn't exist.
+func (d *Database) createTransactionsSchema() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS as_transactions (
+		txn_id TEXT PRIMARY KEY,
+		processed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := d.db.Exec(query); err != nil {
+		return fmt.Errorf("failed to create as_transactions table: %w", err)
+	}
+	return nil
+}
+
+// MarkTransactionProcessed records an Application Service transaction as processed. It reports whether the
+// transaction was recorded now: false means it was already processed, or is being processed by another request.
+func (d *Database) MarkTransactionProcessed(txnID string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`INSERT OR IGNORE INTO as_transactions (txn_id, processed_at) VALUES (?, ?);`, txnID, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("failed to mark transaction processed: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// PruneTransactions removes the transactions processed before the given time and returns how many were removed.
+func (d *Database) PruneTransactions(before time.Time) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM as_transactions WHERE processed_at < ?;`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune transactions: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return rowsAffected, nil
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactions(t *testing.T) {
+	db, err := NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	recorded, err := db.MarkTransactionProcessed("txn1")
+	require.NoError(t, err)
+	assert.True(t, recorded)
+	recorded, err = db.MarkTransactionProcessed("txn1")
+	require.NoError(t, err)
+	assert.False(t, recorded)
+
+	pruned, err := db.PruneTransactions(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), pruned)
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/nethesis/matrix2acrobits/api"
@@ -8,9 +14,18 @@ import (
 	"github.com/nethesis/matrix2acrobits/logger"
 	"github.com/nethesis/matrix2acrobits/matrix"
 	"github.com/nethesis/matrix2acrobits/service"
+	"maunium.net/go/mautrix/id"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "generate-registration" {
+		if err := generateRegistration(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "generate-registration:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Load configuration from environment variables
 	cfg, err := service.NewConfig()
 	if err != nil {
@@ -23,6 +38,7 @@ func main() {
 
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = api.IPExtractor(cfg.TrustedProxyNets)
 	e.Pre(middleware.RemoveTrailingSlash())
 	e.Use(middleware.RequestID())
 	e.Use(middleware.Logger())
@@ -38,6 +54,7 @@ func main() {
 		HomeserverURL: cfg.MatrixHomeserverURL,
 		AsToken:       cfg.MatrixAsToken,
 		AsUserID:      cfg.MatrixAsUserID,
+		SyncTimeout:   cfg.SyncTimeout,
 	})
 	if err != nil {
 		logger.Fatal().Err(err).Msg("failed to initialize matrix client")
@@ -57,11 +74,61 @@ func main() {
 	logger.Info().Str("proxy_url", cfg.ProxyURL).Msg("proxy URL configured for pusher registration")
 
 	svc := service.NewMessageService(matrixClient, pushTokenDB, cfg)
-	pushSvc := service.NewPushService(pushTokenDB)
-	api.RegisterRoutes(e, svc, pushSvc, cfg.MatrixAsToken, pushTokenDB)
+	go svc.RunPusherReconciler(context.Background(), cfg.PusherReconcileInterval)
+	pushSvc := service.NewPushService(matrixClient, pushTokenDB, cfg)
+	pushSvc.Start(context.Background())
+	api.RegisterRoutes(e, svc, pushSvc, cfg.MatrixAsToken, cfg.MatrixHsToken, pushTokenDB)
 
 	logger.Info().Str("port", cfg.ProxyPort).Msg("starting server")
 	if err := e.Start(":" + cfg.ProxyPort); err != nil {
 		logger.Fatal().Err(err).Msg("server stopped")
 	}
 }
+
+// generateRegistration writes a Synapse Application Service registration file built from
+// MATRIX_HOMESERVER_URL, AS_USER_ID and PROXY_URL, with new random as_token and hs_token.
+func generateRegistration(args []string) error {
+	flags := flag.NewFlagSet("generate-registration", flag.ContinueOnError)
+	registrationID := flags.String("id", "acrobits-proxy", "application service ID")
+	output := flags.String("output", "", "write the registration to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	homeserverURL := os.Getenv("MATRIX_HOMESERVER_URL")
+	if homeserverURL == "" {
+		return fmt.Errorf("MATRIX_HOMESERVER_URL is required")
+	}
+	u, err := url.Parse(homeserverURL)
+	if err != nil {
+		return fmt.Errorf("invalid MATRIX_HOMESERVER_URL: %w", err)
+	}
+	asUserID := os.Getenv("AS_USER_ID")
+	if asUserID == "" {
+		return fmt.Errorf("AS_USER_ID is required")
+	}
+	proxyURL := os.Getenv("PROXY_URL")
+	if proxyURL == "" {
+		proxyURL = homeserverURL
+	}
+
+	reg, err := service.NewRegistration(*registrationID, id.UserID(asUserID), u.Hostname(), proxyURL)
+	if err != nil {
+		return err
+	}
+	data, err := reg.YAML()
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(*output, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "start the proxy with MATRIX_AS_TOKEN=%s and MATRIX_HS_TOKEN=%s\n", reg.AsToken, reg.HsToken)
+	return nil
+}
@@ -30,6 +30,7 @@ type testConfig struct {
 	homeserverURL string
 	serverName    string
 	adminToken    string
+	hsToken       string
 	user1         string
 	user1Password string
 	user1Number   string
@@ -56,6 +57,7 @@ func loadTestEnv() (*testConfig, error) {
 		homeserverURL: "http://localhost:8008",
 		serverName:    "localhost",
 		adminToken:    "admin-token",
+		hsToken:       "synapse-token",
 		user1:         "giacomo@localhost",
 		user1Password: "Giacomo,1234",
 		user1Number:   "201",
@@ -94,6 +96,7 @@ func startTestServer(cfg *testConfig) (*echo.Echo, error) {
 
 	e := echo.New()
 	e.HideBanner = true
+	e.IPExtractor = api.IPExtractor(nil)
 	e.Pre(middleware.RemoveTrailingSlash())
 	e.Use(middleware.RequestID())
 	e.Use(middleware.Recover())
@@ -116,6 +119,7 @@ func startTestServer(cfg *testConfig) (*echo.Echo, error) {
 		LogLevel:             "DEBUG",
 		MatrixHomeserverURL:  cfg.homeserverURL,
 		MatrixAsToken:        cfg.adminToken,
+		MatrixHsToken:        cfg.hsToken,
 		MatrixAsUserID:       id.UserID(cfg.asUser),
 		MatrixHomeserverHost: cfg.serverName,
 		PushTokenDBPath:      "/tmp/push_tokens_test.db",
@@ -135,8 +139,9 @@ func startTestServer(cfg *testConfig) (*echo.Echo, error) {
 	}
 
 	svc := service.NewMessageService(matrixClient, pushTokenDB, serviceCfg)
-	pushSvc := service.NewPushService(pushTokenDB)
-	api.RegisterRoutes(e, svc, pushSvc, cfg.adminToken, pushTokenDB)
+	pushSvc := service.NewPushService(matrixClient, pushTokenDB, serviceCfg)
+	pushSvc.Start(context.Background())
+	api.RegisterRoutes(e, svc, pushSvc, cfg.adminToken, cfg.hsToken, pushTokenDB)
 
 	go func() {
 		if err := e.Start("127.0.0.1:" + testServerPort); err != nil && err != http.ErrServerClosed {
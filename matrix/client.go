@@ -22,16 +22,36 @@ type Config struct {
 	AsUserID      id.UserID
 	AsToken       string
 	HTTPClient    *http.Client
+	// SyncTimeout is how long an incremental sync waits for new events before returning; zero returns at once
+	SyncTimeout time.Duration
+}
+
+// syncFilter limits the sync responses to what the proxy reads: message events, read receipts and
+// the members of the message senders. Presence and account data are left out.
+var syncFilter = &mautrix.Filter{
+	AccountData: &mautrix.FilterPart{NotTypes: []event.Type{{Type: "*"}}},
+	Presence:    &mautrix.FilterPart{NotTypes: []event.Type{{Type: "*"}}},
+	Room: &mautrix.RoomFilter{
+		AccountData: &mautrix.FilterPart{NotTypes: []event.Type{{Type: "*"}}},
+		Ephemeral:   &mautrix.FilterPart{Types: []event.Type{event.EphemeralEventReceipt}},
+		State:       &mautrix.FilterPart{LazyLoadMembers: true},
+		Timeline:    &mautrix.FilterPart{Types: []event.Type{event.EventMessage}, LazyLoadMembers: true},
+	},
 }
 
 // MatrixClient is a client wrapper for performing Application Service actions.
-// Note: The underlying mautrix client is stateful for impersonation in this version.
-// A mutex is used to make operations thread-safe.
+// The mautrix client impersonates a single user, so each call gets a lightweight client for the
+// impersonated user, sharing the HTTP client: calls for different users run concurrently.
 type MatrixClient struct {
-	cli            *mautrix.Client
+	cli            *mautrix.Client // acts as the Application Service user
+	asUserID       id.UserID
+	asToken        string
+	httpClient     *http.Client
 	homeserverURL  string
 	homeserverName string
-	mu             sync.Mutex
+	syncTimeout    time.Duration
+	mu             sync.RWMutex
+	filters        map[id.UserID]string // sync filter ID uploaded for each user
 }
 
 // NewClient creates a MatrixClient authenticated as an Application Service.
@@ -48,17 +68,14 @@ func NewClient(cfg Config) (*MatrixClient, error) {
 
 	httpClient := cfg.HTTPClient
 	if httpClient == nil {
-		httpClient = &http.Client{Timeout: 30 * time.Second}
+		// Leave room for the long-polling sync requests
+		httpClient = &http.Client{Timeout: cfg.SyncTimeout + 30*time.Second}
 	}
 
-	// For v0.26.0, the AS token and user ID are passed to NewClient.
-	client, err := mautrix.NewClient(cfg.HomeserverURL, cfg.AsUserID, cfg.AsToken)
+	client, err := newAppServiceClient(cfg.HomeserverURL, cfg.AsUserID, cfg.AsToken, httpClient)
 	if err != nil {
-		return nil, fmt.Errorf("create mautrix client: %w", err)
+		return nil, err
 	}
-	client.Client = httpClient
-	// This flag enables the `user_id` query parameter for impersonation.
-	client.SetAppServiceUserID = true
 
 	// Extract homeserver name from URL:
 	// eg: https://synapse.example.com -> synapse.example.com)
@@ -74,20 +91,52 @@ func NewClient(cfg Config) (*MatrixClient, error) {
 
 	return &MatrixClient{
 		cli:            client,
+		asUserID:       cfg.AsUserID,
+		asToken:        cfg.AsToken,
+		httpClient:     httpClient,
 		homeserverURL:  cfg.HomeserverURL,
 		homeserverName: homeserverName,
+		syncTimeout:    cfg.SyncTimeout,
+		filters:        make(map[id.UserID]string),
 	}, nil
 }
 
-// SendMessage sends a message to a room, impersonating the specified userID.
-func (mc *MatrixClient) SendMessage(ctx context.Context, userID id.UserID, roomID id.RoomID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
-	mc.mu.Lock()
-	defer mc.mu.Unlock()
+// newAppServiceClient creates a mautrix client authenticated with the AS token and impersonating userID.
+func newAppServiceClient(homeserverURL string, userID id.UserID, asToken string, httpClient *http.Client) (*mautrix.Client, error) {
+	// For v0.26.0, the AS token and user ID are passed to NewClient.
+	client, err := mautrix.NewClient(homeserverURL, userID, asToken)
+	if err != nil {
+		return nil, fmt.Errorf("create mautrix client: %w", err)
+	}
+	client.Client = httpClient
+	// This flag enables the `user_id` query parameter for impersonation.
+	client.SetAppServiceUserID = true
+	return client, nil
+}
+
+// userClient returns a client impersonating userID. The clients are created for each call: they only hold the
+// user ID and share the HTTP client, so nothing is kept for the users served.
+func (mc *MatrixClient) userClient(userID id.UserID) (*mautrix.Client, error) {
+	if userID == mc.asUserID {
+		return mc.cli, nil
+	}
+	return newAppServiceClient(mc.homeserverURL, userID, mc.asToken, mc.httpClient)
+}
 
+// SendMessage sends a message to a room, impersonating the specified userID.
+// The content is usually an *event.MessageEventContent, or an *event.Content when extra fields are needed.
+func (mc *MatrixClient) SendMessage(ctx context.Context, userID id.UserID, roomID id.RoomID, content interface{}) (*mautrix.RespSendEvent, error) {
 	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: sending message event")
 
-	mc.cli.UserID = userID
-	resp, err := mc.cli.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+	var resp *mautrix.RespSendEvent
+	err = withRateLimitRetry(ctx, "send_message", func() (err error) {
+		resp, err = cli.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+		return err
+	})
 	if err != nil {
 		logger.Error().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("matrix: failed to send message event")
 		return nil, err
@@ -97,20 +146,81 @@ func (mc *MatrixClient) SendMessage(ctx context.Context, userID id.UserID, roomI
 	return resp, nil
 }
 
+// UploadMedia uploads data to the homeserver media repository, impersonating the specified userID.
+func (mc *MatrixClient) UploadMedia(ctx context.Context, userID id.UserID, data []byte, contentType, fileName string) (id.ContentURI, error) {
+	logger.Debug().Str("user_id", string(userID)).Str("content_type", contentType).Int("size", len(data)).Msg("matrix: uploading media")
+
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return id.ContentURI{}, err
+	}
+	var resp *mautrix.RespMediaUpload
+	err = withRateLimitRetry(ctx, "upload_media", func() (err error) {
+		resp, err = cli.UploadBytesWithName(ctx, data, contentType, fileName)
+		return err
+	})
+	if err != nil {
+		logger.Error().Str("user_id", string(userID)).Str("content_type", contentType).Err(err).Msg("matrix: failed to upload media")
+		return id.ContentURI{}, err
+	}
+
+	logger.Debug().Str("user_id", string(userID)).Str("content_uri", resp.ContentURI.String()).Msg("matrix: media uploaded")
+	return resp.ContentURI, nil
+}
+
+// DownloadMedia starts downloading a file from the homeserver media repository as the
+// Application Service user. The caller must close the response body.
+func (mc *MatrixClient) DownloadMedia(ctx context.Context, uri id.ContentURI) (*http.Response, error) {
+	logger.Debug().Str("content_uri", uri.String()).Msg("matrix: downloading media")
+
+	resp, err := mc.cli.Download(ctx, uri)
+	if err != nil {
+		logger.Debug().Str("content_uri", uri.String()).Err(err).Msg("matrix: failed to download media")
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DownloadThumbnail starts downloading a scaled thumbnail of a media file as the
+// Application Service user. The caller must close the response body.
+func (mc *MatrixClient) DownloadThumbnail(ctx context.Context, uri id.ContentURI, width, height int) (*http.Response, error) {
+	logger.Debug().Str("content_uri", uri.String()).Int("width", width).Int("height", height).Msg("matrix: downloading thumbnail")
+
+	resp, err := mc.cli.DownloadThumbnail(ctx, uri, height, width, mautrix.DownloadThumbnailExtra{Method: "scale"})
+	if err != nil {
+		logger.Debug().Str("content_uri", uri.String()).Err(err).Msg("matrix: failed to download thumbnail")
+		return nil, err
+	}
+	return resp, nil
+}
+
 // Sync performs a sync for the specified user with an optional batch token for incremental sync.
-// If batchToken is empty, a full sync is performed.
+// If batchToken is empty, an initial sync with the full room state is performed.
 func (mc *MatrixClient) Sync(ctx context.Context, userID id.UserID, batchToken string) (*mautrix.RespSync, error) {
-	mc.mu.Lock()
-	defer mc.mu.Unlock()
-
 	logger.Debug().Str("user_id", string(userID)).Str("batch_token", batchToken).Msg("matrix: performing sync with token")
 
-	mc.cli.UserID = userID
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+	filterID := mc.syncFilterID(ctx, cli)
 
 	// The SyncRequest method signature: SyncRequest(ctx, timeoutMS, since, filter, fullState, setPresence)
-	// Pass batchToken as the 'since' parameter for incremental sync
-	resp, err := mc.cli.SyncRequest(ctx, 30000, batchToken, "", true, "online")
+	// Pass batchToken as the 'since' parameter for incremental sync. The proxy polls on behalf of the app, even
+	// when it is in background, so the sync leaves the presence of the user unchanged.
+	fullState := batchToken == ""
+	var resp *mautrix.RespSync
+	err = withRateLimitRetry(ctx, "sync", func() (err error) {
+		resp, err = cli.SyncRequest(ctx, int(mc.syncTimeout.Milliseconds()), batchToken, filterID, fullState, event.PresenceOffline)
+		return err
+	})
 	if err != nil {
+		if filterID != "" {
+			// The filter may be gone from the homeserver: upload it again on the next sync
+			mc.mu.Lock()
+			delete(mc.filters, userID)
+			mc.mu.Unlock()
+		}
 		logger.Error().Str("user_id", string(userID)).Err(err).Msg("matrix: sync failed")
 		return nil, err
 	}
@@ -119,14 +229,55 @@ func (mc *MatrixClient) Sync(ctx context.Context, userID id.UserID, batchToken s
 	return resp, nil
 }
 
-// CreateDirectRoom creates a new direct message room impersonating 'userID' and inviting 'targetUserID'.
-func (mc *MatrixClient) CreateDirectRoom(ctx context.Context, userID id.UserID, targetUserID id.UserID, aliasKey string) (*mautrix.RespCreateRoom, error) {
+// syncFilterID returns the ID of the sync filter of the user impersonated by cli, uploading it on first use.
+// If the upload fails, the sync is performed without filter.
+func (mc *MatrixClient) syncFilterID(ctx context.Context, cli *mautrix.Client) string {
+	mc.mu.RLock()
+	filterID, ok := mc.filters[cli.UserID]
+	mc.mu.RUnlock()
+	if ok {
+		return filterID
+	}
+
+	resp, err := cli.CreateFilter(ctx, syncFilter)
+	if err != nil {
+		logger.Warn().Str("user_id", string(cli.UserID)).Err(err).Msg("matrix: failed to upload sync filter, syncing without filter")
+		return ""
+	}
+	logger.Debug().Str("user_id", string(cli.UserID)).Str("filter_id", resp.FilterID).Msg("matrix: sync filter uploaded")
+
 	mc.mu.Lock()
-	defer mc.mu.Unlock()
+	mc.filters[cli.UserID] = resp.FilterID
+	mc.mu.Unlock()
+	return resp.FilterID
+}
+
+// Messages returns a page of the room history before the 'from' token, newest first, impersonating the specified userID.
+func (mc *MatrixClient) Messages(ctx context.Context, userID id.UserID, roomID id.RoomID, from string, limit int) (*mautrix.RespMessages, error) {
+	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("from", from).Int("limit", limit).Msg("matrix: fetching room history")
 
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.Messages(ctx, roomID, from, "", mautrix.DirectionBackward, nil, limit)
+	if err != nil {
+		logger.Error().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("matrix: failed to fetch room history")
+		return nil, err
+	}
+
+	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Int("events", len(resp.Chunk)).Str("end", resp.End).Msg("matrix: fetched room history")
+	return resp, nil
+}
+
+// CreateDirectRoom creates a new direct message room impersonating 'userID' and inviting 'targetUserID'.
+func (mc *MatrixClient) CreateDirectRoom(ctx context.Context, userID id.UserID, targetUserID id.UserID, aliasKey string) (*mautrix.RespCreateRoom, error) {
 	logger.Debug().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Msg("matrix: creating direct room")
 
-	mc.cli.UserID = userID
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
 	req := &mautrix.ReqCreateRoom{
 		Invite:   []id.UserID{targetUserID},
 		Preset:   "trusted_private_chat",
@@ -137,7 +288,11 @@ func (mc *MatrixClient) CreateDirectRoom(ctx context.Context, userID id.UserID,
 	if aliasKey != "" {
 		req.RoomAliasName = aliasKey
 	}
-	resp, err := mc.cli.CreateRoom(ctx, req)
+	var resp *mautrix.RespCreateRoom
+	err = withRateLimitRetry(ctx, "create_room", func() (err error) {
+		resp, err = cli.CreateRoom(ctx, req)
+		return err
+	})
 	if err != nil {
 		logger.Error().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Str("alias_key", aliasKey).Err(err).Msg("matrix: failed to create direct room")
 		return nil, err
@@ -149,12 +304,18 @@ func (mc *MatrixClient) CreateDirectRoom(ctx context.Context, userID id.UserID,
 
 // JoinRoom joins a room, impersonating the specified userID.
 func (mc *MatrixClient) JoinRoom(ctx context.Context, userID id.UserID, roomID id.RoomID) (*mautrix.RespJoinRoom, error) {
-	mc.mu.Lock()
-	defer mc.mu.Unlock()
-	mc.cli.UserID = userID
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
 	req := &mautrix.ReqJoinRoom{}
 	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Msg("matrix: joining local room")
-	return mc.cli.JoinRoom(ctx, string(roomID), req)
+	var resp *mautrix.RespJoinRoom
+	err = withRateLimitRetry(ctx, "join_room", func() (err error) {
+		resp, err = cli.JoinRoom(ctx, string(roomID), req)
+		return err
+	})
+	return resp, err
 }
 
 // ResolveRoomAlias resolves a room alias to a room ID.
@@ -167,8 +328,11 @@ func (mc *MatrixClient) ResolveRoomAlias(ctx context.Context, roomAlias string)
 	if !strings.HasPrefix(roomAlias, "#") {
 		roomAlias = "#" + roomAlias + ":" + mc.homeserverName
 	}
-	// This action does not require impersonation, so no lock is needed.
-	resp, err := mc.cli.ResolveAlias(ctx, id.RoomAlias(roomAlias))
+	var resp *mautrix.RespAliasResolve
+	err := withRateLimitRetry(ctx, "resolve_alias", func() (err error) {
+		resp, err = mc.cli.ResolveAlias(ctx, id.RoomAlias(roomAlias))
+		return err
+	})
 	if err != nil {
 		logger.Debug().Str("room_alias", roomAlias).Err(err).Msg("matrix: failed to resolve room alias")
 		return ""
@@ -177,7 +341,6 @@ func (mc *MatrixClient) ResolveRoomAlias(ctx context.Context, roomAlias string)
 }
 
 func (mc *MatrixClient) GetRoomAliases(ctx context.Context, roomID id.RoomID) []string {
-	// This action does not require impersonation, so no lock is needed.
 	logger.Debug().Str("room_id", roomID.String()).Msg("matrix: fetching room aliases")
 	resp, err := mc.cli.GetAliases(ctx, roomID)
 	if err != nil {
@@ -197,11 +360,11 @@ func (mc *MatrixClient) GetRoomAliases(ctx context.Context, roomID id.RoomID) []
 }
 
 func (mc *MatrixClient) ListJoinedRooms(ctx context.Context, userID id.UserID) ([]id.RoomID, error) {
-	mc.mu.Lock()
-	defer mc.mu.Unlock()
-
-	mc.cli.UserID = userID
-	resp, err := mc.cli.JoinedRooms(ctx)
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.JoinedRooms(ctx)
 	if err != nil {
 		logger.Debug().Str("user_id", string(userID)).Err(err).Msg("matrix: failed to list joined rooms")
 		return nil, err
@@ -210,12 +373,147 @@ func (mc *MatrixClient) ListJoinedRooms(ctx context.Context, userID id.UserID) (
 	return resp.JoinedRooms, nil
 }
 
+// GetJoinedMembers returns the users currently joined to a room, impersonating the specified userID.
+func (mc *MatrixClient) GetJoinedMembers(ctx context.Context, userID id.UserID, roomID id.RoomID) ([]id.UserID, error) {
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.JoinedMembers(ctx, roomID)
+	if err != nil {
+		logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("matrix: failed to get joined members")
+		return nil, err
+	}
+
+	members := make([]id.UserID, 0, len(resp.Joined))
+	for member := range resp.Joined {
+		members = append(members, member)
+	}
+	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Int("member_count", len(members)).Msg("matrix: fetched joined members")
+	return members, nil
+}
+
+// GetRoomName returns the m.room.name of a room, impersonating the specified userID.
+// Returns an empty string if the room has no name.
+func (mc *MatrixClient) GetRoomName(ctx context.Context, userID id.UserID, roomID id.RoomID) string {
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return ""
+	}
+	var content event.RoomNameEventContent
+	if err := cli.StateEvent(ctx, roomID, event.StateRoomName, "", &content); err != nil {
+		logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("matrix: room has no name")
+		return ""
+	}
+	return content.Name
+}
+
+// GetEvent fetches a single event of a room, impersonating the specified userID.
+func (mc *MatrixClient) GetEvent(ctx context.Context, userID id.UserID, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+	evt, err := cli.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Err(err).Msg("matrix: failed to get event")
+		return nil, err
+	}
+	return evt, nil
+}
+
+// GetDisplayName returns the profile display name of targetUserID, impersonating the specified userID.
+func (mc *MatrixClient) GetDisplayName(ctx context.Context, userID, targetUserID id.UserID) (string, error) {
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return "", err
+	}
+	resp, err := cli.GetDisplayName(ctx, targetUserID)
+	if err != nil {
+		logger.Debug().Str("user_id", string(userID)).Str("target_user_id", string(targetUserID)).Err(err).Msg("matrix: failed to get display name")
+		return "", err
+	}
+	return resp.DisplayName, nil
+}
+
+// MarkRead moves the m.read receipt and the m.fully_read marker of a room to the given event,
+// impersonating the specified userID.
+func (mc *MatrixClient) MarkRead(ctx context.Context, userID id.UserID, roomID id.RoomID, eventID id.EventID) error {
+	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Msg("matrix: setting read markers")
+
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return err
+	}
+	err = cli.SetReadMarkers(ctx, roomID, &mautrix.ReqSetReadMarkers{
+		Read:      eventID,
+		FullyRead: eventID,
+	})
+	if err != nil {
+		logger.Error().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Err(err).Msg("matrix: failed to set read markers")
+		return err
+	}
+	return nil
+}
+
+// RegisterUser registers a user of the Application Service namespace on the homeserver.
+// A user that is already registered is not an error.
+func (mc *MatrixClient) RegisterUser(ctx context.Context, localpart string) error {
+	logger.Debug().Str("localpart", localpart).Msg("matrix: registering application service user")
+
+	_, _, err := mc.cli.Register(ctx, &mautrix.ReqRegister{
+		Username:     localpart,
+		Type:         mautrix.AuthTypeAppservice,
+		InhibitLogin: true,
+	})
+	if errors.Is(err, mautrix.MUserInUse) {
+		logger.Debug().Str("localpart", localpart).Msg("matrix: user already registered")
+		return nil
+	}
+	if err != nil {
+		logger.Error().Str("localpart", localpart).Err(err).Msg("matrix: failed to register user")
+		return fmt.Errorf("register user: %w", err)
+	}
+
+	logger.Info().Str("localpart", localpart).Msg("matrix: user registered")
+	return nil
+}
+
+// SetDisplayName sets the profile display name of the specified userID, impersonating it.
+func (mc *MatrixClient) SetDisplayName(ctx context.Context, userID id.UserID, displayName string) error {
+	logger.Debug().Str("user_id", string(userID)).Str("display_name", displayName).Msg("matrix: setting display name")
+
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return err
+	}
+	if err := cli.SetDisplayName(ctx, displayName); err != nil {
+		logger.Error().Str("user_id", string(userID)).Err(err).Msg("matrix: failed to set display name")
+		return fmt.Errorf("set display name: %w", err)
+	}
+	return nil
+}
+
+// GetPushers lists the pushers registered by the specified user.
+func (mc *MatrixClient) GetPushers(ctx context.Context, userID id.UserID) ([]models.Pusher, error) {
+	logger.Debug().Str("user_id", string(userID)).Msg("matrix: listing pushers")
+
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp models.PushersResponse
+	if _, err := cli.MakeRequest(ctx, http.MethodGet, cli.BuildClientURL("v3", "pushers"), nil, &resp); err != nil {
+		logger.Error().Str("user_id", string(userID)).Err(err).Msg("matrix: failed to list pushers")
+		return nil, fmt.Errorf("get pushers: %w", err)
+	}
+	return resp.Pushers, nil
+}
+
 // SetPusher registers or updates a push gateway for the specified user.
 // This is used to configure Matrix to send push notifications to the proxy's /_matrix/push/v1/notify endpoint.
 func (mc *MatrixClient) SetPusher(ctx context.Context, userID id.UserID, req *models.SetPusherRequest) error {
-	mc.mu.Lock()
-	defer mc.mu.Unlock()
-
 	logger.Debug().
 		Str("user_id", string(userID)).
 		Str("pushkey", req.Pushkey).
@@ -223,13 +521,16 @@ func (mc *MatrixClient) SetPusher(ctx context.Context, userID id.UserID, req *mo
 		Interface("kind", req.Kind).
 		Msg("matrix: setting pusher")
 
-	mc.cli.UserID = userID
+	cli, err := mc.userClient(userID)
+	if err != nil {
+		return err
+	}
 
 	// Construct the URL path for the pusher endpoint
-	urlPath := mc.cli.BuildClientURL("v3", "pushers", "set")
+	urlPath := cli.BuildClientURL("v3", "pushers", "set")
 
 	// Make the POST request
-	_, err := mc.cli.MakeRequest(ctx, http.MethodPost, urlPath, req, nil)
+	_, err = cli.MakeRequest(ctx, http.MethodPost, urlPath, req, nil)
 	if err != nil {
 		logger.Error().
 			Str("user_id", string(userID)).
@@ -3,14 +3,19 @@ package matrix
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -127,6 +132,26 @@ func TestSetPusher_Success(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestGetPushers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/pushers", r.URL.Path)
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+		w.Write([]byte(`{"pushers":[{"app_id":"com.acrobits.softphone","pushkey":"token1","kind":"http","lang":"en","data":{"format":"event_id_only","url":"https://proxy.example.com/_matrix/push/v1/notify"}}]}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+
+	pushers, err := client.GetPushers(context.Background(), id.UserID("@alice:example.com"))
+	require.NoError(t, err)
+	require.Len(t, pushers, 1)
+	assert.Equal(t, "token1", pushers[0].Pushkey)
+	assert.Equal(t, "com.acrobits.softphone", pushers[0].AppID)
+	assert.Equal(t, "https://proxy.example.com/_matrix/push/v1/notify", pushers[0].Data.URL)
+}
+
 // TestSetPusher_InvalidRequest tests SetPusher with invalid request
 
 // TestSetPusher_ServerError tests SetPusher when server returns error
@@ -189,3 +214,390 @@ func TestSetPusher_MissingURL(t *testing.T) {
 	err = client.SetPusher(context.Background(), id.UserID("@alice:example.com"), pusherReq)
 	assert.NoError(t, err)
 }
+
+// TestUploadMedia_Success tests media upload on behalf of a user
+func TestUploadMedia_Success(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/_matrix/media/v3/upload", r.URL.Path)
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+		assert.Equal(t, "photo.jpg", r.URL.Query().Get("filename"))
+		assert.Equal(t, "image/jpeg", r.Header.Get("Content-Type"))
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "jpeg-bytes", string(body))
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"content_uri":"mxc://example.com/abc123"}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	uri, err := client.UploadMedia(context.Background(), id.UserID("@alice:example.com"), []byte("jpeg-bytes"), "image/jpeg", "photo.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "mxc://example.com/abc123", uri.String())
+}
+
+// TestGetJoinedMembers_Success tests fetching the members of a room on behalf of a user
+func TestGetJoinedMembers_Success(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/_matrix/client/v3/rooms/!group:example.com/joined_members", r.URL.Path)
+		assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{},"@carol:example.com":{}}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	members, err := client.GetJoinedMembers(context.Background(), "@alice:example.com", "!group:example.com")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []id.UserID{"@alice:example.com", "@bob:example.com", "@carol:example.com"}, members)
+}
+
+// TestGetRoomName tests reading the room name, and the fallback for rooms without a name
+func TestGetRoomName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!group:example.com/state/m.room.name/":
+			w.Write([]byte(`{"name":"Support team"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Support team", client.GetRoomName(context.Background(), "@alice:example.com", "!group:example.com"))
+	assert.Equal(t, "", client.GetRoomName(context.Background(), "@alice:example.com", "!other:example.com"))
+}
+
+// TestMarkRead tests that read markers are set as the impersonated user
+func TestMarkRead(t *testing.T) {
+	var gotPath, gotUser string
+	var gotBody map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser = r.URL.Query().Get("user_id")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &gotBody)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	err = client.MarkRead(context.Background(), "@alice:example.com", "!room:example.com", "$event")
+	assert.NoError(t, err)
+	assert.Equal(t, "/_matrix/client/v3/rooms/!room:example.com/read_markers", gotPath)
+	assert.Equal(t, "@alice:example.com", gotUser)
+	assert.Equal(t, map[string]string{"m.read": "$event", "m.fully_read": "$event"}, gotBody)
+}
+
+func TestRegisterUser(t *testing.T) {
+	var gotBody map[string]interface{}
+	inUse := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_matrix/client/v3/register", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &gotBody)
+		if inUse {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errcode":"M_USER_IN_USE","error":"User ID already taken."}`))
+			return
+		}
+		w.Write([]byte(`{"user_id":"@bob:example.com"}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, client.RegisterUser(context.Background(), "bob"))
+	assert.Equal(t, "bob", gotBody["username"])
+	assert.Equal(t, "m.login.application_service", gotBody["type"])
+	assert.Equal(t, true, gotBody["inhibit_login"])
+
+	inUse = true
+	assert.NoError(t, client.RegisterUser(context.Background(), "bob"))
+}
+
+func TestSetDisplayName(t *testing.T) {
+	var gotPath, gotUser string
+	var gotBody map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser = r.URL.Query().Get("user_id")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &gotBody)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, client.SetDisplayName(context.Background(), "@bob:example.com", "bob (202)"))
+	assert.Equal(t, "/_matrix/client/v3/profile/@bob:example.com/displayname", gotPath)
+	assert.Equal(t, "@bob:example.com", gotUser)
+	assert.Equal(t, map[string]string{"displayname": "bob (202)"}, gotBody)
+}
+
+// TestSync_DoesNotBlockOtherUsers tests that a long-polling sync of a user does not delay the requests of other users
+func TestSync_DoesNotBlockOtherUsers(t *testing.T) {
+	syncStarted := make(chan struct{})
+	releaseSync := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/sync") {
+			close(syncStarted)
+			<-releaseSync
+			w.Write([]byte(`{"next_batch":"s1"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/filter") {
+			w.Write([]byte(`{"filter_id":"f1"}`))
+			return
+		}
+		assert.Equal(t, "@bob:example.com", r.URL.Query().Get("user_id"))
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	}))
+	defer server.Close()
+	defer close(releaseSync)
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	syncDone := make(chan error, 1)
+	go func() {
+		_, err := client.Sync(context.Background(), "@alice:example.com", "")
+		syncDone <- err
+	}()
+	<-syncStarted
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := client.SendMessage(ctx, "@bob:example.com", "!room:example.com", &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, id.EventID("$sent"), resp.EventID)
+
+	select {
+	case err := <-syncDone:
+		t.Fatalf("sync returned before being released: %v", err)
+	default:
+	}
+}
+
+// TestUserClient tests that impersonated users get a new client sharing the HTTP client, and the AS user the main one
+func TestUserClient(t *testing.T) {
+	httpClient := &http.Client{}
+	client, err := NewClient(Config{
+		HomeserverURL: "http://localhost:8008",
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+		HTTPClient:    httpClient,
+	})
+	require.NoError(t, err)
+
+	alice, err := client.userClient("@alice:example.com")
+	require.NoError(t, err)
+	again, err := client.userClient("@alice:example.com")
+	require.NoError(t, err)
+	bob, err := client.userClient("@bob:example.com")
+	require.NoError(t, err)
+	proxy, err := client.userClient("@proxy:example.com")
+	require.NoError(t, err)
+
+	assert.NotSame(t, alice, again)
+	assert.Equal(t, id.UserID("@alice:example.com"), again.UserID)
+	assert.Same(t, httpClient, alice.Client)
+	assert.Same(t, httpClient, bob.Client)
+	assert.True(t, bob.SetAppServiceUserID)
+	assert.Same(t, client.cli, proxy)
+	assert.Equal(t, id.UserID("@bob:example.com"), bob.UserID)
+	assert.Equal(t, id.UserID("@proxy:example.com"), client.cli.UserID)
+}
+
+// TestSync_Filter tests that the sync filter is uploaded once per user, and full state is requested only on initial sync
+func TestSync_Filter(t *testing.T) {
+	var filterUploads int32
+	var filter map[string]interface{}
+	var queries []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/_matrix/client/v3/user/@alice:example.com/filter":
+			atomic.AddInt32(&filterUploads, 1)
+			body, _ := io.ReadAll(r.Body)
+			require.NoError(t, json.Unmarshal(body, &filter))
+			w.Write([]byte(`{"filter_id":"f1"}`))
+		case r.URL.Path == "/_matrix/client/v3/sync":
+			q := r.URL.Query()
+			queries = append(queries, map[string]string{
+				"filter":     q.Get("filter"),
+				"full_state": q.Get("full_state"),
+				"timeout":    q.Get("timeout"),
+				"since":      q.Get("since"),
+				"presence":   q.Get("set_presence"),
+			})
+			w.Write([]byte(`{"next_batch":"s2"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+		SyncTimeout:   5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	_, err = client.Sync(context.Background(), "@alice:example.com", "")
+	require.NoError(t, err)
+	_, err = client.Sync(context.Background(), "@alice:example.com", "s1")
+	require.NoError(t, err)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&filterUploads))
+	room := filter["room"].(map[string]interface{})
+	assert.Equal(t, []interface{}{"m.room.message"}, room["timeline"].(map[string]interface{})["types"])
+	assert.Equal(t, true, room["state"].(map[string]interface{})["lazy_load_members"])
+	assert.Equal(t, []interface{}{"*"}, filter["presence"].(map[string]interface{})["not_types"])
+
+	require.Len(t, queries, 2)
+	assert.Equal(t, map[string]string{"filter": "f1", "full_state": "true", "timeout": "5000", "since": "", "presence": "offline"}, queries[0])
+	assert.Equal(t, map[string]string{"filter": "f1", "full_state": "", "timeout": "5000", "since": "s1", "presence": "offline"}, queries[1])
+}
+
+// TestSync_FilterUploadFailure tests that a sync is still performed when the filter cannot be uploaded
+func TestSync_FilterUploadFailure(t *testing.T) {
+	var gotFilter string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/sync" {
+			gotFilter = r.URL.Query().Get("filter")
+			w.Write([]byte(`{"next_batch":"s1"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN"}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{
+		HomeserverURL: server.URL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+
+	resp, err := client.Sync(context.Background(), "@alice:example.com", "")
+	require.NoError(t, err)
+	assert.Equal(t, "s1", resp.NextBatch)
+	assert.Equal(t, "", gotFilter)
+}
+
+// newLatencyServer returns a homeserver answering sync and send requests after the given latency.
+func newLatencyServer(latency time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/sync"):
+			w.Write([]byte(`{"next_batch":"s1"}`))
+			return
+		case strings.HasSuffix(r.URL.Path, "/filter"):
+			w.Write([]byte(`{"filter_id":"f1"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	}))
+}
+
+// BenchmarkSendMessage_Concurrent measures messages sent by many users at the same time:
+// with a 5ms homeserver latency, ns/op stays well below 5ms when requests do not serialize.
+func BenchmarkSendMessage_Concurrent(b *testing.B) {
+	server := newLatencyServer(5 * time.Millisecond)
+	defer server.Close()
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(b, err)
+
+	var users atomic.Int32
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		userID := id.NewUserID(fmt.Sprintf("user%d", users.Add(1)), "example.com")
+		for pb.Next() {
+			if _, err := client.SendMessage(context.Background(), userID, "!room:example.com", content); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSyncAndSendMessage_Concurrent measures users fetching messages while others send:
+// a slow sync must not hold back the other requests.
+func BenchmarkSyncAndSendMessage_Concurrent(b *testing.B) {
+	server := newLatencyServer(5 * time.Millisecond)
+	defer server.Close()
+	client, err := NewClient(Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(b, err)
+
+	var users atomic.Int32
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := users.Add(1)
+		userID := id.NewUserID(fmt.Sprintf("user%d", n), "example.com")
+		for pb.Next() {
+			var err error
+			if n%2 == 0 {
+				_, err = client.Sync(context.Background(), userID, "s0")
+			} else {
+				_, err = client.SendMessage(context.Background(), userID, "!room:example.com", content)
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix"
+)
+
+const (
+	// maxRateLimitRetries is how many times a rate limited request is retried before giving up
+	maxRateLimitRetries = 3
+	// Backoff used when the homeserver does not say how long to wait, doubled at each retry
+	defaultRateLimitBackoff = 500 * time.Millisecond
+	maxRateLimitBackoff     = 5 * time.Second
+)
+
+// RateLimitError is returned when the homeserver keeps rate limiting a request (M_LIMIT_EXCEEDED).
+// RetryAfter is how long the homeserver asked to wait before trying again, zero if unknown.
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by the homeserver, retry after %s: %v", e.RetryAfter, e.Err)
+	}
+	return fmt.Sprintf("rate limited by the homeserver: %v", e.Err)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// retryAfter reports whether err is a rate limit error, and how long the homeserver asked to wait.
+// The wait comes from retry_after_ms in the error body, or from the Retry-After header.
+func retryAfter(err error) (time.Duration, bool) {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return 0, false
+	}
+	if !errors.Is(err, mautrix.MLimitExceeded) && !httpErr.IsStatus(http.StatusTooManyRequests) {
+		return 0, false
+	}
+	if httpErr.RespError != nil {
+		if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && ms > 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	if httpErr.Response != nil {
+		if secs, err := strconv.Atoi(httpErr.Response.Header.Get("Retry-After")); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return 0, true
+}
+
+// withRateLimitRetry runs do, retrying it while the homeserver rate limits it. Each retry waits for the time
+// asked by the homeserver, or an exponential backoff. When the wait is longer than maxRateLimitBackoff or
+// would go past the context deadline, or the retries are exhausted, a *RateLimitError is returned.
+func withRateLimitRetry(ctx context.Context, op string, do func() error) error {
+	backoff := defaultRateLimitBackoff
+	for attempt := 0; ; attempt++ {
+		err := do()
+		wait, limited := retryAfter(err)
+		if !limited {
+			return err
+		}
+		if attempt == maxRateLimitRetries {
+			return &RateLimitError{RetryAfter: wait, Err: err}
+		}
+
+		delay := wait
+		if delay == 0 {
+			delay = backoff
+			backoff *= 2
+		}
+		// Longer waits are left to the caller
+		if delay > maxRateLimitBackoff {
+			return &RateLimitError{RetryAfter: wait, Err: err}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return &RateLimitError{RetryAfter: wait, Err: err}
+		}
+
+		logger.Warn().Str("op", op).Int("attempt", attempt+1).Dur("delay", delay).Msg("matrix: rate limited, retrying")
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &RateLimitError{RetryAfter: wait, Err: err}
+		case <-timer.C:
+		}
+	}
+}
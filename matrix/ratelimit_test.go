@@ -0,0 +1,138 @@
+package matrix
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+)
+
+// newRateLimitServer returns a homeserver rate limiting the first 'limited' requests with the given body,
+// then accepting messages, room creations and joins.
+func newRateLimitServer(limited int32, body string, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= limited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(body))
+			return
+		}
+		if strings.Contains(r.URL.Path, "/join/") {
+			w.Write([]byte(`{"room_id":"!room:example.com"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/createRoom") {
+			w.Write([]byte(`{"room_id":"!room:example.com"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id":"$sent"}`))
+	}))
+}
+
+func newRateLimitClient(t *testing.T, url string) *MatrixClient {
+	client, err := NewClient(Config{HomeserverURL: url, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	return client
+}
+
+var rateLimitContent = &event.MessageEventContent{MsgType: event.MsgText, Body: "hi"}
+
+func TestSendMessage_RateLimitRetry(t *testing.T) {
+	var calls int32
+	server := newRateLimitServer(2, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":10}`, &calls)
+	defer server.Close()
+
+	resp, err := newRateLimitClient(t, server.URL).SendMessage(context.Background(), "@alice:example.com", "!room:example.com", rateLimitContent)
+	require.NoError(t, err)
+	assert.Equal(t, "$sent", string(resp.EventID))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestSendMessage_RateLimitRetriesExhausted(t *testing.T) {
+	var calls int32
+	server := newRateLimitServer(100, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":10}`, &calls)
+	defer server.Close()
+
+	_, err := newRateLimitClient(t, server.URL).SendMessage(context.Background(), "@alice:example.com", "!room:example.com", rateLimitContent)
+	var rateLimited *RateLimitError
+	require.True(t, errors.As(err, &rateLimited))
+	assert.Equal(t, 10*time.Millisecond, rateLimited.RetryAfter)
+	assert.Equal(t, int32(maxRateLimitRetries+1), atomic.LoadInt32(&calls))
+}
+
+func TestSendMessage_RateLimitWaitTooLong(t *testing.T) {
+	var calls int32
+	server := newRateLimitServer(100, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":60000}`, &calls)
+	defer server.Close()
+
+	_, err := newRateLimitClient(t, server.URL).SendMessage(context.Background(), "@alice:example.com", "!room:example.com", rateLimitContent)
+	var rateLimited *RateLimitError
+	require.True(t, errors.As(err, &rateLimited))
+	assert.Equal(t, time.Minute, rateLimited.RetryAfter)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestJoinRoom_RateLimitRetry(t *testing.T) {
+	var calls int32
+	server := newRateLimitServer(1, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":10}`, &calls)
+	defer server.Close()
+
+	resp, err := newRateLimitClient(t, server.URL).JoinRoom(context.Background(), "@alice:example.com", "!room:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "!room:example.com", string(resp.RoomID))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestJoinRoom_RateLimitWaitTooLong(t *testing.T) {
+	var calls int32
+	server := newRateLimitServer(100, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":60000}`, &calls)
+	defer server.Close()
+
+	_, err := newRateLimitClient(t, server.URL).JoinRoom(context.Background(), "@alice:example.com", "!room:example.com")
+	var rateLimited *RateLimitError
+	require.True(t, errors.As(err, &rateLimited))
+	assert.Equal(t, time.Minute, rateLimited.RetryAfter)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+// TestCreateDirectRoom_RateLimitDeadline tests that the backoff does not go past the request deadline
+func TestCreateDirectRoom_RateLimitDeadline(t *testing.T) {
+	var calls int32
+	server := newRateLimitServer(100, `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests"}`, &calls)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := newRateLimitClient(t, server.URL).CreateDirectRoom(ctx, "@alice:example.com", "@bob:example.com", "")
+	var rateLimited *RateLimitError
+	require.True(t, errors.As(err, &rateLimited))
+	assert.Zero(t, rateLimited.RetryAfter)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"slow down"}`))
+	}))
+	defer server.Close()
+
+	_, err := newRateLimitClient(t, server.URL).SendMessage(context.Background(), "@alice:example.com", "!room:example.com", rateLimitContent)
+	var rateLimited *RateLimitError
+	require.True(t, errors.As(err, &rateLimited))
+	assert.Equal(t, 7*time.Second, rateLimited.RetryAfter)
+
+	wait, limited := retryAfter(errors.New("other"))
+	assert.False(t, limited)
+	assert.Zero(t, wait)
+}
@@ -0,0 +1,14 @@
+package models
+
+import "maunium.net/go/mautrix/event"
+
+// AppServiceTransaction is the body of a transaction pushed by the homeserver to the Application Service.
+type AppServiceTransaction struct {
+	Events []*event.Event `json:"events"`
+}
+
+// MatrixError is the standard Matrix error body returned to the homeserver.
+type MatrixError struct {
+	ErrCode string `json:"errcode"`
+	Error   string `json:"error"`
+}
@@ -0,0 +1,30 @@
+package models
+
+// Acrobits file transfer models (spec: https://doc.acrobits.net/api/client/x-acro-filetransfer.html)
+
+// FileTransferContentType is the content type used by Acrobits for messages carrying attachments.
+const FileTransferContentType = "application/x-acro-filetransfer+json"
+
+// FileTransferMessage represents the JSON body of an application/x-acro-filetransfer+json message.
+type FileTransferMessage struct {
+	Body        string       `json:"body,omitempty"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+// Attachment describes a single file referenced by a file transfer message.
+type Attachment struct {
+	ContentType   string             `json:"content-type,omitempty"`
+	ContentURL    string             `json:"content-url"`
+	ContentSize   int64              `json:"content-size,omitempty"`
+	Filename      string             `json:"filename,omitempty"`
+	Description   string             `json:"description,omitempty"`
+	EncryptionKey string             `json:"encryption-key,omitempty"`
+	Hash          string             `json:"hash,omitempty"`
+	Preview       *AttachmentPreview `json:"preview,omitempty"`
+}
+
+// AttachmentPreview contains an inline, base64 encoded thumbnail of an attachment.
+type AttachmentPreview struct {
+	ContentType string `json:"content-type,omitempty"`
+	Content     string `json:"content"`
+}
@@ -42,6 +42,9 @@ type SMS struct {
 	DispositionNotification string `json:"disposition_notification,omitempty"`
 	Displayed               bool   `json:"displayed,omitempty"`
 	StreamID                string `json:"stream_id"`
+	// Group chat information, only present for messages of multi-party rooms
+	StreamName   string   `json:"stream_name,omitempty"`
+	Participants []string `json:"participants,omitempty"`
 }
 
 // Message is a helper struct for internal use.
@@ -55,7 +58,30 @@ type PushTokenReportRequest struct {
 	AppIDMsgs  string `json:"appid_msgs"`
 	TokenCalls string `json:"token_calls"`
 	AppIDCalls string `json:"appid_calls"`
+	// Device identifies the app installation (Acrobits %installid%), a user can report tokens from several
+	Device string `json:"device"`
 }
 
 // PushTokenReportResponse is the successful response for push token reporting.
 type PushTokenReportResponse struct{}
+
+// AccountRemovalRequest mirrors the Acrobits account removal reporter POST JSON schema.
+type AccountRemovalRequest struct {
+	UserName string `json:"username"`
+	Password string `json:"password"`
+	Selector string `json:"selector"`
+}
+
+// AccountRemovalResponse is the successful response for account removal reporting.
+type AccountRemovalResponse struct{}
+
+// MarkDisplayedRequest marks a message, and the ones before it in the same stream, as displayed.
+type MarkDisplayedRequest struct {
+	UserName string `json:"username"`
+	Password string `json:"password"`
+	StreamID string `json:"stream_id"`
+	SMSID    string `json:"sms_id"`
+}
+
+// MarkDisplayedResponse is the successful response for marking messages as displayed.
+type MarkDisplayedResponse struct{}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 // Matrix Push Gateway API models (spec: https://spec.matrix.org/v1.16/push-gateway-api/)
 
 // MatrixPushNotifyRequest represents the request body for POST /_matrix/push/v1/notify
@@ -52,8 +54,8 @@ type AcrobitsPushRequest struct {
 	DeviceToken string `json:"DeviceToken"` // Device token
 	Selector    string `json:"Selector,omitempty"`
 
-	// For NotifyTextMessage (iOS 13+)
-	Badge           int    `json:"Badge,omitempty"`
+	// For NotifyTextMessage (iOS 13+), Badge is also the payload of NotifyBadge, where 0 is sent
+	Badge           *int   `json:"Badge,omitempty"`
 	Sound           string `json:"Sound,omitempty"`
 	UserName        string `json:"UserName,omitempty"`
 	UserDisplayName string `json:"UserDisplayName,omitempty"`
@@ -69,6 +71,27 @@ type AcrobitsPushResponse struct {
 	Response string `json:"response"`
 }
 
+// RecordedPush is a push that the proxy, in record mode, stored instead of sending it to Acrobits PNM.
+type RecordedPush struct {
+	RecordedAt time.Time           `json:"recorded_at"`
+	Request    AcrobitsPushRequest `json:"request"`
+}
+
+// PushSettings are the push notification preferences of a Matrix user.
+// With HideContent, pushes show a generic text instead of the message and its sender.
+type PushSettings struct {
+	UserID      string `json:"user_id"`
+	HideContent bool   `json:"hide_content"`
+}
+
+// PushSettingsReportRequest changes the push notification preferences of the authenticated user.
+// When HideContent is omitted, the current preferences are only returned.
+type PushSettingsReportRequest struct {
+	UserName    string `json:"username"`
+	Password    string `json:"password"`
+	HideContent *bool  `json:"hide_content,omitempty"`
+}
+
 // Matrix Client-Server API pusher models (spec: https://spec.matrix.org/v1.16/client-server-api/#post_matrixclientv3pushersset)
 
 // SetPusherRequest represents the request body for POST /_matrix/client/v3/pushers/set
@@ -89,3 +112,37 @@ type PusherData struct {
 	Format string `json:"format,omitempty"` // "event_id_only" for HTTP pushers
 	URL    string `json:"url,omitempty"`    // HTTPS URL for push gateway (required for http kind)
 }
+
+// Pusher is a pusher registered on the homeserver, as returned by GET /_matrix/client/v3/pushers
+type Pusher struct {
+	AppDisplayName    string     `json:"app_display_name"`
+	AppID             string     `json:"app_id"`
+	Data              PusherData `json:"data"`
+	DeviceDisplayName string     `json:"device_display_name"`
+	Kind              string     `json:"kind"`
+	Lang              string     `json:"lang"`
+	ProfileTag        string     `json:"profile_tag,omitempty"`
+	Pushkey           string     `json:"pushkey"`
+}
+
+// PushersResponse is the response body of GET /_matrix/client/v3/pushers
+type PushersResponse struct {
+	Pushers []Pusher `json:"pushers"`
+}
+
+// PusherChange is a pusher removed or registered by the pusher reconciliation.
+type PusherChange struct {
+	UserID  string `json:"user_id"`
+	AppID   string `json:"app_id"`
+	Pushkey string `json:"pushkey"`
+	Reason  string `json:"reason"`
+}
+
+// PusherReconcileReport describes what a pusher reconciliation changed on the homeserver.
+type PusherReconcileReport struct {
+	StartedAt  time.Time      `json:"started_at"`
+	Users      int            `json:"users"`
+	Removed    []PusherChange `json:"removed"`
+	Registered []PusherChange `json:"registered"`
+	Errors     []string       `json:"errors"`
+}
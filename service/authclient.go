@@ -79,6 +79,31 @@ func (h *HTTPAuthClient) Validate(ctx context.Context, username, password, homes
 		logger.Debug().Str("key", key).Msg("authclient: cache miss or expired")
 	}
 
+	mappings, ok, err := h.fetchUsers(ctx, username, password, homeserverHost)
+	if err != nil {
+		return mappings, ok, err
+	}
+
+	// Cache successful authentication
+	if h.cacheTTL > 0 {
+		h.mu.Lock()
+		h.cache[key] = cachedAuth{expiry: time.Now().Add(h.cacheTTL)}
+		h.mu.Unlock()
+		logger.Debug().Str("key", key).Time("expiry", time.Now().Add(h.cacheTTL)).Msg("authclient: cached successful authentication")
+	}
+	return mappings, true, nil
+}
+
+// ListUsers returns the mappings of all the users of the directory, read with the credentials of a service account.
+// Unlike Validate, the result is never cached: it is used to find the users added since the last login of anyone.
+func (h *HTTPAuthClient) ListUsers(ctx context.Context, username, password, homeserverHost string) ([]*models.MappingRequest, error) {
+	mappings, _, err := h.fetchUsers(ctx, strings.TrimSpace(username), password, homeserverHost)
+	return mappings, err
+}
+
+// fetchUsers logs into the external service, checks the chat capability and retrieves the user mappings.
+// The boolean is false when the credentials were rejected.
+func (h *HTTPAuthClient) fetchUsers(ctx context.Context, username, password, homeserverHost string) ([]*models.MappingRequest, bool, error) {
 	// Step 1: POST /api/login to get JWT token
 	loginURL := strings.TrimRight(h.url, "/") + "/api/login"
 	loginReq := models.LoginRequest{
@@ -200,14 +225,6 @@ func (h *HTTPAuthClient) Validate(ctx context.Context, username, password, homes
 
 	logger.Debug().Int("user_count", len(chatResponse.Users)).Msg("authclient: parsed chat response")
 
-	// Cache successful authentication
-	if h.cacheTTL > 0 {
-		h.mu.Lock()
-		h.cache[key] = cachedAuth{expiry: time.Now().Add(h.cacheTTL)}
-		h.mu.Unlock()
-		logger.Debug().Str("key", key).Time("expiry", time.Now().Add(h.cacheTTL)).Msg("authclient: cached successful authentication")
-	}
-
 	// Convert chat users to mappings
 	mappings := make([]*models.MappingRequest, 0, len(chatResponse.Users))
 	for _, user := range chatResponse.Users {
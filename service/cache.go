@@ -1,6 +1,7 @@
 package service
 
 import (
+	"strings"
 	"sync"
 	"time"
 )
@@ -130,6 +131,13 @@ func (c *RoomAliasesCache) Set(roomID string, aliases []string) {
 	}
 }
 
+// Delete removes the cached aliases of the given room ID.
+func (c *RoomAliasesCache) Delete(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, roomID)
+}
+
 // Clear removes all entries from the cache.
 func (c *RoomAliasesCache) Clear() {
 	c.mu.Lock()
@@ -187,9 +195,89 @@ func (c *RoomParticipantCache) Set(key string, identifier string) {
 	}
 }
 
+// DeleteRoom removes the cached participants of the given room ID, for all viewers.
+func (c *RoomParticipantCache) DeleteRoom(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := roomID + "|"
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
 // Clear removes all entries from the cache.
 func (c *RoomParticipantCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.entries = make(map[string]cacheEntry[string])
 }
+
+// RoomGroup holds the name and joined members of a multi-party room.
+type RoomGroup struct {
+	Name    string
+	Members []string
+}
+
+// RoomGroupCache caches room ID to group information mappings
+// (e.g., "!roomid:server" -> {Name: "Support", Members: ["@a:server", "@b:server", "@c:server"]}).
+// This is used by resolveConversation to avoid fetching members and name of group rooms on every sync.
+type RoomGroupCache struct {
+	mu      sync.RWMutex
+	entries map[string]cacheEntry[RoomGroup]
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+// NewRoomGroupCache creates a new RoomGroupCache with the specified TTL.
+func NewRoomGroupCache(ttl time.Duration) *RoomGroupCache {
+	return &RoomGroupCache{
+		entries: make(map[string]cacheEntry[RoomGroup]),
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// Get retrieves the cached group information for the given room ID, or returns false if not found or expired.
+func (c *RoomGroupCache) Get(roomID string) (RoomGroup, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[roomID]
+	if !ok || entry.isExpired(c.now()) {
+		return RoomGroup{}, false
+	}
+
+	// Return a copy to avoid external mutation
+	group := entry.Value
+	group.Members = append([]string(nil), group.Members...)
+	return group, true
+}
+
+// Set stores the group information for the given room ID with TTL expiration.
+func (c *RoomGroupCache) Set(roomID string, group RoomGroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Store a copy to avoid external mutations
+	group.Members = append([]string(nil), group.Members...)
+	c.entries[roomID] = cacheEntry[RoomGroup]{
+		Value:     group,
+		ExpiresAt: c.now().Add(c.ttl),
+	}
+}
+
+// Delete removes the cached group information of the given room ID.
+func (c *RoomGroupCache) Delete(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, roomID)
+}
+
+// Clear removes all entries from the cache.
+func (c *RoomGroupCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cacheEntry[RoomGroup])
+}
@@ -2,9 +2,11 @@ package service
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/logger"
@@ -12,11 +14,24 @@ import (
 )
 
 const (
-	defaultPort            = "8080"
-	defaultCacheTTLSeconds = 3600
-	defaultPushTokenDBPath = "/tmp/push_tokens.db"
-	defaultExtAuthTimeoutS = 5
-	defaultLogLevel        = "INFO"
+	defaultPort                = "8080"
+	defaultCacheTTLSeconds     = 3600
+	defaultPushTokenDBPath     = "/tmp/push_tokens.db"
+	defaultExtAuthTimeoutS     = 5
+	defaultSyncTokenMaxAgeDays = 30
+	defaultSyncTimeoutS        = 30
+	defaultPusherReconcileS    = 3600
+	defaultPushQueueWorkers    = 2
+	defaultPushMaxAttempts     = 8
+	defaultMediaLinkTTLHours   = 7 * 24
+	defaultLogLevel            = "INFO"
+	defaultPNMURL              = "https://pnm.cloudsoftphone.com/pnm2/send"
+)
+
+// Push record modes: pushes are kept in memory, and also appended to PUSH_RECORD_FILE, instead of being sent
+const (
+	PushRecordMemory = "memory"
+	PushRecordFile   = "file"
 )
 
 // Config holds all configuration loaded from environment variables
@@ -28,15 +43,52 @@ type Config struct {
 	// Matrix configuration
 	MatrixHomeserverURL  string
 	MatrixAsToken        string
+	MatrixHsToken        string
 	MatrixAsUserID       id.UserID
 	MatrixHomeserverHost string
 
 	// Push tokens database
 	PushTokenDBPath string
 
+	// Sync tokens not used for longer than this are pruned from the database
+	SyncTokenMaxAgeDays int
+	SyncTokenMaxAge     time.Duration
+
+	// Time an incremental sync waits for new messages before fetch_messages returns
+	SyncTimeoutS int
+	SyncTimeout  time.Duration
+
 	// Proxy configuration for push registration
 	ProxyURL string
 
+	// Interval of the reconciliation of the homeserver pushers with the push tokens, zero disables it
+	PusherReconcileIntervalS int
+	PusherReconcileInterval  time.Duration
+
+	// Push gateway protection: addresses allowed to call /_matrix/push/v1/notify (empty allows any)
+	// and the secret used to sign the pusher URLs registered on the homeserver
+	PushGatewayAllowedNets []*net.IPNet
+	PushGatewaySecret      string
+
+	// Reverse proxies whose X-Forwarded-For header is trusted for the client address (empty trusts none)
+	TrustedProxyNets []*net.IPNet
+
+	// Acrobits PNM endpoint, and the record mode used to inspect pushes without sending them
+	PNMURL         string
+	PushRecordMode string
+	PushRecordFile string
+
+	// Workers delivering the queued pushes, and attempts before a push is dropped
+	PushQueueWorkers int
+	PushMaxAttempts  int
+
+	// Public base URL used to build media download links for the Acrobits app, the secret the links are
+	// signed with (MATRIX_AS_TOKEN when empty, never used directly) and how long the links are valid
+	MediaPublicURL    string
+	MediaSigningKey   string
+	MediaLinkTTLHours int
+	MediaLinkTTL      time.Duration
+
 	// Message service configuration
 	CacheTTLSeconds int
 	CacheTTL        time.Duration
@@ -45,6 +97,9 @@ type Config struct {
 	ExtAuthURL      string
 	ExtAuthTimeoutS int
 	ExtAuthTimeout  time.Duration
+	// Service account used to look up in the directory the users the homeserver asks about
+	ExtAuthDirectoryUser     string
+	ExtAuthDirectoryPassword string
 }
 
 // NewConfig loads all configuration from environment variables with validation
@@ -85,6 +140,13 @@ func NewConfig() (*Config, error) {
 	}
 	logger.Debug().Msg("MATRIX_AS_TOKEN loaded from environment")
 
+	cfg.MatrixHsToken = os.Getenv("MATRIX_HS_TOKEN")
+	if cfg.MatrixHsToken == "" {
+		logger.Warn().Msg("MATRIX_HS_TOKEN not set - application service transactions from the homeserver will be rejected")
+	} else {
+		logger.Debug().Msg("MATRIX_HS_TOKEN loaded from environment")
+	}
+
 	asUserIDStr := os.Getenv("AS_USER_ID")
 	if asUserIDStr == "" {
 		logger.Error().Msg("AS_USER_ID environment variable is missing")
@@ -110,6 +172,45 @@ func NewConfig() (*Config, error) {
 		logger.Debug().Str("PUSH_TOKEN_DB_PATH", cfg.PushTokenDBPath).Msg("push token database path loaded from environment")
 	}
 
+	cfg.SyncTokenMaxAgeDays = defaultSyncTokenMaxAgeDays
+	if v := os.Getenv("SYNC_TOKEN_MAX_AGE_DAYS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.SyncTokenMaxAgeDays = parsed
+			logger.Debug().Int("SYNC_TOKEN_MAX_AGE_DAYS", cfg.SyncTokenMaxAgeDays).Msg("sync token max age loaded from environment")
+		} else {
+			logger.Warn().Str("SYNC_TOKEN_MAX_AGE_DAYS", v).Err(err).Int("default", defaultSyncTokenMaxAgeDays).Msg("invalid sync token max age value, using default")
+		}
+	} else {
+		logger.Debug().Int("SYNC_TOKEN_MAX_AGE_DAYS", cfg.SyncTokenMaxAgeDays).Msg("using default sync token max age")
+	}
+	cfg.SyncTokenMaxAge = time.Duration(cfg.SyncTokenMaxAgeDays) * 24 * time.Hour
+
+	cfg.SyncTimeoutS = defaultSyncTimeoutS
+	if v := os.Getenv("SYNC_TIMEOUT_S"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.SyncTimeoutS = parsed
+			logger.Debug().Int("SYNC_TIMEOUT_S", cfg.SyncTimeoutS).Msg("sync timeout loaded from environment")
+		} else {
+			logger.Warn().Str("SYNC_TIMEOUT_S", v).Err(err).Int("default", defaultSyncTimeoutS).Msg("invalid sync timeout value, using default")
+		}
+	} else {
+		logger.Debug().Int("SYNC_TIMEOUT_S", cfg.SyncTimeoutS).Msg("using default sync timeout")
+	}
+	cfg.SyncTimeout = time.Duration(cfg.SyncTimeoutS) * time.Second
+
+	cfg.PusherReconcileIntervalS = defaultPusherReconcileS
+	if v := os.Getenv("PUSHER_RECONCILE_INTERVAL_S"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			cfg.PusherReconcileIntervalS = parsed
+			logger.Debug().Int("PUSHER_RECONCILE_INTERVAL_S", cfg.PusherReconcileIntervalS).Msg("pusher reconcile interval loaded from environment")
+		} else {
+			logger.Warn().Str("PUSHER_RECONCILE_INTERVAL_S", v).Err(err).Int("default", defaultPusherReconcileS).Msg("invalid pusher reconcile interval value, using default")
+		}
+	} else {
+		logger.Debug().Int("PUSHER_RECONCILE_INTERVAL_S", cfg.PusherReconcileIntervalS).Msg("using default pusher reconcile interval")
+	}
+	cfg.PusherReconcileInterval = time.Duration(cfg.PusherReconcileIntervalS) * time.Second
+
 	// Load proxy configuration
 	cfg.ProxyURL = os.Getenv("PROXY_URL")
 	if cfg.ProxyURL == "" {
@@ -119,6 +220,108 @@ func NewConfig() (*Config, error) {
 		logger.Debug().Str("PROXY_URL", cfg.ProxyURL).Msg("proxy URL loaded from environment")
 	}
 
+	if v := os.Getenv("PUSH_GATEWAY_ALLOWED_IPS"); v != "" {
+		cfg.PushGatewayAllowedNets = parseAllowedNets(v)
+		if len(cfg.PushGatewayAllowedNets) == 0 {
+			logger.Error().Str("PUSH_GATEWAY_ALLOWED_IPS", v).Msg("push gateway allowlist contains no valid address")
+			return nil, fmt.Errorf("PUSH_GATEWAY_ALLOWED_IPS contains no valid IP address or CIDR")
+		}
+		logger.Debug().Str("PUSH_GATEWAY_ALLOWED_IPS", v).Int("networks", len(cfg.PushGatewayAllowedNets)).Msg("push gateway allowlist loaded from environment")
+	} else {
+		logger.Debug().Msg("PUSH_GATEWAY_ALLOWED_IPS not set, push gateway accepts requests from any address")
+	}
+
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		cfg.TrustedProxyNets = parseAllowedNets(v)
+		if len(cfg.TrustedProxyNets) == 0 {
+			logger.Error().Str("TRUSTED_PROXIES", v).Msg("trusted proxies contain no valid address")
+			return nil, fmt.Errorf("TRUSTED_PROXIES contains no valid IP address or CIDR")
+		}
+		logger.Debug().Str("TRUSTED_PROXIES", v).Int("networks", len(cfg.TrustedProxyNets)).Msg("trusted proxies loaded from environment")
+	} else {
+		logger.Debug().Msg("TRUSTED_PROXIES not set, the client address is the address of the connection")
+	}
+
+	cfg.PushGatewaySecret = os.Getenv("PUSH_GATEWAY_SECRET")
+	if cfg.PushGatewaySecret == "" {
+		logger.Warn().Msg("PUSH_GATEWAY_SECRET not set - push gateway requests will not be authenticated")
+	} else {
+		logger.Debug().Msg("PUSH_GATEWAY_SECRET loaded from environment")
+	}
+
+	cfg.PNMURL = os.Getenv("PNM_URL")
+	if cfg.PNMURL == "" {
+		cfg.PNMURL = defaultPNMURL
+	}
+	logger.Debug().Str("PNM_URL", cfg.PNMURL).Msg("push notification manager URL configured")
+
+	cfg.PushRecordMode = strings.ToLower(strings.TrimSpace(os.Getenv("PUSH_RECORD_MODE")))
+	cfg.PushRecordFile = os.Getenv("PUSH_RECORD_FILE")
+	switch cfg.PushRecordMode {
+	case "":
+	case PushRecordMemory:
+		logger.Warn().Msg("PUSH_RECORD_MODE is memory - pushes are recorded and not sent to the PNM")
+	case PushRecordFile:
+		if cfg.PushRecordFile == "" {
+			logger.Error().Msg("PUSH_RECORD_FILE environment variable is missing")
+			return nil, fmt.Errorf("PUSH_RECORD_FILE is required when PUSH_RECORD_MODE is file")
+		}
+		logger.Warn().Str("PUSH_RECORD_FILE", cfg.PushRecordFile).Msg("PUSH_RECORD_MODE is file - pushes are recorded and not sent to the PNM")
+	default:
+		logger.Warn().Str("PUSH_RECORD_MODE", cfg.PushRecordMode).Msg("invalid push record mode, pushes are sent to the PNM")
+		cfg.PushRecordMode = ""
+	}
+
+	cfg.PushQueueWorkers = defaultPushQueueWorkers
+	if v := os.Getenv("PUSH_QUEUE_WORKERS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 1 {
+			cfg.PushQueueWorkers = parsed
+			logger.Debug().Int("PUSH_QUEUE_WORKERS", cfg.PushQueueWorkers).Msg("push queue workers loaded from environment")
+		} else {
+			logger.Warn().Str("PUSH_QUEUE_WORKERS", v).Err(err).Int("default", defaultPushQueueWorkers).Msg("invalid push queue workers value, using default")
+		}
+	} else {
+		logger.Debug().Int("PUSH_QUEUE_WORKERS", cfg.PushQueueWorkers).Msg("using default push queue workers")
+	}
+
+	cfg.PushMaxAttempts = defaultPushMaxAttempts
+	if v := os.Getenv("PUSH_MAX_ATTEMPTS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 1 {
+			cfg.PushMaxAttempts = parsed
+			logger.Debug().Int("PUSH_MAX_ATTEMPTS", cfg.PushMaxAttempts).Msg("push max attempts loaded from environment")
+		} else {
+			logger.Warn().Str("PUSH_MAX_ATTEMPTS", v).Err(err).Int("default", defaultPushMaxAttempts).Msg("invalid push max attempts value, using default")
+		}
+	} else {
+		logger.Debug().Int("PUSH_MAX_ATTEMPTS", cfg.PushMaxAttempts).Msg("using default push max attempts")
+	}
+
+	cfg.MediaPublicURL = os.Getenv("MEDIA_PUBLIC_URL")
+	if cfg.MediaPublicURL == "" {
+		cfg.MediaPublicURL = cfg.ProxyURL
+		logger.Debug().Str("MEDIA_PUBLIC_URL", cfg.MediaPublicURL).Msg("MEDIA_PUBLIC_URL not configured, using PROXY_URL")
+	} else {
+		logger.Debug().Str("MEDIA_PUBLIC_URL", cfg.MediaPublicURL).Msg("media public URL loaded from environment")
+	}
+
+	cfg.MediaSigningKey = os.Getenv("MEDIA_SIGNING_KEY")
+	if cfg.MediaSigningKey == "" {
+		logger.Debug().Msg("MEDIA_SIGNING_KEY not configured, media links are signed with a key derived from MATRIX_AS_TOKEN")
+	}
+
+	cfg.MediaLinkTTLHours = defaultMediaLinkTTLHours
+	if v := os.Getenv("MEDIA_LINK_TTL_HOURS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			cfg.MediaLinkTTLHours = parsed
+			logger.Debug().Int("MEDIA_LINK_TTL_HOURS", cfg.MediaLinkTTLHours).Msg("media link TTL loaded from environment")
+		} else {
+			logger.Warn().Str("MEDIA_LINK_TTL_HOURS", v).Err(err).Int("default", defaultMediaLinkTTLHours).Msg("invalid media link TTL value, using default")
+		}
+	} else {
+		logger.Debug().Int("MEDIA_LINK_TTL_HOURS", cfg.MediaLinkTTLHours).Msg("using default media link TTL")
+	}
+	cfg.MediaLinkTTL = time.Duration(cfg.MediaLinkTTLHours) * time.Hour
+
 	// Load cache configuration
 	cacheTTLStr := os.Getenv("CACHE_TTL_SECONDS")
 	cfg.CacheTTLSeconds = defaultCacheTTLSeconds
@@ -155,26 +358,80 @@ func NewConfig() (*Config, error) {
 	}
 	cfg.ExtAuthTimeout = time.Duration(cfg.ExtAuthTimeoutS) * time.Second
 
+	cfg.ExtAuthDirectoryUser = os.Getenv("EXT_AUTH_DIRECTORY_USER")
+	cfg.ExtAuthDirectoryPassword = os.Getenv("EXT_AUTH_DIRECTORY_PASSWORD")
+	if cfg.ExtAuthDirectoryUser == "" || cfg.ExtAuthDirectoryPassword == "" {
+		logger.Warn().Msg("EXT_AUTH_DIRECTORY_USER or EXT_AUTH_DIRECTORY_PASSWORD not set - only the users already known to the proxy are provisioned on the homeserver")
+	} else {
+		logger.Debug().Str("EXT_AUTH_DIRECTORY_USER", cfg.ExtAuthDirectoryUser).Msg("external directory account loaded from environment")
+	}
+
 	logger.Debug().Msg("configuration loading completed successfully")
 
 	return cfg, nil
 }
 
+// parseAllowedNets parses a comma-separated list of IP addresses and CIDR networks.
+// Invalid entries are logged and skipped.
+func parseAllowedNets(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				logger.Warn().Str("entry", entry).Msg("invalid IP address in allowlist, ignoring")
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			logger.Warn().Str("entry", entry).Err(err).Msg("invalid CIDR in allowlist, ignoring")
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
 // NewTestConfig creates a minimal Config for testing purposes
 func NewTestConfig() *Config {
 	return &Config{
-		ProxyPort:            defaultPort,
-		LogLevel:             defaultLogLevel,
-		MatrixHomeserverURL:  "https://example.com",
-		MatrixAsToken:        "test_token",
-		MatrixAsUserID:       "@test:example.com",
-		MatrixHomeserverHost: "example.com",
-		PushTokenDBPath:      defaultPushTokenDBPath,
-		ProxyURL:             "https://example.com",
-		CacheTTLSeconds:      defaultCacheTTLSeconds,
-		CacheTTL:             time.Duration(defaultCacheTTLSeconds) * time.Second,
-		ExtAuthTimeoutS:      defaultExtAuthTimeoutS,
-		ExtAuthTimeout:       time.Duration(defaultExtAuthTimeoutS) * time.Second,
+		ProxyPort:                defaultPort,
+		LogLevel:                 defaultLogLevel,
+		MatrixHomeserverURL:      "https://example.com",
+		MatrixAsToken:            "test_token",
+		MatrixHsToken:            "test_hs_token",
+		MatrixAsUserID:           "@test:example.com",
+		MatrixHomeserverHost:     "example.com",
+		PushTokenDBPath:          defaultPushTokenDBPath,
+		SyncTokenMaxAgeDays:      defaultSyncTokenMaxAgeDays,
+		SyncTokenMaxAge:          time.Duration(defaultSyncTokenMaxAgeDays) * 24 * time.Hour,
+		SyncTimeoutS:             defaultSyncTimeoutS,
+		SyncTimeout:              time.Duration(defaultSyncTimeoutS) * time.Second,
+		ProxyURL:                 "https://example.com",
+		PusherReconcileIntervalS: defaultPusherReconcileS,
+		PusherReconcileInterval:  time.Duration(defaultPusherReconcileS) * time.Second,
+		PNMURL:                   defaultPNMURL,
+		PushQueueWorkers:         defaultPushQueueWorkers,
+		PushMaxAttempts:          defaultPushMaxAttempts,
+		MediaPublicURL:           "https://example.com",
+		MediaLinkTTLHours:        defaultMediaLinkTTLHours,
+		MediaLinkTTL:             time.Duration(defaultMediaLinkTTLHours) * time.Hour,
+		CacheTTLSeconds:          defaultCacheTTLSeconds,
+		CacheTTL:                 time.Duration(defaultCacheTTLSeconds) * time.Second,
+		ExtAuthTimeoutS:          defaultExtAuthTimeoutS,
+		ExtAuthTimeout:           time.Duration(defaultExtAuthTimeoutS) * time.Second,
 	}
 }
 
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// conversation describes how the messages of a room are presented to the Acrobits app.
+// Direct rooms have the identifier of the other participant, multi-party rooms have a
+// display name and the list of participants instead.
+type conversation struct {
+	other        string
+	group        bool
+	name         string
+	participants []string
+}
+
+// isRoomTarget reports whether a send_message recipient refers to a room rather than a user:
+// a room ID (which is also the stream_id reported by fetch_messages) or a room alias.
+func isRoomTarget(target string) bool {
+	target = strings.TrimSpace(target)
+	return strings.HasPrefix(target, "!") || strings.HasPrefix(target, "#")
+}
+
+// resolveRoomTarget resolves a room ID or room alias used as send_message recipient.
+// Aliases without a server name are completed with the homeserver host.
+func (s *MessageService) resolveRoomTarget(ctx context.Context, target string) (id.RoomID, error) {
+	target = strings.TrimSpace(target)
+	if strings.HasPrefix(target, "!") {
+		return id.RoomID(target), nil
+	}
+
+	alias := target
+	if !strings.Contains(alias, ":") {
+		alias = alias + ":" + s.homeserverHost
+	}
+	roomID := s.matrixClient.ResolveRoomAlias(ctx, alias)
+	if roomID == "" {
+		logger.Warn().Str("alias", alias).Msg("room alias could not be resolved")
+		return "", ErrInvalidRecipient
+	}
+	return id.RoomID(roomID), nil
+}
+
+// joinTargetRoom ensures the sender is a member of a room used as send_message recipient.
+// Rooms the sender is not allowed to join are reported as invalid recipients.
+func (s *MessageService) joinTargetRoom(ctx context.Context, sender id.UserID, roomID id.RoomID) error {
+	if _, err := s.matrixClient.JoinRoom(ctx, sender, roomID); err != nil {
+		if errors.Is(err, mautrix.MForbidden) || errors.Is(err, mautrix.MNotFound) {
+			logger.Warn().Str("sender", string(sender)).Str("room_id", string(roomID)).Err(err).Msg("sender cannot join target room")
+			return fmt.Errorf("%w: %v", ErrInvalidRecipient, err)
+		}
+		return fmt.Errorf("send message: %w", mapAuthErr(err))
+	}
+	return nil
+}
+
+// resolveConversation determines whether a room is a direct or a group conversation for userID.
+// Rooms with a direct alias (see generateRoomAliasKey) are direct. Other rooms are direct only when
+// they have no name and exactly one other member (e.g. direct chats created by Element), and are
+// otherwise reported as groups.
+func (s *MessageService) resolveConversation(ctx context.Context, roomID id.RoomID, userID id.UserID) conversation {
+	if other := s.resolveRoomIDToOtherIdentifier(ctx, roomID, string(userID)); other != "" {
+		return conversation{other: other}
+	}
+
+	group, err := s.getRoomGroup(ctx, roomID, userID)
+	if err != nil {
+		logger.Warn().Str("room_id", string(roomID)).Err(err).Msg("failed to resolve room members")
+		return conversation{}
+	}
+
+	others := make([]string, 0, len(group.Members))
+	participants := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		identifier := s.resolveMatrixIDToIdentifier(member)
+		participants = append(participants, identifier)
+		if !isSentBy(member, string(userID)) {
+			others = append(others, identifier)
+		}
+	}
+	sort.Strings(others)
+	sort.Strings(participants)
+
+	if group.Name == "" && len(others) == 1 {
+		return conversation{other: others[0]}
+	}
+
+	name := group.Name
+	if name == "" {
+		name = strings.Join(others, ", ")
+	}
+	return conversation{group: true, name: name, participants: participants}
+}
+
+// getRoomGroup returns the name and joined members of a room, as seen by userID.
+func (s *MessageService) getRoomGroup(ctx context.Context, roomID id.RoomID, userID id.UserID) (RoomGroup, error) {
+	if group, ok := s.roomGroupCache.Get(string(roomID)); ok {
+		logger.Debug().Str("room_id", string(roomID)).Int("member_count", len(group.Members)).Msg("fetched room group from cache")
+		return group, nil
+	}
+
+	members, err := s.matrixClient.GetJoinedMembers(ctx, userID, roomID)
+	if err != nil {
+		return RoomGroup{}, err
+	}
+	group := RoomGroup{
+		Name:    s.matrixClient.GetRoomName(ctx, userID, roomID),
+		Members: make([]string, 0, len(members)),
+	}
+	for _, member := range members {
+		group.Members = append(group.Members, string(member))
+	}
+	s.roomGroupCache.Set(string(roomID), group)
+	return group, nil
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+)
+
+// fakeGroupHomeserver serves a group room, "!group:example.com" (alias #team:example.com),
+// and an unnamed two-member room, "!dm:example.com", without direct aliases.
+type fakeGroupHomeserver struct {
+	mu     sync.Mutex
+	joined []string // rooms joined
+}
+
+func (f *fakeGroupHomeserver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		path := r.URL.Path
+		switch {
+		case path == "/_matrix/client/v3/directory/room/#team:example.com":
+			_, _ = w.Write([]byte(`{"room_id":"!group:example.com","servers":["example.com"]}`))
+		case strings.HasPrefix(path, "/_matrix/client/v3/join/"):
+			roomID := strings.TrimPrefix(path, "/_matrix/client/v3/join/")
+			if roomID == "!private:example.com" {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"not invited"}`))
+				return
+			}
+			f.joined = append(f.joined, roomID)
+			fmt.Fprintf(w, `{"room_id":%q}`, roomID)
+		case strings.HasSuffix(path, "/aliases"):
+			_, _ = w.Write([]byte(`{"aliases":[]}`))
+		case path == "/_matrix/client/v3/rooms/!group:example.com/joined_members":
+			_, _ = w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{},"@carol:example.com":{}}}`))
+		case path == "/_matrix/client/v3/rooms/!dm:example.com/joined_members":
+			_, _ = w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{}}}`))
+		case path == "/_matrix/client/v3/rooms/!group:example.com/state/m.room.name/":
+			_, _ = w.Write([]byte(`{"name":"Team"}`))
+		case path == "/_matrix/client/v3/sync":
+			_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{
+				"!group:example.com":{"timeline":{"events":[
+					{"type":"m.room.message","event_id":"$g1","sender":"@bob:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"hi team"}},
+					{"type":"m.room.message","event_id":"$g2","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"hello"}}
+				]}},
+				"!dm:example.com":{"timeline":{"events":[
+					{"type":"m.room.message","event_id":"$d1","sender":"@alice:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"just us"}}
+				]}}
+			}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}
+}
+
+func TestResolveRoomTarget(t *testing.T) {
+	hs := &fakeGroupHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	assert.True(t, isRoomTarget("!group:example.com"))
+	assert.True(t, isRoomTarget("#team"))
+	assert.False(t, isRoomTarget("@bob:example.com"))
+	assert.False(t, isRoomTarget("201"))
+
+	roomID, err := svc.resolveRoomTarget(context.Background(), "!group:example.com")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!group:example.com"), roomID)
+
+	roomID, err = svc.resolveRoomTarget(context.Background(), "#team")
+	require.NoError(t, err)
+	assert.Equal(t, id.RoomID("!group:example.com"), roomID)
+
+	_, err = svc.resolveRoomTarget(context.Background(), "#missing:example.com")
+	assert.ErrorIs(t, err, ErrInvalidRecipient)
+}
+
+func TestJoinTargetRoom(t *testing.T) {
+	hs := &fakeGroupHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	require.NoError(t, svc.joinTargetRoom(context.Background(), "@alice:example.com", "!group:example.com"))
+	assert.Equal(t, []string{"!group:example.com"}, hs.joined)
+	err := svc.joinTargetRoom(context.Background(), "@alice:example.com", "!private:example.com")
+	assert.ErrorIs(t, err, ErrInvalidRecipient)
+}
+
+func TestResolveConversation(t *testing.T) {
+	hs := &fakeGroupHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+	setMapping(t, svc, mappingEntry{Number: 202, MatrixID: "@bob:example.com"})
+
+	t.Run("named group", func(t *testing.T) {
+		conv := svc.resolveConversation(context.Background(), "!group:example.com", "@alice:example.com")
+		assert.True(t, conv.group)
+		assert.Equal(t, "Team", conv.name)
+		assert.Equal(t, []string{"202", "@alice:example.com", "@carol:example.com"}, conv.participants)
+
+		group, ok := svc.roomGroupCache.Get("!group:example.com")
+		assert.True(t, ok)
+		assert.Len(t, group.Members, 3)
+	})
+
+	t.Run("unnamed two-member room is direct", func(t *testing.T) {
+		conv := svc.resolveConversation(context.Background(), "!dm:example.com", "@alice:example.com")
+		assert.False(t, conv.group)
+		assert.Equal(t, "202", conv.other)
+	})
+
+	t.Run("unnamed group uses participant names", func(t *testing.T) {
+		svc.roomGroupCache.Set("!unnamed:example.com", RoomGroup{Members: []string{"@alice:example.com", "@bob:example.com", "@carol:example.com"}})
+		conv := svc.resolveConversation(context.Background(), "!unnamed:example.com", "@alice:example.com")
+		assert.True(t, conv.group)
+		assert.Equal(t, "202, @carol:example.com", conv.name)
+	})
+}
+
+func TestFetchMessages_GroupRooms(t *testing.T) {
+	hs := &fakeGroupHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{Username: "@alice:example.com"})
+	require.NoError(t, err)
+
+	require.Len(t, resp.ReceivedSMSs, 1)
+	received := resp.ReceivedSMSs[0]
+	assert.Equal(t, "!group:example.com", received.StreamID)
+	assert.Equal(t, "Team", received.StreamName)
+	assert.Len(t, received.Participants, 3)
+	assert.Equal(t, "@bob:example.com", received.Sender)
+
+	sentByID := map[string]models.SMS{}
+	for _, sms := range resp.SentSMSs {
+		sentByID[sms.SMSID] = sms
+	}
+	require.Len(t, sentByID, 2)
+	assert.Equal(t, "!group:example.com", sentByID["$g2"].Recipient)
+	assert.Equal(t, "Team", sentByID["$g2"].StreamName)
+	assert.Equal(t, "@bob:example.com", sentByID["$d1"].Recipient)
+	assert.Empty(t, sentByID["$d1"].StreamName)
+	assert.Empty(t, sentByID["$d1"].Participants)
+
+	data, err := json.Marshal(received)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"stream_name":"Team"`)
+}
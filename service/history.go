@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// historyPageSize is the number of events requested for each page of room history.
+	historyPageSize = 100
+	// maxHistoryPages bounds the room history fetched, per room, to find the last delivered messages.
+	maxHistoryPages = 10
+)
+
+// deliveryMarkers are the last received (last_id) and sent (last_sent_id) messages a device reported
+// to have, used to rebuild the messages it has not seen when its sync cursor is lost.
+type deliveryMarkers struct {
+	lastID     id.EventID
+	lastSentID id.EventID
+	// Timestamps of the marker events, set once they are found in the room history
+	lastTS     int64
+	lastSentTS int64
+}
+
+func (m *deliveryMarkers) empty() bool {
+	return m.lastID == "" && m.lastSentID == ""
+}
+
+// found reports whether all the reported markers have been located in the room history.
+func (m *deliveryMarkers) found() bool {
+	return (m.lastID == "" || m.lastTS != 0) && (m.lastSentID == "" || m.lastSentTS != 0)
+}
+
+// oldest returns the timestamp of the oldest located marker, which bounds the history to fetch.
+func (m *deliveryMarkers) oldest() int64 {
+	switch {
+	case m.lastID == "":
+		return m.lastSentTS
+	case m.lastSentID == "":
+		return m.lastTS
+	default:
+		return min(m.lastTS, m.lastSentTS)
+	}
+}
+
+func (m *deliveryMarkers) observe(evt *event.Event) {
+	switch evt.ID {
+	case m.lastID:
+		m.lastTS = evt.Timestamp
+	case m.lastSentID:
+		m.lastSentTS = evt.Timestamp
+	}
+}
+
+// isNew reports whether a message was not yet delivered to the device. The markers are messages of any room,
+// so messages are compared by timestamp with the marker of their direction. When that marker was not found,
+// the other one bounds the messages; when none was found, every message is new.
+func (m *deliveryMarkers) isNew(evt *event.Event, sent bool) bool {
+	if m == nil {
+		return true
+	}
+	marker, ts, otherTS := m.lastID, m.lastTS, m.lastSentTS
+	if sent {
+		marker, ts, otherTS = m.lastSentID, m.lastSentTS, m.lastTS
+	}
+	switch {
+	case marker != "" && ts != 0:
+		return evt.ID != marker && evt.Timestamp >= ts
+	case otherTS != 0:
+		// The device has all the messages up to the other marker, at least
+		return evt.Timestamp > otherTS
+	default:
+		return true
+	}
+}
+
+// located reports whether at least one of the reported markers has been located in the room history.
+func (m *deliveryMarkers) located() bool {
+	return m.lastTS != 0 || m.lastSentTS != 0
+}
+
+// rebuildFromHistory prepends older events to the timelines of a full sync, paginating the history of
+// each room until the markers are found and the history reaches back to them.
+// The markers can be in any room: they are first looked for in all the timelines, so the rooms holding neither
+// of them stop paging once they reach back to the markers found elsewhere. When no marker is found at all,
+// the fetched history is discarded and the device gets the timelines of the full sync.
+func (s *MessageService) rebuildFromHistory(ctx context.Context, userID id.UserID, resp *mautrix.RespSync, markers *deliveryMarkers) {
+	timelines := make(map[id.RoomID][]*event.Event, len(resp.Rooms.Join))
+	for roomID, room := range resp.Rooms.Join {
+		timelines[roomID] = room.Timeline.Events
+		for _, evt := range room.Timeline.Events {
+			markers.observe(evt)
+		}
+	}
+
+	for roomID, room := range resp.Rooms.Join {
+		if !room.Timeline.Limited {
+			// The timeline already holds the whole room history
+			continue
+		}
+
+		from := room.Timeline.PrevBatch
+		for page := 0; page < maxHistoryPages && from != ""; page++ {
+			if markers.found() && len(room.Timeline.Events) > 0 && room.Timeline.Events[0].Timestamp <= markers.oldest() {
+				break
+			}
+
+			history, err := s.matrixClient.Messages(ctx, userID, roomID, from, historyPageSize)
+			if err != nil {
+				logger.Warn().Str("user_id", string(userID)).Str("room_id", string(roomID)).Err(err).Msg("failed to fetch room history")
+				break
+			}
+			if len(history.Chunk) == 0 {
+				break
+			}
+
+			// Pages are returned newest first
+			older := make([]*event.Event, 0, len(history.Chunk)+len(room.Timeline.Events))
+			for i := len(history.Chunk) - 1; i >= 0; i-- {
+				markers.observe(history.Chunk[i])
+				older = append(older, history.Chunk[i])
+			}
+			room.Timeline.Events = append(older, room.Timeline.Events...)
+			from = history.End
+		}
+	}
+
+	if !markers.located() {
+		for roomID, room := range resp.Rooms.Join {
+			room.Timeline.Events = timelines[roomID]
+		}
+		logger.Warn().Str("user_id", string(userID)).Str("last_id", string(markers.lastID)).Str("last_sent_id", string(markers.lastSentID)).
+			Msg("last delivered messages not found in room history, returning the latest messages only")
+		return
+	}
+
+	logger.Debug().
+		Str("user_id", string(userID)).
+		Str("last_id", string(markers.lastID)).
+		Str("last_sent_id", string(markers.lastSentID)).
+		Bool("found", markers.found()).
+		Msg("rebuilt messages from room history")
+}
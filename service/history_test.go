@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHistoryHomeserver serves a direct room between alice and bob whose full sync timeline is limited,
+// with the older events available through /messages.
+type fakeHistoryHomeserver struct {
+	mu    sync.Mutex
+	since []string // since tokens of the sync requests
+	froms []string // from tokens of the history requests
+}
+
+func (f *fakeHistoryHomeserver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!dm:example.com/joined_members":
+			_, _ = w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{}}}`))
+		case "/_matrix/client/v3/sync":
+			since := r.URL.Query().Get("since")
+			f.since = append(f.since, since)
+			if since != "" {
+				_, _ = w.Write([]byte(`{"next_batch":"s2"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!dm:example.com":{"timeline":{"limited":true,"prev_batch":"p1","events":[
+				{"type":"m.room.message","event_id":"$5","sender":"@bob:example.com","origin_server_ts":5000,"content":{"msgtype":"m.text","body":"five"}},
+				{"type":"m.room.message","event_id":"$6","sender":"@alice:example.com","origin_server_ts":6000,"content":{"msgtype":"m.text","body":"six"}}
+			]}}}}}`))
+		case "/_matrix/client/v3/rooms/!dm:example.com/messages":
+			from := r.URL.Query().Get("from")
+			f.froms = append(f.froms, from)
+			switch from {
+			case "p1":
+				_, _ = w.Write([]byte(`{"start":"p1","end":"p2","chunk":[
+					{"type":"m.room.message","event_id":"$4","sender":"@alice:example.com","origin_server_ts":4000,"content":{"msgtype":"m.text","body":"four"}},
+					{"type":"m.room.message","event_id":"$3","sender":"@bob:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"three"}}
+				]}`))
+			case "p2":
+				_, _ = w.Write([]byte(`{"start":"p2","end":"p3","chunk":[
+					{"type":"m.room.message","event_id":"$2","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"two"}},
+					{"type":"m.room.message","event_id":"$1","sender":"@bob:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"one"}}
+				]}`))
+			default:
+				_, _ = w.Write([]byte(`{"start":"p3","chunk":[]}`))
+			}
+		default:
+			_, _ = w.Write([]byte(`{"aliases":[]}`))
+		}
+	}
+}
+
+func smsIDs(messages []models.SMS) []string {
+	ids := make([]string, 0, len(messages))
+	for _, sms := range messages {
+		ids = append(ids, sms.SMSID)
+	}
+	return ids
+}
+
+func TestFetchMessages_RebuildFromHistory(t *testing.T) {
+	hs := &fakeHistoryHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	t.Run("pages back to the last delivered messages", func(t *testing.T) {
+		resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{
+			Username:   "@alice:example.com",
+			Device:     "phone",
+			LastID:     "$1",
+			LastSentID: "$4",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"$3", "$5"}, smsIDs(resp.ReceivedSMSs))
+		assert.Equal(t, []string{"$6"}, smsIDs(resp.SentSMSs))
+		assert.Equal(t, []string{"p1", "p2"}, hs.froms)
+		assert.Equal(t, "s1", svc.getBatchToken("@alice:example.com", "phone"))
+	})
+
+	t.Run("stops paging once the markers are reached", func(t *testing.T) {
+		hs.froms = nil
+		resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{
+			Username:   "@alice:example.com",
+			Device:     "tablet",
+			LastID:     "$5",
+			LastSentID: "$4",
+		})
+		require.NoError(t, err)
+		assert.Empty(t, resp.ReceivedSMSs)
+		assert.Equal(t, []string{"$6"}, smsIDs(resp.SentSMSs))
+		assert.Equal(t, []string{"p1"}, hs.froms)
+	})
+
+	t.Run("falls back to the other marker when one is not found", func(t *testing.T) {
+		hs.froms = nil
+		resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{
+			Username:   "@alice:example.com",
+			Device:     "laptop",
+			LastID:     "$gone",
+			LastSentID: "$4",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"$5"}, smsIDs(resp.ReceivedSMSs))
+		assert.Equal(t, []string{"$6"}, smsIDs(resp.SentSMSs))
+	})
+
+	t.Run("returns the latest messages when no marker is found", func(t *testing.T) {
+		hs.froms = nil
+		resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{
+			Username:   "@alice:example.com",
+			Device:     "watch",
+			LastID:     "$gone",
+			LastSentID: "$other-room",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"$5"}, smsIDs(resp.ReceivedSMSs))
+		assert.Equal(t, []string{"$6"}, smsIDs(resp.SentSMSs))
+		assert.Equal(t, []string{"p1", "p2", "p3"}, hs.froms)
+	})
+
+	t.Run("devices keep separate cursors", func(t *testing.T) {
+		hs.since = nil
+		_, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{Username: "@alice:example.com", Device: "phone"})
+		require.NoError(t, err)
+		_, err = svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{Username: "@alice:example.com", Device: "desktop"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"s1", ""}, hs.since)
+		assert.Equal(t, "s2", svc.getBatchToken("@alice:example.com", "phone"))
+		assert.Equal(t, "s1", svc.getBatchToken("@alice:example.com", "desktop"))
+	})
+}
@@ -0,0 +1,658 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// maxAttachmentSize limits the size of a single attachment downloaded from the Acrobits file storage.
+	maxAttachmentSize = 100 << 20
+	// maxPreviewSize limits the size of the inline preview added to incoming media.
+	maxPreviewSize = 256 << 10
+	// previewSize is the bounding box, in pixels, requested for thumbnails of incoming images.
+	previewSize = 320
+)
+
+var (
+	ErrInvalidAttachment     = errors.New("invalid file transfer attachment")
+	ErrInvalidMediaSignature = errors.New("invalid media signature")
+	ErrMediaLinkExpired      = errors.New("media link expired")
+	ErrMediaNotFound         = errors.New("media not found")
+)
+
+// sendFileTransfer translates an application/x-acro-filetransfer+json body into Matrix media events.
+// Every attachment is downloaded from its content-url, uploaded to the homeserver media repository
+// as the sender and posted to the room as m.image, m.video, m.audio or m.file.
+// If the message carries a text body, it is sent as a separate m.text event before the attachments.
+// The disposition notification, if any, is attached to the first event, whose ID is returned.
+func (s *MessageService) sendFileTransfer(ctx context.Context, sender id.UserID, roomID id.RoomID, body, notification string) (id.EventID, error) {
+	var ft models.FileTransferMessage
+	if err := json.Unmarshal([]byte(body), &ft); err != nil {
+		logger.Warn().Str("sender", string(sender)).Err(err).Msg("file transfer: invalid message body")
+		return "", fmt.Errorf("%w: %v", ErrInvalidAttachment, err)
+	}
+	if len(ft.Attachments) == 0 {
+		logger.Warn().Str("sender", string(sender)).Msg("file transfer: message has no attachments")
+		return "", fmt.Errorf("%w: no attachments", ErrInvalidAttachment)
+	}
+
+	contents := make([]*event.MessageEventContent, 0, len(ft.Attachments)+1)
+	if strings.TrimSpace(ft.Body) != "" {
+		contents = append(contents, &event.MessageEventContent{
+			MsgType: event.MsgText,
+			Body:    ft.Body,
+		})
+	}
+	for i := range ft.Attachments {
+		content, err := s.uploadAttachment(ctx, sender, &ft.Attachments[i])
+		if err != nil {
+			return "", err
+		}
+		contents = append(contents, content)
+	}
+
+	var firstEventID id.EventID
+	for i, content := range contents {
+		var payload interface{} = content
+		if i == 0 {
+			payload = withDispositionNotification(content, notification)
+		}
+		resp, err := s.matrixClient.SendMessage(ctx, sender, roomID, payload)
+		if err != nil {
+			logger.Error().Str("sender", string(sender)).Str("room_id", string(roomID)).Str("msgtype", string(content.MsgType)).Err(err).Msg("file transfer: failed to send event")
+			return "", fmt.Errorf("send message: %w", mapAuthErr(err))
+		}
+		if firstEventID == "" {
+			firstEventID = resp.EventID
+		}
+	}
+
+	logger.Debug().Str("sender", string(sender)).Str("room_id", string(roomID)).Int("attachments", len(ft.Attachments)).Msg("file transfer: attachments sent")
+	return firstEventID, nil
+}
+
+// uploadAttachment downloads a single attachment, uploads it (and its preview, if any) to the
+// Matrix media repository and returns the message content describing it.
+// Attachments carrying an encryption-key are decrypted and stored as Matrix encrypted files,
+// so they are never kept in clear in the media repository.
+func (s *MessageService) uploadAttachment(ctx context.Context, sender id.UserID, att *models.Attachment) (*event.MessageEventContent, error) {
+	if strings.TrimSpace(att.ContentURL) == "" {
+		return nil, fmt.Errorf("%w: missing content-url", ErrInvalidAttachment)
+	}
+
+	data, respContentType, err := s.downloadAttachment(ctx, att.ContentURL)
+	if err != nil {
+		logger.Error().Str("content_url", att.ContentURL).Err(err).Msg("file transfer: failed to download attachment")
+		return nil, err
+	}
+
+	encrypted := strings.TrimSpace(att.EncryptionKey) != ""
+	if encrypted {
+		if err := decryptAttachment(att, data); err != nil {
+			logger.Error().Str("content_url", att.ContentURL).Err(err).Msg("file transfer: failed to decrypt attachment")
+			return nil, err
+		}
+		// The storage only sees ciphertext, its Content-Type is meaningless
+		respContentType = ""
+	}
+	// A corrupted download or a wrong key must not be delivered as the file
+	if att.Hash != "" && att.Hash != acrobitsHash(data) {
+		logger.Warn().Str("content_url", att.ContentURL).Str("hash", att.Hash).Msg("file transfer: attachment hash mismatch")
+		return nil, fmt.Errorf("%w: hash mismatch", ErrInvalidAttachment)
+	}
+
+	fileName := attachmentFileName(att)
+	mimeType := attachmentMimeType(att.ContentType, respContentType, fileName, data)
+
+	info := &event.FileInfo{
+		MimeType: mimeType,
+		Size:     len(data),
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			info.Width, info.Height = cfg.Width, cfg.Height
+		}
+	}
+
+	var file *attachment.EncryptedFile
+	uploadType := mimeType
+	if encrypted {
+		file = attachment.NewEncryptedFile()
+		file.EncryptInPlace(data)
+		uploadType = "application/octet-stream"
+	}
+
+	uri, err := s.matrixClient.UploadMedia(ctx, sender, data, uploadType, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("upload attachment: %w", mapAuthErr(err))
+	}
+
+	if att.Preview != nil && att.Preview.Content != "" {
+		if err := s.uploadAttachmentPreview(ctx, sender, att.Preview, info, encrypted); err != nil {
+			// A missing thumbnail is not fatal, the attachment itself is still delivered
+			logger.Warn().Str("content_url", att.ContentURL).Err(err).Msg("file transfer: failed to upload attachment preview")
+		}
+	}
+
+	body := fileName
+	if att.Description != "" {
+		body = att.Description
+	}
+	content := &event.MessageEventContent{
+		MsgType:  msgTypeForMime(mimeType),
+		Body:     body,
+		FileName: fileName,
+		Info:     info,
+	}
+	if file != nil {
+		content.File = &event.EncryptedFileInfo{EncryptedFile: *file, URL: uri.CUString()}
+	} else {
+		content.URL = uri.CUString()
+	}
+	return content, nil
+}
+
+// uploadAttachmentPreview uploads the inline preview of an attachment and records it as thumbnail in info.
+// When encrypted is set, the preview is stored as a Matrix encrypted file like the attachment itself.
+func (s *MessageService) uploadAttachmentPreview(ctx context.Context, sender id.UserID, preview *models.AttachmentPreview, info *event.FileInfo, encrypted bool) error {
+	data, err := base64.StdEncoding.DecodeString(preview.Content)
+	if err != nil {
+		return fmt.Errorf("decode preview: %w", err)
+	}
+	mimeType := preview.ContentType
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	thumbInfo := &event.FileInfo{
+		MimeType: mimeType,
+		Size:     len(data),
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		thumbInfo.Width, thumbInfo.Height = cfg.Width, cfg.Height
+	}
+
+	var file *attachment.EncryptedFile
+	uploadType := mimeType
+	if encrypted {
+		file = attachment.NewEncryptedFile()
+		file.EncryptInPlace(data)
+		uploadType = "application/octet-stream"
+	}
+
+	uri, err := s.matrixClient.UploadMedia(ctx, sender, data, uploadType, "")
+	if err != nil {
+		return fmt.Errorf("upload preview: %w", err)
+	}
+
+	if file != nil {
+		info.ThumbnailFile = &event.EncryptedFileInfo{EncryptedFile: *file, URL: uri.CUString()}
+	} else {
+		info.ThumbnailURL = uri.CUString()
+	}
+	info.ThumbnailInfo = thumbInfo
+	return nil
+}
+
+// decryptAttachment decrypts in place an attachment downloaded from the Acrobits file storage.
+func decryptAttachment(att *models.Attachment, data []byte) error {
+	key, err := parseAcrobitsKey(att.EncryptionKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAttachment, err)
+	}
+	if err := xorAcrobitsCTR(data, key); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAttachment, err)
+	}
+	return nil
+}
+
+// errAttachmentAddress is returned when an attachment URL points to an address that is not public.
+var errAttachmentAddress = errors.New("attachment address not allowed")
+
+// newMediaHTTPClient returns the client downloading the attachments. The attachment URLs are chosen by the app,
+// so the client only connects to public addresses, checked after the name resolution, and only follows https redirects.
+func newMediaHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: publicAddressOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// An outbound proxy would connect on our behalf, bypassing the address check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   60 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirect to %s", errAttachmentAddress, req.URL.Scheme)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// nonPublicPrefixes are the special-purpose ranges that are not reachable on the internet, or that embed
+// another address (NAT64, 6to4, Teredo), left out by the netip checks.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT)
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("3fff::/20"),       // documentation
+	netip.MustParsePrefix("fec0::/10"),       // site-local
+}
+
+// publicAddressOnly refuses the connections to addresses that are not public global unicast ones: loopback,
+// private, link-local, multicast, unspecified and the special-purpose ranges of nonPublicPrefixes.
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errAttachmentAddress, address)
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errAttachmentAddress, host)
+	}
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("%w: %s", errAttachmentAddress, host)
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: %s", errAttachmentAddress, host)
+		}
+	}
+	return nil
+}
+
+// downloadAttachment fetches an attachment from the Acrobits file storage.
+// It returns the file content and the Content-Type reported by the server.
+func (s *MessageService) downloadAttachment(ctx context.Context, contentURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, contentURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidAttachment, err)
+	}
+	if req.URL.Scheme != "https" {
+		return nil, "", fmt.Errorf("%w: content-url must use https", ErrInvalidAttachment)
+	}
+
+	resp, err := s.mediaHTTPClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errAttachmentAddress) {
+			return nil, "", fmt.Errorf("%w: %v", ErrInvalidAttachment, err)
+		}
+		return nil, "", fmt.Errorf("download attachment: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("download attachment: status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAttachmentSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("download attachment: %w", err)
+	}
+	if len(data) > maxAttachmentSize {
+		return nil, "", fmt.Errorf("%w: attachment exceeds %d bytes", ErrInvalidAttachment, maxAttachmentSize)
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// attachmentFileName returns the attachment filename, falling back to the last element of its URL.
+func attachmentFileName(att *models.Attachment) string {
+	if name := strings.TrimSpace(att.Filename); name != "" {
+		return name
+	}
+	name := att.ContentURL
+	if i := strings.IndexAny(name, "?#"); i != -1 {
+		name = name[:i]
+	}
+	name = path.Base(name)
+	if name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+// attachmentMimeType picks the most specific mime type available for an attachment:
+// the declared content-type, then the download Content-Type, then the file extension,
+// and finally content sniffing.
+func attachmentMimeType(declared, downloaded, fileName string, data []byte) string {
+	for _, candidate := range []string{declared, downloaded} {
+		if mediaType, _, err := mime.ParseMediaType(candidate); err == nil && mediaType != "application/octet-stream" {
+			return mediaType
+		}
+	}
+	if byExt := mime.TypeByExtension(path.Ext(fileName)); byExt != "" {
+		if mediaType, _, err := mime.ParseMediaType(byExt); err == nil {
+			return mediaType
+		}
+	}
+	return http.DetectContentType(data)
+}
+
+// msgTypeForMime maps a mime type to the Matrix message type used to send it.
+func msgTypeForMime(mimeType string) event.MessageType {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return event.MsgImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return event.MsgVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return event.MsgAudio
+	default:
+		return event.MsgFile
+	}
+}
+
+// isMediaMsgType reports whether the message type carries a file in the media repository.
+func isMediaMsgType(msgType event.MessageType) bool {
+	switch msgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseMessageContent decodes the content of an m.room.message event.
+func parseMessageContent(evt *event.Event) (*event.MessageEventContent, error) {
+	raw := []byte(evt.Content.VeryRaw)
+	if len(raw) == 0 {
+		var err error
+		if raw, err = json.Marshal(evt.Content.Raw); err != nil {
+			return nil, err
+		}
+	}
+	var content event.MessageEventContent
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// smsContent returns the text and content type used to deliver a Matrix message to Acrobits.
+// Media messages are converted to an application/x-acro-filetransfer+json document, while
+// everything else is delivered as plain text.
+func (s *MessageService) smsContent(ctx context.Context, evt *event.Event) (string, string) {
+	content, err := parseMessageContent(evt)
+	if err != nil {
+		logger.Warn().Str("event_id", string(evt.ID)).Err(err).Msg("failed to parse message content, falling back to raw body")
+		body, _ := evt.Content.Raw["body"].(string)
+		return body, "text/plain"
+	}
+	if !isMediaMsgType(content.MsgType) || (content.URL == "" && content.File == nil) {
+		return content.Body, "text/plain"
+	}
+
+	ft, err := s.buildFileTransfer(ctx, content)
+	if err != nil {
+		logger.Warn().Str("event_id", string(evt.ID)).Err(err).Msg("failed to convert media message, falling back to plain text")
+		return content.Body, "text/plain"
+	}
+	data, err := json.Marshal(ft)
+	if err != nil {
+		return content.Body, "text/plain"
+	}
+	return string(data), models.FileTransferContentType
+}
+
+// buildFileTransfer describes a Matrix media message as an Acrobits file transfer message.
+// The attachment URL points to the media proxy endpoint, so the app never talks to the homeserver directly.
+// Matrix encrypted files are re-encrypted by the media proxy with a key derived from the content URI,
+// which is delivered to the app in the encryption-key field of the attachment.
+func (s *MessageService) buildFileTransfer(ctx context.Context, content *event.MessageEventContent) (*models.FileTransferMessage, error) {
+	contentURI := content.URL
+	if content.File != nil {
+		contentURI = content.File.URL
+	}
+	uri, err := contentURI.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid content uri: %w", err)
+	}
+
+	sealedKey := ""
+	encryptionKey := ""
+	if content.File != nil {
+		if err := content.File.PrepareForDecryption(); err != nil {
+			return nil, fmt.Errorf("invalid encrypted file: %w", err)
+		}
+		if sealedKey, err = s.sealMediaFileKey(uri, &content.File.EncryptedFile); err != nil {
+			return nil, fmt.Errorf("seal file key: %w", err)
+		}
+		encryptionKey = hex.EncodeToString(s.acrobitsKey(uri))
+	}
+
+	fileName := content.FileName
+	caption := ""
+	if fileName == "" {
+		fileName = content.Body
+	} else if content.Body != fileName {
+		// When filename is set, body is a caption
+		caption = content.Body
+	}
+
+	att := models.Attachment{
+		ContentURL:    s.mediaURL(uri, sealedKey),
+		Filename:      fileName,
+		EncryptionKey: encryptionKey,
+	}
+	if content.Info != nil {
+		att.ContentType = content.Info.MimeType
+		att.ContentSize = int64(content.Info.Size)
+	}
+	att.Preview = s.fetchPreview(ctx, uri, content.Info, content.File != nil)
+
+	return &models.FileTransferMessage{
+		Body:        caption,
+		Attachments: []models.Attachment{att},
+	}, nil
+}
+
+// fetchPreview downloads a small thumbnail of an incoming media file to be inlined in the attachment.
+// It uses the thumbnail provided by the sender if present, otherwise asks the homeserver to
+// generate one for images. The homeserver cannot generate thumbnails of encrypted files.
+// Returns nil if no preview is available.
+func (s *MessageService) fetchPreview(ctx context.Context, uri id.ContentURI, info *event.FileInfo, encrypted bool) *models.AttachmentPreview {
+	if s.matrixClient == nil {
+		return nil
+	}
+
+	var resp *http.Response
+	var thumbFile *attachment.EncryptedFile
+	var err error
+	switch {
+	case info != nil && info.ThumbnailFile != nil:
+		thumbURI, perr := info.ThumbnailFile.URL.Parse()
+		if perr != nil {
+			return nil
+		}
+		thumbFile = &info.ThumbnailFile.EncryptedFile
+		resp, err = s.matrixClient.DownloadMedia(ctx, thumbURI)
+	case info != nil && info.ThumbnailURL != "":
+		thumbURI, perr := info.ThumbnailURL.Parse()
+		if perr != nil {
+			return nil
+		}
+		resp, err = s.matrixClient.DownloadMedia(ctx, thumbURI)
+	case !encrypted && info != nil && strings.HasPrefix(info.MimeType, "image/"):
+		resp, err = s.matrixClient.DownloadThumbnail(ctx, uri, previewSize, previewSize)
+	default:
+		return nil
+	}
+	if err != nil {
+		logger.Debug().Str("content_uri", uri.String()).Err(err).Msg("failed to download media preview")
+		return nil
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPreviewSize+1))
+	if err != nil || len(data) == 0 || len(data) > maxPreviewSize {
+		logger.Debug().Str("content_uri", uri.String()).Int("size", len(data)).Err(err).Msg("media preview unavailable or too large")
+		return nil
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if thumbFile != nil {
+		if err := thumbFile.DecryptInPlace(data); err != nil {
+			logger.Debug().Str("content_uri", uri.String()).Err(err).Msg("failed to decrypt media preview")
+			return nil
+		}
+		contentType = ""
+		if info.ThumbnailInfo != nil {
+			contentType = info.ThumbnailInfo.MimeType
+		}
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return &models.AttachmentPreview{
+		ContentType: contentType,
+		Content:     base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+// mediaURL builds the signed public URL used by the app to download a Matrix media file through the proxy.
+// The link expires after the media link TTL. For encrypted files, sealedKey carries the Matrix decryption
+// material (see sealMediaFileKey).
+func (s *MessageService) mediaURL(uri id.ContentURI, sealedKey string) string {
+	exp := s.now().Add(s.mediaLinkTTL).Unix()
+	link := fmt.Sprintf("%s/api/client/media/%s/%s?exp=%d&sig=%s",
+		strings.TrimSuffix(s.mediaPublicURL, "/"),
+		url.PathEscape(uri.Homeserver),
+		url.PathEscape(uri.FileID),
+		exp,
+		s.signMedia(uri, exp),
+	)
+	if sealedKey != "" {
+		link += "&key=" + url.QueryEscape(sealedKey)
+	}
+	return link
+}
+
+// signMedia returns the HMAC-SHA256 signature of a content URI and the expiry of its link, in Unix seconds.
+func (s *MessageService) signMedia(uri id.ContentURI, exp int64) string {
+	mac := hmac.New(sha256.New, s.mediaSigningKey)
+	mac.Write([]byte(uri.String() + "|" + strconv.FormatInt(exp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DownloadMedia verifies a signed media link, expiring at exp, and starts downloading the file from the homeserver.
+// When sealedKey is set, the file is a Matrix encrypted file: it is decrypted and re-encrypted
+// with the key given to the app (see acrobitsKey) before being returned.
+// The caller must close the response body.
+func (s *MessageService) DownloadMedia(ctx context.Context, server, mediaID, sig, exp, sealedKey string) (*http.Response, error) {
+	uri := id.ContentURI{Homeserver: server, FileID: mediaID}
+	if !uri.IsValid() {
+		return nil, ErrMediaNotFound
+	}
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || !hmac.Equal([]byte(sig), []byte(s.signMedia(uri, expiry))) {
+		logger.Warn().Str("content_uri", uri.String()).Msg("media download with invalid signature")
+		return nil, ErrInvalidMediaSignature
+	}
+	if s.now().Unix() > expiry {
+		logger.Info().Str("content_uri", uri.String()).Time("expired_at", time.Unix(expiry, 0)).Msg("media download with expired link")
+		return nil, ErrMediaLinkExpired
+	}
+	var file *attachment.EncryptedFile
+	if sealedKey != "" {
+		if file, err = s.openMediaFileKey(uri, sealedKey); err != nil {
+			logger.Warn().Str("content_uri", uri.String()).Msg("media download with invalid file key")
+			return nil, err
+		}
+	}
+
+	resp, err := s.matrixClient.DownloadMedia(ctx, uri)
+	if err != nil {
+		if errors.Is(err, mautrix.MNotFound) {
+			return nil, ErrMediaNotFound
+		}
+		return nil, fmt.Errorf("download media: %w", err)
+	}
+	if sealedKey == "" {
+		return resp, nil
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	return s.reencryptMedia(uri, file, resp.Body)
+}
+
+// reencryptMedia converts a Matrix encrypted file to the Acrobits encryption scheme.
+// The whole file is buffered, so that its hash is verified before anything is sent to the app.
+func (s *MessageService) reencryptMedia(uri id.ContentURI, file *attachment.EncryptedFile, body io.Reader) (*http.Response, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxAttachmentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("download media: %w", err)
+	}
+	if len(data) > maxAttachmentSize {
+		return nil, fmt.Errorf("download media: file exceeds %d bytes", maxAttachmentSize)
+	}
+	if err := file.DecryptInPlace(data); err != nil {
+		logger.Warn().Str("content_uri", uri.String()).Err(err).Msg("failed to decrypt media")
+		return nil, fmt.Errorf("decrypt media: %w", err)
+	}
+	if err := xorAcrobitsCTR(data, s.acrobitsKey(uri)); err != nil {
+		return nil, fmt.Errorf("encrypt media: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		ContentLength: int64(len(data)),
+		Body:          io.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
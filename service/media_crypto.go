@@ -0,0 +1,161 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/id"
+)
+
+// Acrobits encrypted attachments (spec: https://doc.acrobits.net/api/client/x-acro-filetransfer.html)
+// are encrypted with AES in CTR mode, starting from an all-zero counter block. The key is carried
+// hex encoded in the encryption-key field of the attachment and the optional hash field holds the
+// CRC32 checksum of the decrypted content.
+// Matrix encrypted attachments use AES-256-CTR too, but with a random IV and a JWK encoded key,
+// so files are always re-encrypted when crossing the proxy.
+
+// acrobitsKeySize is the size of the keys generated by the proxy for attachments delivered to the app.
+const acrobitsKeySize = 16
+
+var ErrInvalidEncryptionKey = errors.New("invalid attachment encryption key")
+
+// parseAcrobitsKey decodes a hex encoded AES-128, AES-192 or AES-256 key.
+func parseAcrobitsKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported key length %d", ErrInvalidEncryptionKey, len(key))
+	}
+}
+
+// xorAcrobitsCTR encrypts or decrypts data in place using the Acrobits attachment scheme.
+func xorAcrobitsCTR(data, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(data, data)
+	return nil
+}
+
+// acrobitsHash returns the checksum of decrypted content in the format of the Acrobits hash field.
+func acrobitsHash(data []byte) string {
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 10)
+}
+
+// deriveMediaSigningKey derives the key signing the media links and sealing the Matrix file keys from
+// MEDIA_SIGNING_KEY, or from the Application Service token when it is not set: the token itself is never
+// used as a key.
+func deriveMediaSigningKey(cfg *Config) []byte {
+	secret := cfg.MediaSigningKey
+	if secret == "" {
+		secret = cfg.MatrixAsToken
+	}
+	// HKDF only fails for keys longer than 255 hashes
+	key, _ := hkdf.Key(sha256.New, []byte(secret), nil, "matrix2acrobits media links", sha256.Size)
+	return key
+}
+
+// acrobitsKey derives the key used to encrypt a Matrix encrypted file before serving it to the app.
+// The key is bound to the content URI, so the media proxy can recompute it without storing any state.
+func (s *MessageService) acrobitsKey(uri id.ContentURI) []byte {
+	mac := hmac.New(sha256.New, s.mediaSigningKey)
+	mac.Write([]byte("acrobits-key|" + uri.String()))
+	return mac.Sum(nil)[:acrobitsKeySize]
+}
+
+// mediaFileKey holds the decryption material of a Matrix encrypted file.
+type mediaFileKey struct {
+	Key    string `json:"k"`
+	IV     string `json:"iv"`
+	SHA256 string `json:"h"`
+}
+
+// sealMediaFileKey encrypts the decryption material of a Matrix encrypted file so it can travel in a
+// download link without being exposed in URLs and access logs. The content URI is authenticated
+// along with the key, so a sealed key is only valid for its own file.
+func (s *MessageService) sealMediaFileKey(uri id.ContentURI, file *attachment.EncryptedFile) (string, error) {
+	plaintext, err := json.Marshal(mediaFileKey{
+		Key:    file.Key.Key,
+		IV:     file.InitVector,
+		SHA256: file.Hashes.SHA256,
+	})
+	if err != nil {
+		return "", err
+	}
+	aead, err := s.mediaKeyAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(uri.String()))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openMediaFileKey reverses sealMediaFileKey and returns a Matrix encrypted file ready for decryption.
+func (s *MessageService) openMediaFileKey(uri id.ContentURI, sealed string) (*attachment.EncryptedFile, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, ErrInvalidMediaSignature
+	}
+	aead, err := s.mediaKeyAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrInvalidMediaSignature
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(uri.String()))
+	if err != nil {
+		return nil, ErrInvalidMediaSignature
+	}
+	var key mediaFileKey
+	if err := json.Unmarshal(plaintext, &key); err != nil {
+		return nil, ErrInvalidMediaSignature
+	}
+	return &attachment.EncryptedFile{
+		Key: attachment.JSONWebKey{
+			Key:         key.Key,
+			Algorithm:   "A256CTR",
+			Extractable: true,
+			KeyType:     "oct",
+			KeyOps:      []string{"encrypt", "decrypt"},
+		},
+		InitVector: key.IV,
+		Hashes:     attachment.EncryptedFileHashes{SHA256: key.SHA256},
+		Version:    "v2",
+	}, nil
+}
+
+// mediaKeyAEAD returns the cipher used to seal Matrix file keys, keyed from the media signing key.
+func (s *MessageService) mediaKeyAEAD() (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, s.mediaSigningKey)
+	mac.Write([]byte("media-file-key"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,478 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// fakeHomeserver records media uploads and sent message events.
+type fakeHomeserver struct {
+	mu      sync.Mutex
+	uploads []string // content types of uploaded media
+	data    [][]byte // content of uploaded media
+	events  []map[string]interface{}
+	media   map[string][]byte // downloadable media by media ID
+}
+
+func (f *fakeHomeserver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_matrix/media/v3/upload"):
+			data, _ := io.ReadAll(r.Body)
+			f.uploads = append(f.uploads, r.Header.Get("Content-Type"))
+			f.data = append(f.data, data)
+			fmt.Fprintf(w, `{"content_uri":"mxc://example.com/media%d"}`, len(f.uploads))
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v1/media/download/example.com/"):
+			mediaID := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v1/media/download/example.com/")
+			if data, ok := f.media[mediaID]; ok {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, _ = w.Write(data)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("media:" + mediaID))
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v1/media/thumbnail/example.com/"):
+			w.Header().Set("Content-Type", "image/jpeg")
+			_, _ = w.Write([]byte("thumbnail"))
+		case strings.Contains(r.URL.Path, "/send/m.room.message/"):
+			var content map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&content))
+			f.events = append(f.events, content)
+			fmt.Fprintf(w, `{"event_id":"$event%d"}`, len(f.events))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}
+}
+
+func newMediaTestService(t *testing.T, homeserverURL string) *MessageService {
+	t.Helper()
+	mc, err := matrix.NewClient(matrix.Config{
+		HomeserverURL: homeserverURL,
+		AsUserID:      "@proxy:example.com",
+		AsToken:       "test_token",
+	})
+	require.NoError(t, err)
+	return NewMessageService(mc, nil, NewTestConfig())
+}
+
+func TestSendFileTransfer(t *testing.T) {
+	secretKey := []byte("0123456789abcdef")
+	files := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/secret.txt":
+			data := []byte("top secret")
+			require.NoError(t, xorAcrobitsCTR(data, secretKey))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(data)
+		case "/files/photo.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			_, _ = w.Write([]byte("fake-jpeg-data"))
+		case "/files/report":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write([]byte("%PDF-1.4 fake"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer files.Close()
+
+	hs := &fakeHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+	// The test file storage is on the loopback address, refused by the default client
+	svc.mediaHTTPClient = files.Client()
+
+	t.Run("text and attachments", func(t *testing.T) {
+		ft := models.FileTransferMessage{
+			Body: "look at this",
+			Attachments: []models.Attachment{
+				{
+					ContentType: "image/jpeg",
+					ContentURL:  files.URL + "/files/photo.jpg",
+					Filename:    "photo.jpg",
+					Preview: &models.AttachmentPreview{
+						ContentType: "image/jpeg",
+						Content:     base64.StdEncoding.EncodeToString([]byte("thumb")),
+					},
+				},
+				{
+					ContentURL: files.URL + "/files/report",
+					Filename:   "report.pdf",
+				},
+			},
+		}
+		body, err := json.Marshal(ft)
+		require.NoError(t, err)
+
+		eventID, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", string(body), "")
+		require.NoError(t, err)
+		assert.Equal(t, id.EventID("$event1"), eventID)
+
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		require.Len(t, hs.events, 3)
+		assert.Equal(t, "m.text", hs.events[0]["msgtype"])
+		assert.Equal(t, "look at this", hs.events[0]["body"])
+
+		assert.Equal(t, "m.image", hs.events[1]["msgtype"])
+		assert.Equal(t, "photo.jpg", hs.events[1]["filename"])
+		assert.Equal(t, "mxc://example.com/media1", hs.events[1]["url"])
+		info := hs.events[1]["info"].(map[string]interface{})
+		assert.Equal(t, "image/jpeg", info["mimetype"])
+		assert.EqualValues(t, len("fake-jpeg-data"), info["size"])
+		assert.Equal(t, "mxc://example.com/media2", info["thumbnail_url"])
+
+		assert.Equal(t, "m.file", hs.events[2]["msgtype"])
+		fileInfo := hs.events[2]["info"].(map[string]interface{})
+		assert.Equal(t, "application/pdf", fileInfo["mimetype"])
+	})
+
+	t.Run("encrypted attachment", func(t *testing.T) {
+		hs.mu.Lock()
+		hs.events, hs.uploads, hs.data = nil, nil, nil
+		hs.mu.Unlock()
+
+		body := fmt.Sprintf(`{"attachments":[{"content-url":"%s/files/secret.txt","filename":"secret.txt","encryption-key":"%s","hash":"%s"}]}`,
+			files.URL, hex.EncodeToString(secretKey), acrobitsHash([]byte("top secret")))
+		_, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", body, "")
+		require.NoError(t, err)
+
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		require.Len(t, hs.events, 1)
+		assert.Equal(t, "m.file", hs.events[0]["msgtype"])
+		assert.NotContains(t, hs.events[0], "url")
+		info := hs.events[0]["info"].(map[string]interface{})
+		assert.Equal(t, "text/plain", info["mimetype"])
+
+		raw, err := json.Marshal(hs.events[0]["file"])
+		require.NoError(t, err)
+		var file event.EncryptedFileInfo
+		require.NoError(t, json.Unmarshal(raw, &file))
+		assert.Equal(t, id.ContentURIString("mxc://example.com/media1"), file.URL)
+
+		require.Len(t, hs.data, 1)
+		assert.Equal(t, "application/octet-stream", hs.uploads[0])
+		assert.NotEqual(t, "top secret", string(hs.data[0]))
+		plaintext, err := file.Decrypt(hs.data[0])
+		require.NoError(t, err)
+		assert.Equal(t, "top secret", string(plaintext))
+	})
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		hs.mu.Lock()
+		hs.events, hs.uploads, hs.data = nil, nil, nil
+		hs.mu.Unlock()
+
+		body := fmt.Sprintf(`{"attachments":[{"content-url":"%s/files/secret.txt","filename":"secret.txt","encryption-key":"%s","hash":"%s"}]}`,
+			files.URL, hex.EncodeToString(secretKey), acrobitsHash([]byte("something else")))
+		_, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", body, "")
+		assert.ErrorIs(t, err, ErrInvalidAttachment)
+
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		assert.Empty(t, hs.events)
+		assert.Empty(t, hs.data)
+	})
+
+	t.Run("invalid encryption key", func(t *testing.T) {
+		body := fmt.Sprintf(`{"attachments":[{"content-url":"%s/files/secret.txt","encryption-key":"zz"}]}`, files.URL)
+		_, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", body, "")
+		assert.ErrorIs(t, err, ErrInvalidAttachment)
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		_, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", "not json", "")
+		assert.ErrorIs(t, err, ErrInvalidAttachment)
+	})
+
+	t.Run("no attachments", func(t *testing.T) {
+		_, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", `{"body":"hi","attachments":[]}`, "")
+		assert.ErrorIs(t, err, ErrInvalidAttachment)
+	})
+
+	t.Run("download failure", func(t *testing.T) {
+		body := fmt.Sprintf(`{"attachments":[{"content-url":"%s/files/missing"}]}`, files.URL)
+		_, err := svc.sendFileTransfer(context.Background(), "@alice:example.com", "!room:example.com", body, "")
+		assert.Error(t, err)
+	})
+}
+
+func TestSMSContent(t *testing.T) {
+	hs := &fakeHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+
+	t.Run("text message", func(t *testing.T) {
+		evt := &event.Event{ID: "$text", Content: event.Content{Raw: map[string]interface{}{"msgtype": "m.text", "body": "hello"}}}
+		body, contentType := svc.smsContent(context.Background(), evt)
+		assert.Equal(t, "hello", body)
+		assert.Equal(t, "text/plain", contentType)
+	})
+
+	t.Run("image with generated preview", func(t *testing.T) {
+		raw := `{"msgtype":"m.image","body":"nice view","filename":"view.png","url":"mxc://example.com/img1","info":{"mimetype":"image/png","size":1234}}`
+		evt := &event.Event{ID: "$img", Content: event.Content{VeryRaw: json.RawMessage(raw)}}
+		body, contentType := svc.smsContent(context.Background(), evt)
+		assert.Equal(t, models.FileTransferContentType, contentType)
+
+		var ft models.FileTransferMessage
+		require.NoError(t, json.Unmarshal([]byte(body), &ft))
+		assert.Equal(t, "nice view", ft.Body)
+		require.Len(t, ft.Attachments, 1)
+		att := ft.Attachments[0]
+		assert.Equal(t, "view.png", att.Filename)
+		assert.Equal(t, "image/png", att.ContentType)
+		assert.EqualValues(t, 1234, att.ContentSize)
+		assert.Equal(t, svc.mediaURL(id.ContentURI{Homeserver: "example.com", FileID: "img1"}, ""), att.ContentURL)
+		assert.True(t, strings.HasPrefix(att.ContentURL, fmt.Sprintf("https://example.com/api/client/media/example.com/img1?exp=%d&sig=", now.Add(7*24*time.Hour).Unix())))
+		require.NotNil(t, att.Preview)
+		assert.Equal(t, "image/jpeg", att.Preview.ContentType)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("thumbnail")), att.Preview.Content)
+	})
+
+	t.Run("file without preview", func(t *testing.T) {
+		raw := `{"msgtype":"m.file","body":"report.pdf","url":"mxc://example.com/doc1","info":{"mimetype":"application/pdf"}}`
+		evt := &event.Event{ID: "$file", Content: event.Content{VeryRaw: json.RawMessage(raw)}}
+		body, contentType := svc.smsContent(context.Background(), evt)
+		assert.Equal(t, models.FileTransferContentType, contentType)
+
+		var ft models.FileTransferMessage
+		require.NoError(t, json.Unmarshal([]byte(body), &ft))
+		assert.Empty(t, ft.Body)
+		require.Len(t, ft.Attachments, 1)
+		assert.Equal(t, "report.pdf", ft.Attachments[0].Filename)
+		assert.Nil(t, ft.Attachments[0].Preview)
+	})
+}
+
+func TestDownloadMedia(t *testing.T) {
+	hs := &fakeHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+	uri := id.ContentURI{Homeserver: "example.com", FileID: "abc"}
+	exp := time.Now().Add(time.Hour).Unix()
+	expParam := strconv.FormatInt(exp, 10)
+
+	t.Run("valid signature", func(t *testing.T) {
+		resp, err := svc.DownloadMedia(context.Background(), "example.com", "abc", svc.signMedia(uri, exp), expParam, "")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "media:abc", string(data))
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		_, err := svc.DownloadMedia(context.Background(), "example.com", "abc", "deadbeef", expParam, "")
+		assert.ErrorIs(t, err, ErrInvalidMediaSignature)
+	})
+
+	t.Run("signature for another file", func(t *testing.T) {
+		other := id.ContentURI{Homeserver: "example.com", FileID: "other"}
+		_, err := svc.DownloadMedia(context.Background(), "example.com", "abc", svc.signMedia(other, exp), expParam, "")
+		assert.ErrorIs(t, err, ErrInvalidMediaSignature)
+	})
+
+	t.Run("extended expiry", func(t *testing.T) {
+		later := strconv.FormatInt(exp+3600, 10)
+		_, err := svc.DownloadMedia(context.Background(), "example.com", "abc", svc.signMedia(uri, exp), later, "")
+		assert.ErrorIs(t, err, ErrInvalidMediaSignature)
+		_, err = svc.DownloadMedia(context.Background(), "example.com", "abc", svc.signMedia(uri, exp), "", "")
+		assert.ErrorIs(t, err, ErrInvalidMediaSignature)
+	})
+
+	t.Run("expired link", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute).Unix()
+		_, err := svc.DownloadMedia(context.Background(), "example.com", "abc", svc.signMedia(uri, past), strconv.FormatInt(past, 10), "")
+		assert.ErrorIs(t, err, ErrMediaLinkExpired)
+	})
+}
+
+func TestDeriveMediaSigningKey(t *testing.T) {
+	cfg := NewTestConfig()
+	derived := deriveMediaSigningKey(cfg)
+	assert.Len(t, derived, 32)
+	assert.NotEqual(t, []byte(cfg.MatrixAsToken), derived)
+
+	cfg.MediaSigningKey = "dedicated"
+	assert.NotEqual(t, derived, deriveMediaSigningKey(cfg))
+}
+
+func TestEncryptedMediaRoundTrip(t *testing.T) {
+	file := attachment.NewEncryptedFile()
+	ciphertext := []byte("encrypted photo")
+	file.EncryptInPlace(ciphertext)
+
+	hs := &fakeHomeserver{media: map[string][]byte{"enc1": ciphertext}}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	fileJSON, err := json.Marshal(event.EncryptedFileInfo{EncryptedFile: *file, URL: "mxc://example.com/enc1"})
+	require.NoError(t, err)
+	raw := fmt.Sprintf(`{"msgtype":"m.image","body":"photo.jpg","file":%s,"info":{"mimetype":"image/jpeg","size":15}}`, fileJSON)
+	evt := &event.Event{ID: "$enc", Content: event.Content{VeryRaw: json.RawMessage(raw)}}
+
+	body, contentType := svc.smsContent(context.Background(), evt)
+	assert.Equal(t, models.FileTransferContentType, contentType)
+
+	var ft models.FileTransferMessage
+	require.NoError(t, json.Unmarshal([]byte(body), &ft))
+	require.Len(t, ft.Attachments, 1)
+	att := ft.Attachments[0]
+	assert.Nil(t, att.Preview)
+	key, err := parseAcrobitsKey(att.EncryptionKey)
+	require.NoError(t, err)
+	assert.Len(t, key, acrobitsKeySize)
+
+	link, err := url.Parse(att.ContentURL)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/client/media/example.com/enc1", link.Path)
+	assert.NotContains(t, att.ContentURL, file.Key.Key)
+
+	t.Run("download", func(t *testing.T) {
+		resp, err := svc.DownloadMedia(context.Background(), "example.com", "enc1", link.Query().Get("sig"), link.Query().Get("exp"), link.Query().Get("key"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, xorAcrobitsCTR(data, key))
+		assert.Equal(t, "encrypted photo", string(data))
+	})
+
+	t.Run("key bound to another file", func(t *testing.T) {
+		other := id.ContentURI{Homeserver: "example.com", FileID: "other"}
+		exp := time.Now().Add(time.Hour).Unix()
+		_, err := svc.DownloadMedia(context.Background(), "example.com", "other", svc.signMedia(other, exp), strconv.FormatInt(exp, 10), link.Query().Get("key"))
+		assert.ErrorIs(t, err, ErrInvalidMediaSignature)
+	})
+
+	t.Run("tampered file", func(t *testing.T) {
+		hs.mu.Lock()
+		hs.media["enc1"] = []byte("tampered data!!")
+		hs.mu.Unlock()
+		_, err := svc.DownloadMedia(context.Background(), "example.com", "enc1", link.Query().Get("sig"), link.Query().Get("exp"), link.Query().Get("key"))
+		assert.Error(t, err)
+	})
+}
+
+func TestMsgTypeForMime(t *testing.T) {
+	assert.Equal(t, event.MsgImage, msgTypeForMime("image/png"))
+	assert.Equal(t, event.MsgVideo, msgTypeForMime("video/mp4"))
+	assert.Equal(t, event.MsgAudio, msgTypeForMime("audio/ogg"))
+	assert.Equal(t, event.MsgFile, msgTypeForMime("application/pdf"))
+}
+
+func TestAttachmentMimeType(t *testing.T) {
+	assert.Equal(t, "image/png", attachmentMimeType("image/png", "application/octet-stream", "x.bin", nil))
+	assert.Equal(t, "video/mp4", attachmentMimeType("", "video/mp4; codecs=avc1", "x.bin", nil))
+	assert.Equal(t, "application/pdf", attachmentMimeType("", "application/octet-stream", "doc.pdf", nil))
+	assert.Equal(t, "text/plain; charset=utf-8", attachmentMimeType("", "", "noext", []byte("hello")))
+}
+
+func TestAttachmentFileName(t *testing.T) {
+	assert.Equal(t, "a.jpg", attachmentFileName(&models.Attachment{Filename: "a.jpg", ContentURL: "https://x/b.jpg"}))
+	assert.Equal(t, "b.jpg", attachmentFileName(&models.Attachment{ContentURL: "https://x/files/b.jpg?sig=1"}))
+	assert.Equal(t, "attachment", attachmentFileName(&models.Attachment{ContentURL: ""}))
+}
+
+func TestDownloadAttachment_AddressNotAllowed(t *testing.T) {
+	var requests atomic.Int32
+	files := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = w.Write([]byte("internal"))
+	}))
+	defer files.Close()
+
+	svc := NewMessageService(nil, nil, NewTestConfig())
+	for _, contentURL := range []string{
+		files.URL + "/files/a.txt",
+		"http://files.example.com/a.txt",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[::1]/a.txt",
+	} {
+		_, _, err := svc.downloadAttachment(context.Background(), contentURL)
+		assert.ErrorIs(t, err, ErrInvalidAttachment, contentURL)
+	}
+	assert.Zero(t, requests.Load())
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		allowed bool
+	}{
+		{"public IPv4", "93.184.216.34:443", true},
+		{"public IPv6", "[2606:2800:220:1::1]:443", true},
+		{"private", "10.0.0.1:443", false},
+		{"private 192.168", "192.168.1.10:443", false},
+		{"loopback", "127.0.0.1:443", false},
+		{"unspecified", "0.0.0.0:443", false},
+		{"this network", "0.1.2.3:443", false},
+		{"CGNAT", "100.64.0.1:443", false},
+		{"CGNAT end", "100.127.255.254:443", false},
+		{"IETF protocol assignments", "192.0.0.8:443", false},
+		{"documentation", "192.0.2.1:443", false},
+		{"benchmarking", "198.18.0.1:443", false},
+		{"benchmarking end", "198.19.255.254:443", false},
+		{"reserved", "240.0.0.1:443", false},
+		{"broadcast", "255.255.255.255:443", false},
+		{"multicast", "224.0.0.1:443", false},
+		{"IPv4-mapped private", "[::ffff:10.0.0.1]:443", false},
+		{"NAT64", "[64:ff9b::a00:1]:443", false},
+		{"6to4", "[2002:a00:1::1]:443", false},
+		{"Teredo", "[2001::1]:443", false},
+		{"IPv6 documentation", "[2001:db8::1]:443", false},
+		{"unique local", "[fd00::1]:443", false},
+		{"link-local", "[fe80::1]:443", false},
+		{"IPv6 loopback", "[::1]:443", false},
+		{"host name", "files.example.com:443", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := publicAddressOnly("tcp", tc.address, nil)
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, errAttachmentAddress)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,6 +25,9 @@ var (
 	ErrInvalidRecipient = errors.New("recipient is not resolvable to a Matrix user or room")
 	ErrMappingNotFound  = errors.New("mapping not found")
 	ErrInvalidSender    = errors.New("sender is not resolvable to a Matrix user")
+	// ErrPushTokenOwnership is returned when a user reports or removes the push token of another user's selector,
+	// or reports a device token of another user
+	ErrPushTokenOwnership = errors.New("push token belongs to another user")
 )
 
 // MessageService handles sending/fetching messages plus the mapping store.
@@ -31,22 +36,40 @@ type MessageService struct {
 	pushTokenDB  *db.Database
 	now          func() time.Time
 	proxyURL     string // Public-facing URL of this proxy (e.g., https://matrix.example.com)
+	// Secret used to sign the push gateway URL of the pushers registered on the homeserver
+	pushGatewaySecret string
 	// External auth configuration
 	extAuthURL     string
 	extAuthTimeout time.Duration
 	authClient     *HTTPAuthClient
+	// Service account reading the directory, see directoryUser
+	directoryAccount  string
+	directoryPassword string
+	// HTTP client used to download attachments from the Acrobits file storage
+	mediaHTTPClient *http.Client
+	// Media proxy configuration: public base URL, key used to sign download links and their validity
+	mediaPublicURL  string
+	mediaSigningKey []byte
+	mediaLinkTTL    time.Duration
 	// Homeserver host used to build Matrix IDs from auth response
 	homeserverHost string
 
 	mu                sync.RWMutex
 	mappings          map[string]mappingEntry
 	subNumberMappings map[int]string    // subNumber -> MatrixID
-	batchTokens       map[string]string // userID -> next_batch token
+	batchTokens       map[string]string // userID|device -> next_batch token, used when no database is configured
+	// Sync tokens older than syncTokenMaxAge are pruned from the database, at most once per syncTokenPruneInterval
+	syncTokenMaxAge time.Duration
+	lastSyncPrune   time.Time
+	lastTxnPrune    time.Time
+	// Serializes the pusher reconciliations, see ReconcilePushers
+	reconcileMu sync.Mutex
 
 	// Caches for room resolution
 	roomAliasCache       *RoomAliasCache
 	roomAliasesCache     *RoomAliasesCache
 	roomParticipantCache *RoomParticipantCache
+	roomGroupCache       *RoomGroupCache
 }
 
 type mappingEntry struct {
@@ -67,22 +90,60 @@ func NewMessageService(matrixClient *matrix.MatrixClient, pushTokenDB *db.Databa
 		logger.Warn().Msg("EXT_AUTH_URL not set!")
 	}
 
-	return &MessageService{
+	s := &MessageService{
 		matrixClient:         matrixClient,
 		pushTokenDB:          pushTokenDB,
 		now:                  time.Now,
 		proxyURL:             cfg.ProxyURL,
+		pushGatewaySecret:    cfg.PushGatewaySecret,
 		mappings:             make(map[string]mappingEntry),
 		subNumberMappings:    make(map[int]string),
 		batchTokens:          make(map[string]string),
 		roomAliasCache:       NewRoomAliasCache(cfg.CacheTTL),
 		roomAliasesCache:     NewRoomAliasesCache(cfg.CacheTTL),
 		roomParticipantCache: NewRoomParticipantCache(cfg.CacheTTL),
+		roomGroupCache:       NewRoomGroupCache(cfg.CacheTTL),
 		extAuthURL:           cfg.ExtAuthURL,
 		extAuthTimeout:       cfg.ExtAuthTimeout,
 		authClient:           NewHTTPAuthClient(cfg.ExtAuthURL, cfg.ExtAuthTimeout, cfg.CacheTTL),
+		directoryAccount:     cfg.ExtAuthDirectoryUser,
+		directoryPassword:    cfg.ExtAuthDirectoryPassword,
+		mediaHTTPClient:      newMediaHTTPClient(),
+		mediaPublicURL:       cfg.MediaPublicURL,
+		mediaSigningKey:      deriveMediaSigningKey(cfg),
+		mediaLinkTTL:         cfg.MediaLinkTTL,
 		homeserverHost:       cfg.MatrixHomeserverHost,
+		syncTokenMaxAge:      cfg.SyncTokenMaxAge,
 	}
+	s.loadMappings()
+	s.pruneSyncTokens()
+	return s
+}
+
+// loadMappings fills the mapping store with the mappings persisted in the database.
+func (s *MessageService) loadMappings() {
+	if s.pushTokenDB == nil {
+		return
+	}
+	stored, err := s.pushTokenDB.ListMappings()
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to load mappings from database")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Mappings are listed least recently updated first, so newer entries win on shared usernames
+	for _, m := range stored {
+		s.storeMappingLocked(mappingEntry{
+			Number:     m.Number,
+			MatrixID:   m.MatrixID,
+			UserName:   m.UserName,
+			SubNumbers: m.SubNumbers,
+			UpdatedAt:  m.UpdatedAt,
+		})
+	}
+	logger.Info().Int("count", len(stored)).Msg("mappings loaded from database")
 }
 
 // authenticateAndPersistMappings validates credentials with the external auth service
@@ -99,18 +160,18 @@ func (s *MessageService) authenticateAndPersistMappings(ctx context.Context, use
 		return fmt.Errorf("external auth request failed: %w", err)
 	}
 
-	// Persist all mappings returned by auth
-	for _, mapReq := range mappings {
-		if _, err := s.SaveMapping(mapReq); err != nil {
-			logger.Error().Err(err).Msg("failed to save mapping from external auth response")
-			return fmt.Errorf("failed to save mapping: %w", err)
-		}
+	// Persist the mappings returned by auth
+	if err := s.saveDirectoryMappings(mappings); err != nil {
+		logger.Error().Err(err).Msg("failed to save mappings from external auth response")
+		return err
 	}
 	return nil
 }
 
 // SendMessage translates an Acrobits send_message request into Matrix /send.
-// Only 1-to-1 direct messaging is supported.
+// The recipient can be a user, which gets a direct room with the sender, or a room ID, room alias
+// or stream_id of a group room.
+// Messages with content type application/x-acro-filetransfer+json are sent as Matrix media events.
 // Both sender and recipient are resolved to Matrix user IDs using local mappings if necessary.
 func (s *MessageService) SendMessage(ctx context.Context, req *models.SendMessageRequest) (*models.SendMessageResponse, error) {
 	// Debug full request
@@ -138,33 +199,53 @@ func (s *MessageService) SendMessage(ctx context.Context, req *models.SendMessag
 		return nil, ErrAuthentication
 	}
 
-	// Try to resolve as Matrix user ID or mapping
-	recipientMatrix := s.resolveMatrixUser(req.To)
-	if recipientMatrix == "" {
-		logger.Warn().Str("recipient", req.To).Msg("recipient is not a valid Matrix user ID or room ID")
-		return nil, ErrInvalidRecipient
-	}
+	var roomID id.RoomID
+	var err error
+	if isRoomTarget(req.To) {
+		// Group messaging: post into the given room
+		roomID, err = s.resolveRoomTarget(ctx, req.To)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Msg("sending message to room")
+		if err := s.joinTargetRoom(ctx, senderMatrix, roomID); err != nil {
+			logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to join room")
+			return nil, err
+		}
+	} else {
+		// Try to resolve as Matrix user ID or mapping
+		recipientMatrix := s.resolveMatrixUser(req.To)
+		if recipientMatrix == "" {
+			logger.Warn().Str("recipient", req.To).Msg("recipient is not a valid Matrix user ID or room ID")
+			return nil, ErrInvalidRecipient
+		}
 
-	logger.Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Msg("resolved sender and recipient to Matrix user IDs")
+		logger.Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Msg("resolved sender and recipient to Matrix user IDs")
 
-	// For 1-to-1 messaging, ensure a direct room exists between sender and recipient
-	var err error
-	roomID, err := s.ensureDirectRoom(ctx, senderMatrix, recipientMatrix)
-	if err != nil {
-		logger.Error().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Err(err).Msg("failed to ensure direct room")
-		return nil, err
-	}
+		// For 1-to-1 messaging, ensure a direct room exists between sender and recipient
+		roomID, err = s.ensureDirectRoom(ctx, senderMatrix, recipientMatrix)
+		if err != nil {
+			logger.Error().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Err(err).Msg("failed to ensure direct room")
+			return nil, err
+		}
 
-	if recipientMatrix != "" {
 		logger.Debug().Str("sender", string(senderMatrix)).Str("recipient", string(recipientMatrix)).Str("room_id", string(roomID)).Msg("sending message to direct room")
-	} else {
-		logger.Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Msg("sending message to room")
+		// Ensure the sender is a member of the room (in case join failed during room creation)
+		_, err = s.matrixClient.JoinRoom(ctx, senderMatrix, roomID)
+		if err != nil {
+			logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to join room")
+			return nil, fmt.Errorf("send message: %w", err)
+		}
 	}
-	// Ensure the sender is a member of the room (in case join failed during room creation)
-	_, err = s.matrixClient.JoinRoom(ctx, senderMatrix, roomID)
-	if err != nil {
-		logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to join room")
-		return nil, fmt.Errorf("send message: %w", err)
+
+	if req.ContentType == models.FileTransferContentType {
+		eventID, err := s.sendFileTransfer(ctx, senderMatrix, roomID, req.Body, req.DispositionNotification)
+		if err != nil {
+			logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to send file transfer message")
+			return nil, err
+		}
+		logger.Debug().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Msg("file transfer message sent successfully")
+		return &models.SendMessageResponse{ID: string(eventID)}, nil
 	}
 
 	content := &event.MessageEventContent{
@@ -172,7 +253,7 @@ func (s *MessageService) SendMessage(ctx context.Context, req *models.SendMessag
 		Body:    req.Body,
 	}
 
-	resp, err := s.matrixClient.SendMessage(ctx, senderMatrix, roomID, content)
+	resp, err := s.matrixClient.SendMessage(ctx, senderMatrix, roomID, withDispositionNotification(content, req.DispositionNotification))
 	if err != nil {
 		logger.Error().Str("sender", string(senderMatrix)).Str("room_id", string(roomID)).Err(err).Msg("failed to send message")
 		return nil, fmt.Errorf("send message: %w", mapAuthErr(err))
@@ -222,16 +303,18 @@ func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMes
 
 	logger.Debug().Str("user_id", string(userID)).Msg("syncing messages from matrix")
 
-	// Retrieve the last batch token for this user
-	batchToken := s.getBatchToken(string(userID))
-	logger.Debug().Str("user_id", string(userID)).Str("batch_token", batchToken).Msg("using batch token for incremental sync")
+	// Retrieve the sync cursor of this device
+	device := strings.TrimSpace(req.Device)
+	batchToken := s.getBatchToken(string(userID), device)
+	logger.Debug().Str("user_id", string(userID)).Str("device", device).Str("batch_token", batchToken).Msg("using batch token for incremental sync")
 
 	resp, err := s.matrixClient.Sync(ctx, userID, batchToken)
-	if err != nil {
+	if err != nil && batchToken != "" {
 		// If the token is invalid (e.g. expired or from a different session), retry with a full sync.
 		if strings.Contains(err.Error(), "Invalid stream token") || strings.Contains(err.Error(), "M_UNKNOWN") {
 			logger.Warn().Err(err).Msg("invalid stream token, retrying with full sync")
-			s.clearBatchToken(string(userID))
+			s.clearBatchToken(string(userID), device)
+			batchToken = ""
 			resp, err = s.matrixClient.Sync(ctx, userID, "")
 		}
 	}
@@ -240,10 +323,24 @@ func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMes
 		return nil, fmt.Errorf("sync messages: %w", mapAuthErr(err))
 	}
 
+	// Without a cursor, the device gets the messages after the last ones it reported to have
+	var markers *deliveryMarkers
+	if batchToken == "" {
+		markers = &deliveryMarkers{
+			lastID:     id.EventID(strings.TrimSpace(req.LastID)),
+			lastSentID: id.EventID(strings.TrimSpace(req.LastSentID)),
+		}
+		if markers.empty() {
+			markers = nil
+		} else {
+			s.rebuildFromHistory(ctx, userID, resp, markers)
+		}
+	}
+
 	// Store the next_batch token for subsequent calls
 	if resp.NextBatch != "" {
-		s.setBatchToken(string(userID), resp.NextBatch)
-		logger.Debug().Str("user_id", string(userID)).Str("next_batch", resp.NextBatch).Msg("stored next batch token")
+		s.setBatchToken(string(userID), device, resp.NextBatch)
+		logger.Debug().Str("user_id", string(userID)).Str("device", device).Str("next_batch", resp.NextBatch).Msg("stored next batch token")
 	}
 
 	received, sent := make([]models.SMS, 0, 8), make([]models.SMS, 0, 8)
@@ -252,10 +349,19 @@ func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMes
 	callerIdentifier := s.resolveMatrixIDToIdentifier(string(userID))
 
 	for roomID, room := range resp.Rooms.Join {
-		for _, evt := range room.Timeline.Events {
+		var conv *conversation
+		readReceipts := parseReceipts(room.Ephemeral.Events)
+		// The messages read since the previous sync come first, they are older than the timeline
+		events := append(s.lateReadEvents(ctx, userID, roomID, room.Timeline.Events, readReceipts, batchToken != ""), room.Timeline.Events...)
+		receipts := collectReceipts(events, readReceipts)
+		for pos, evt := range events {
 			if evt.Type != event.EventMessage {
 				continue
 			}
+			if conv == nil {
+				c := s.resolveConversation(ctx, roomID, userID)
+				conv = &c
+			}
 
 			eventRoomID := evt.RoomID
 			if eventRoomID == "" {
@@ -264,34 +370,46 @@ func (s *MessageService) FetchMessages(ctx context.Context, req *models.FetchMes
 
 			logger.Debug().Str("event_id", string(evt.ID)).Str("room_id", string(eventRoomID)).Msg("processing message event")
 
-			body := ""
-			if b, ok := evt.Content.Raw["body"].(string); ok {
-				body = b
-			}
+			body, contentType := s.smsContent(ctx, evt)
 			sms := models.SMS{
-				SMSID:       string(evt.ID),
-				SendingDate: time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
-				SMSText:     body,
-				ContentType: "text/plain",
-				StreamID:    string(roomID),
+				SMSID:                   string(evt.ID),
+				SendingDate:             time.UnixMilli(evt.Timestamp).UTC().Format(time.RFC3339),
+				SMSText:                 body,
+				ContentType:             contentType,
+				StreamID:                string(roomID),
+				DispositionNotification: dispositionNotification(evt),
+			}
+			if conv.group {
+				sms.StreamName = conv.name
+				sms.Participants = conv.participants
 			}
 
 			// Determine if I sent the message
 			senderMatrixID := string(evt.Sender)
 			isSent := isSentBy(senderMatrixID, string(userID))
+			if !markers.isNew(evt, isSent) {
+				continue
+			}
 
 			// Remap sender to identifier (e.g. "202" or "91201")
 			sms.Sender = string(s.resolveMatrixIDToIdentifier(senderMatrixID))
 
 			// Determine Recipient
 			if isSent {
-				// I sent it. Recipient is the other person in the room.
-				other := s.resolveRoomIDToOtherIdentifier(ctx, eventRoomID, string(userID))
-				sms.Recipient = other
+				// I sent it. Recipient is the other person in the room, or the group itself.
+				if conv.group {
+					sms.Recipient = string(roomID)
+				} else {
+					sms.Recipient = conv.other
+				}
+				// Displayed once any recipient has read it
+				sms.Displayed = receipts.readByOthers(userID, pos)
 				sent = append(sent, sms)
 			} else {
 				// I received it. Recipient is me.
 				sms.Recipient = callerIdentifier
+				// Displayed if I have already read it, possibly from another Matrix client
+				sms.Displayed = receipts.readBy(userID, pos)
 				received = append(received, sms)
 			}
 			// Debug each processed message
@@ -496,7 +614,11 @@ func (s *MessageService) ensureDirectRoom(ctx context.Context, actingUserID, tar
 		return id.RoomID(roomID), nil
 	}
 
-	// Create a new direct room with the alias
+	return s.createDirectRoom(ctx, actingUserID, targetUserID, key)
+}
+
+// createDirectRoom creates the direct room between two users with the given alias key and joins the target user.
+func (s *MessageService) createDirectRoom(ctx context.Context, actingUserID, targetUserID id.UserID, key string) (id.RoomID, error) {
 	logger.Info().Str("acting_user", string(actingUserID)).Str("target_user", string(targetUserID)).Msg("creating new direct room")
 	resp, err := s.matrixClient.CreateDirectRoom(ctx, actingUserID, targetUserID, key)
 	if err != nil {
@@ -562,16 +684,47 @@ func (s *MessageService) ListMappings() ([]*models.MappingResponse, error) {
 	return out, nil
 }
 
-// SaveMapping persists a new mapping via the admin API.
+// SaveMapping persists a new mapping via the admin API, storing it in the database when one is configured.
 // For 1-to-1 messaging, this maps a key (phone number or identifier) to a direct room.
 func (s *MessageService) SaveMapping(req *models.MappingRequest) (*models.MappingResponse, error) {
+	entry, err := s.newMappingEntry(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pushTokenDB != nil {
+		if err := s.pushTokenDB.SaveMapping(&db.Mapping{
+			Number:     entry.Number,
+			MatrixID:   entry.MatrixID,
+			UserName:   entry.UserName,
+			SubNumbers: entry.SubNumbers,
+			UpdatedAt:  entry.UpdatedAt,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	s.storeMappingLocked(entry)
+
+	logger.Debug().
+		Str("username", entry.UserName).
+		Int("number", entry.Number).
+		Interface("sub_numbers", entry.SubNumbers).
+		Msg("mapping stored")
+	return s.buildMappingResponse(entry), nil
+}
+
+// newMappingEntry validates a mapping request and builds the mapping to store.
+func (s *MessageService) newMappingEntry(req *models.MappingRequest) (mappingEntry, error) {
 	if req.Number == 0 {
-		return nil, errors.New("number is required")
+		return mappingEntry{}, errors.New("number is required")
 	}
 
 	matrixID := strings.TrimSpace(req.MatrixID)
 	if matrixID == "" {
-		return nil, errors.New("matrix_id is required")
+		return mappingEntry{}, errors.New("matrix_id is required")
 	}
 
 	// Determine a sensible "username" from the provided Matrix identifier.
@@ -579,46 +732,100 @@ func (s *MessageService) SaveMapping(req *models.MappingRequest) (*models.Mappin
 	// For room IDs (starting with '!') we store the RoomID and leave UserName empty.
 	userName := normalizeLocalpart(matrixID)
 
-	entry := mappingEntry{
+	return mappingEntry{
 		Number:     req.Number,
-		MatrixID:   strings.TrimSpace(req.MatrixID),
+		MatrixID:   matrixID,
 		UserName:   userName,
 		SubNumbers: req.SubNumbers,
 		UpdatedAt:  s.now(),
+	}, nil
+}
+
+// saveDirectoryMappings stores the mappings read from the external directory. The directory is returned at each
+// authentication, so the mappings already stored unchanged are skipped and the others are saved in one transaction.
+func (s *MessageService) saveDirectoryMappings(reqs []*models.MappingRequest) error {
+	changed := make([]mappingEntry, 0, len(reqs))
+	s.mu.RLock()
+	for _, req := range reqs {
+		entry, err := s.newMappingEntry(req)
+		if err != nil {
+			s.mu.RUnlock()
+			return fmt.Errorf("failed to save mapping: %w", err)
+		}
+		if !s.mappingStoredLocked(entry) {
+			changed = append(changed, entry)
+		}
+	}
+	s.mu.RUnlock()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if s.pushTokenDB != nil {
+		stored := make([]*db.Mapping, 0, len(changed))
+		for _, entry := range changed {
+			stored = append(stored, &db.Mapping{
+				Number:     entry.Number,
+				MatrixID:   entry.MatrixID,
+				UserName:   entry.UserName,
+				SubNumbers: entry.SubNumbers,
+				UpdatedAt:  entry.UpdatedAt,
+			})
+		}
+		if err := s.pushTokenDB.SaveMappings(stored); err != nil {
+			return fmt.Errorf("failed to save mappings: %w", err)
+		}
 	}
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	for _, entry := range changed {
+		s.storeMappingLocked(entry)
+	}
+	s.mu.Unlock()
+	logger.Debug().Int("changed", len(changed)).Int("total", len(reqs)).Msg("directory mappings stored")
+	return nil
+}
 
-	numberKey := fmt.Sprintf("%d", req.Number)
+// mappingStoredLocked reports whether entry is already stored and indexed unchanged. The caller must hold s.mu.
+func (s *MessageService) mappingStoredLocked(entry mappingEntry) bool {
+	for _, key := range []string{fmt.Sprintf("%d", entry.Number), entry.UserName} {
+		stored, ok := s.mappings[key]
+		if !ok || stored.Number != entry.Number || stored.MatrixID != entry.MatrixID || stored.UserName != entry.UserName ||
+			!slices.Equal(stored.SubNumbers, entry.SubNumbers) {
+			return false
+		}
+	}
+	for _, sub := range entry.SubNumbers {
+		if s.subNumberMappings[sub] != entry.MatrixID {
+			return false
+		}
+	}
+	return true
+}
+
+// storeMappingLocked indexes a mapping by number, username and sub-numbers. The caller must hold s.mu.
+func (s *MessageService) storeMappingLocked(entry mappingEntry) {
+	numberKey := fmt.Sprintf("%d", entry.Number)
 	// Clean up old sub-number mappings if updating an existing entry
 	if oldEntry, exists := s.mappings[numberKey]; exists {
 		for _, sub := range oldEntry.SubNumbers {
 			delete(s.subNumberMappings, sub)
 		}
 	}
-	if oldEntry, exists := s.mappings[userName]; exists {
+	if oldEntry, exists := s.mappings[entry.UserName]; exists {
 		for _, sub := range oldEntry.SubNumbers {
 			delete(s.subNumberMappings, sub)
 		}
 	}
 
-	entry.UpdatedAt = s.now()
 	// Double map: by number and by username
 	s.mappings[numberKey] = entry
-	s.mappings[userName] = entry
+	s.mappings[entry.UserName] = entry
 
 	// Update sub-number index
 	for _, sub := range entry.SubNumbers {
 		s.subNumberMappings[sub] = entry.MatrixID
 	}
-
-	logger.Debug().
-		Str("username", entry.UserName).
-		Int("number", entry.Number).
-		Interface("sub_numbers", entry.SubNumbers).
-		Msg("mapping stored")
-	return s.buildMappingResponse(entry), nil
 }
 
 func (s *MessageService) buildMappingResponse(entry mappingEntry) *models.MappingResponse {
@@ -697,42 +904,58 @@ func (s *MessageService) ReportPushToken(ctx context.Context, req *models.PushTo
 		return nil, err
 	}
 
+	// Resolve the Matrix user owning the token, the push gateway refuses to notify other users on it
+	matrixUserID := s.resolveMatrixUser(userName)
+
+	// Pushers are appended, so the pusher of a token replaced on this selector must be removed
+	previous, err := s.pushTokenDB.GetPushToken(selector)
+	if err != nil {
+		logger.Error().Err(err).Str("selector", selector).Msg("failed to look up previous push token")
+		return nil, fmt.Errorf("failed to look up push token: %w", err)
+	}
+
 	// Save to database
 	if err := s.pushTokenDB.SavePushToken(
 		selector,
+		string(matrixUserID),
+		strings.TrimSpace(req.Device),
 		req.TokenMsgs,
 		req.AppIDMsgs,
 		req.TokenCalls,
 		req.AppIDCalls,
-	); err != nil {
+	); errors.Is(err, db.ErrPushTokenOwnedByOtherUser) {
+		// Another user reporting the selector would receive the notifications of its owner
+		owner := ""
+		if previous != nil {
+			owner = previous.UserID
+		}
+		logger.Warn().
+			Str("selector", selector).
+			Str("matrix_user_id", string(matrixUserID)).
+			Str("owner", owner).
+			Msg("push token report refused: selector or device token belongs to another user")
+		return nil, ErrPushTokenOwnership
+	} else if err != nil {
 		logger.Error().Err(err).Str("selector", selector).Msg("failed to save push token")
 		return nil, fmt.Errorf("failed to save push token: %w", err)
 	}
 
-	logger.Info().Str("selector", selector).Msg("push token reported and saved")
+	logger.Info().Str("selector", selector).Str("device", req.Device).Msg("push token reported and saved")
+
+	if previous != nil && previous.TokenMsgs != "" && previous.TokenMsgs != req.TokenMsgs {
+		owner := id.UserID(previous.UserID)
+		if owner == "" {
+			owner = matrixUserID
+		}
+		s.removePusher(ctx, owner, selector, previous.AppIDMsgs, previous.TokenMsgs)
+	}
 
 	// Register pusher with Matrix homeserver if we have a push token and proxy URL configured
 	if s.proxyURL != "" && req.TokenMsgs != "" {
-		// Resolve selector to Matrix user ID
-		matrixUserID := s.resolveMatrixUser(userName)
 		if matrixUserID == "" {
 			logger.Warn().Str("selector", selector).Msg("could not resolve selector to Matrix user ID for pusher registration")
 		} else {
-			// Construct pusher registration request
-			httpKind := "http"
-			pusherReq := &models.SetPusherRequest{
-				AppDisplayName:    req.AppIDMsgs, // Use app ID as display name
-				AppID:             req.AppIDMsgs,
-				Append:            false, // Replace existing pushers for this app_id/pushkey combination
-				DeviceDisplayName: "Acrobits Softphone",
-				Kind:              &httpKind,
-				Lang:              "en",
-				Pushkey:           req.TokenMsgs,
-				Data: &models.PusherData{
-					Format: "event_id_only",
-					URL:    strings.TrimSuffix(s.proxyURL, "/") + "/_matrix/push/v1/notify",
-				},
-			}
+			pusherReq := s.newPusherRequest(matrixUserID, req.AppIDMsgs, req.TokenMsgs)
 
 			// Call Matrix client to register pusher
 			if s.matrixClient == nil {
@@ -762,23 +985,276 @@ func (s *MessageService) ReportPushToken(ctx context.Context, req *models.PushTo
 	return &models.PushTokenReportResponse{}, nil
 }
 
-// getBatchToken retrieves the stored batch token for a user
-func (s *MessageService) getBatchToken(userID string) string {
+// ReportAccountRemoval handles an account removed from the Acrobits app.
+// It deletes the push token stored for the selector, removes the Matrix pusher registered for it
+// and drops the sync state and cached mappings of the user.
+func (s *MessageService) ReportAccountRemoval(ctx context.Context, req *models.AccountRemovalRequest) (*models.AccountRemovalResponse, error) {
+	if req == nil {
+		return nil, errors.New("request cannot be nil")
+	}
+
+	userName := strings.TrimSpace(req.UserName)
+	if userName == "" {
+		logger.Warn().Msg("account removal: empty username")
+		return nil, errors.New("username is required")
+	}
+
+	selector := strings.TrimSpace(req.Selector)
+	if selector == "" {
+		logger.Warn().Msg("account removal: empty selector")
+		return nil, errors.New("selector is required")
+	}
+
+	if strings.TrimSpace(req.Password) == "" {
+		logger.Warn().Msg("account removal: empty password")
+		return nil, errors.New("password is required")
+	}
+
+	if s.pushTokenDB == nil {
+		logger.Warn().Msg("account removal: database not initialized")
+		return nil, errors.New("push token storage not available")
+	}
+
+	// Validate extension + secret with external auth via AuthClient
+	if err := s.authenticateAndPersistMappings(ctx, userName, req.Password); err != nil {
+		return nil, err
+	}
+
+	matrixUserID := s.resolveMatrixUser(userName)
+
+	token, err := s.pushTokenDB.GetPushToken(selector)
+	if err != nil {
+		logger.Error().Err(err).Str("selector", selector).Msg("account removal: failed to look up push token")
+		return nil, fmt.Errorf("failed to look up push token: %w", err)
+	}
+	if token != nil && token.UserID != "" && token.UserID != string(matrixUserID) {
+		logger.Warn().
+			Str("selector", selector).
+			Str("matrix_user_id", string(matrixUserID)).
+			Str("owner", token.UserID).
+			Msg("account removal refused: selector belongs to another user")
+		return nil, ErrPushTokenOwnership
+	}
+	if token != nil {
+		if token.TokenMsgs != "" {
+			s.removePusher(ctx, matrixUserID, selector, token.AppIDMsgs, token.TokenMsgs)
+		}
+
+		if err := s.pushTokenDB.DeletePushToken(selector); err != nil {
+			logger.Error().Err(err).Str("selector", selector).Msg("account removal: failed to delete push token")
+			return nil, fmt.Errorf("failed to delete push token: %w", err)
+		}
+		// Only the removed device loses its sync cursor, the other devices of the user keep syncing
+		if matrixUserID != "" {
+			s.clearBatchToken(string(matrixUserID), token.DeviceID)
+		}
+	} else {
+		logger.Debug().Str("selector", selector).Msg("account removal: no push token stored for selector")
+	}
+
+	// The mappings are still needed by the other devices of the user
+	if matrixUserID != "" {
+		remaining, err := s.pushTokenDB.ListPushTokensByUser(string(matrixUserID))
+		if err != nil {
+			logger.Error().Err(err).Str("matrix_user_id", string(matrixUserID)).Msg("account removal: failed to list the remaining push tokens")
+		} else if len(remaining) == 0 {
+			s.deleteMappings(string(matrixUserID))
+		} else {
+			logger.Debug().Str("matrix_user_id", string(matrixUserID)).Int("devices", len(remaining)).Msg("account removal: mappings kept for the other devices")
+		}
+	}
+
+	logger.Info().Str("selector", selector).Str("matrix_user_id", string(matrixUserID)).Msg("account removal processed")
+	return &models.AccountRemovalResponse{}, nil
+}
+
+// ReportPushSettings changes the push notification preferences of the user authenticated by the request,
+// and returns them. Users choose for themselves whether their pushes show the message content.
+func (s *MessageService) ReportPushSettings(ctx context.Context, req *models.PushSettingsReportRequest) (*models.PushSettings, error) {
+	if req == nil {
+		return nil, errors.New("request cannot be nil")
+	}
+
+	userName := strings.TrimSpace(req.UserName)
+	if userName == "" || strings.TrimSpace(req.Password) == "" {
+		logger.Warn().Msg("push settings: empty username or password")
+		return nil, ErrAuthentication
+	}
+
+	if s.pushTokenDB == nil {
+		logger.Warn().Msg("push settings: database not initialized")
+		return nil, errors.New("push token storage not available")
+	}
+
+	if err := s.authenticateAndPersistMappings(ctx, userName, req.Password); err != nil {
+		return nil, err
+	}
+
+	userID := s.resolveMatrixUser(userName)
+	if userID == "" {
+		logger.Warn().Str("username", userName).Msg("resolved to empty Matrix user ID")
+		return nil, ErrAuthentication
+	}
+
+	if req.HideContent != nil {
+		if err := s.pushTokenDB.SetPushHideContent(string(userID), *req.HideContent); err != nil {
+			return nil, fmt.Errorf("failed to save push settings: %w", err)
+		}
+		logger.Info().Str("user_id", string(userID)).Bool("hide_content", *req.HideContent).Msg("push settings saved")
+	}
+
+	hide, err := s.pushTokenDB.GetPushHideContent(string(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get push settings: %w", err)
+	}
+	return &models.PushSettings{UserID: string(userID), HideContent: hide}, nil
+}
+
+// newPusherRequest builds the registration of the pusher sending the notifications of userID for the
+// messages token pushkey to the proxy push gateway.
+func (s *MessageService) newPusherRequest(userID id.UserID, appID, pushkey string) *models.SetPusherRequest {
+	httpKind := "http"
+	return &models.SetPusherRequest{
+		AppDisplayName:    appID, // Use app ID as display name
+		AppID:             appID,
+		Append:            true, // Keep the pushers of the other devices, the pusher of this pushkey is updated
+		DeviceDisplayName: "Acrobits Softphone",
+		Kind:              &httpKind,
+		Lang:              "en",
+		Pushkey:           pushkey,
+		Data: &models.PusherData{
+			Format: "event_id_only",
+			URL:    pushGatewayURL(s.proxyURL, s.pushGatewaySecret, string(userID)),
+		},
+	}
+}
+
+// removePusher deletes the pusher registered for a push token of userID.
+// Errors are only logged: the pusher is rejected anyway once its token is gone.
+func (s *MessageService) removePusher(ctx context.Context, userID id.UserID, selector, appID, pushkey string) {
+	if userID == "" || s.matrixClient == nil {
+		return
+	}
+	// A null kind deletes the pusher identified by app_id and pushkey
+	pusherReq := &models.SetPusherRequest{
+		AppID:   appID,
+		Kind:    nil,
+		Pushkey: pushkey,
+	}
+	if err := s.matrixClient.SetPusher(ctx, userID, pusherReq); err != nil {
+		logger.Error().
+			Err(err).
+			Str("selector", selector).
+			Str("matrix_user_id", string(userID)).
+			Str("pushkey", pushkey).
+			Msg("failed to remove pusher from Matrix homeserver")
+		return
+	}
+	logger.Info().
+		Str("selector", selector).
+		Str("matrix_user_id", string(userID)).
+		Str("pushkey", pushkey).
+		Msg("removed pusher from Matrix homeserver")
+}
+
+// deleteMappings removes all the mappings, and their sub-numbers, pointing to the given Matrix ID.
+func (s *MessageService) deleteMappings(matrixID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pushTokenDB != nil {
+		if err := s.pushTokenDB.DeleteMappings(matrixID); err != nil {
+			logger.Error().Err(err).Str("matrix_id", matrixID).Msg("failed to delete mappings from database")
+		}
+	}
+
+	for key, entry := range s.mappings {
+		if !strings.EqualFold(entry.MatrixID, matrixID) {
+			continue
+		}
+		for _, sub := range entry.SubNumbers {
+			delete(s.subNumberMappings, sub)
+		}
+		delete(s.mappings, key)
+	}
+	logger.Debug().Str("matrix_id", matrixID).Msg("mappings removed")
+}
+
+// syncTokenPruneInterval is the minimum interval between two prunings of stale sync tokens
+// and processed transactions.
+const syncTokenPruneInterval = time.Hour
+
+// batchTokenKey returns the key of the sync cursor of a user's device.
+func batchTokenKey(userID, device string) string {
+	if device == "" {
+		return userID
+	}
+	return userID + "|" + device
+}
+
+// getBatchToken retrieves the stored batch token for a user's device
+func (s *MessageService) getBatchToken(userID, device string) string {
+	if s.pushTokenDB != nil {
+		token, err := s.pushTokenDB.GetSyncToken(userID, device)
+		if err != nil {
+			logger.Error().Err(err).Str("user_id", userID).Str("device", device).Msg("failed to load sync token")
+		}
+		return token
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.batchTokens[userID]
+	return s.batchTokens[batchTokenKey(userID, device)]
 }
 
-// setBatchToken stores the batch token for a user
-func (s *MessageService) setBatchToken(userID string, token string) {
+// setBatchToken stores the batch token for a user's device
+func (s *MessageService) setBatchToken(userID, device, token string) {
+	if s.pushTokenDB != nil {
+		if err := s.pushTokenDB.SaveSyncToken(userID, device, token); err != nil {
+			logger.Error().Err(err).Str("user_id", userID).Str("device", device).Msg("failed to save sync token")
+		}
+		s.pruneSyncTokens()
+		return
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.batchTokens[userID] = token
+	s.batchTokens[batchTokenKey(userID, device)] = token
 }
 
-// clearBatchToken removes the batch token for a user
-func (s *MessageService) clearBatchToken(userID string) {
+// clearBatchToken removes the batch token for a user's device
+func (s *MessageService) clearBatchToken(userID, device string) {
+	if s.pushTokenDB != nil {
+		if err := s.pushTokenDB.DeleteSyncToken(userID, device); err != nil {
+			logger.Error().Err(err).Str("user_id", userID).Str("device", device).Msg("failed to delete sync token")
+		}
+		return
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.batchTokens, userID)
+	delete(s.batchTokens, batchTokenKey(userID, device))
+}
+
+// pruneSyncTokens removes the sync tokens of devices that have not polled for longer than syncTokenMaxAge.
+// It runs at most once per syncTokenPruneInterval.
+func (s *MessageService) pruneSyncTokens() {
+	if s.pushTokenDB == nil || s.syncTokenMaxAge <= 0 {
+		return
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	if !s.lastSyncPrune.IsZero() && now.Sub(s.lastSyncPrune) < syncTokenPruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSyncPrune = now
+	s.mu.Unlock()
+
+	pruned, err := s.pushTokenDB.PruneSyncTokens(now.Add(-s.syncTokenMaxAge))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to prune sync tokens")
+		return
+	}
+	if pruned > 0 {
+		logger.Info().Int64("pruned", pruned).Dur("max_age", s.syncTokenMaxAge).Msg("pruned stale sync tokens")
+	}
 }
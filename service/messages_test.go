@@ -11,9 +11,11 @@ import (
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/matrix"
 	"github.com/nethesis/matrix2acrobits/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
 )
 
 // setMapping is a test helper to directly insert a mapping into the service's internal store.
@@ -421,6 +423,7 @@ func TestReportPushToken(t *testing.T) {
 		require.NoError(t, err)
 		assert.NotNil(t, savedToken)
 		assert.Equal(t, "token123", savedToken.TokenMsgs)
+		assert.Equal(t, "@alice:example.com", savedToken.UserID)
 	})
 
 	// Test with both messages and calls tokens
@@ -472,6 +475,140 @@ func TestReportPushToken(t *testing.T) {
 	})
 }
 
+func TestReportPushToken_MultipleDevices(t *testing.T) {
+	// mock external auth endpoints (2-step flow)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/login" && r.Method == "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+		} else if r.URL.Path == "/api/chat" && r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(models.ChatResponse{
+				Users: []models.ChatUser{
+					{UserName: "alice", MainExtension: "201", SubExtensions: []string{"91201"}},
+				},
+			})
+		}
+	}))
+	defer ts.Close()
+
+	var pusherReqs []map[string]interface{}
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/pushers/set" {
+			assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+			var req map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			pusherReqs = append(pusherReqs, req)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer homeserver.Close()
+
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	svc := NewMessageService(mc, dbi, NewTestConfigWithAuth(ts.URL))
+
+	report := func(selector, device, token string) {
+		_, err := svc.ReportPushToken(context.TODO(), &models.PushTokenReportRequest{
+			UserName:  "201",
+			Password:  "testpass",
+			Selector:  selector,
+			Device:    device,
+			TokenMsgs: token,
+			AppIDMsgs: "com.acrobits.softphone",
+		})
+		require.NoError(t, err)
+	}
+
+	// Each device gets its own pusher, appended to the others
+	report("sel-mobile", "install1", "token-mobile")
+	report("sel-desk", "install2", "token-desk")
+	require.Len(t, pusherReqs, 2)
+	for i, pushkey := range []string{"token-mobile", "token-desk"} {
+		assert.Equal(t, pushkey, pusherReqs[i]["pushkey"])
+		assert.Equal(t, true, pusherReqs[i]["append"])
+		assert.Equal(t, "http", pusherReqs[i]["kind"])
+	}
+
+	tokens, err := dbi.ListPushTokensByUser("@alice:example.com")
+	require.NoError(t, err)
+	assert.Len(t, tokens, 2)
+	mobile, err := dbi.GetPushToken("sel-mobile")
+	require.NoError(t, err)
+	assert.Equal(t, "install1", mobile.DeviceID)
+
+	// A new token on the same device removes the pusher of the old one
+	pusherReqs = nil
+	report("sel-mobile", "install1", "token-mobile-2")
+	require.Len(t, pusherReqs, 2)
+	assert.Nil(t, pusherReqs[0]["kind"])
+	assert.Equal(t, "token-mobile", pusherReqs[0]["pushkey"])
+	assert.Equal(t, "token-mobile-2", pusherReqs[1]["pushkey"])
+
+	// Reporting the same token again only refreshes its pusher
+	pusherReqs = nil
+	report("sel-mobile", "install1", "token-mobile-2")
+	require.Len(t, pusherReqs, 1)
+	assert.Equal(t, "http", pusherReqs[0]["kind"])
+}
+
+func TestReportPushToken_Ownership(t *testing.T) {
+	// mock external auth endpoints (2-step flow), with two users
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/login" && r.Method == "POST" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+		} else if r.URL.Path == "/api/chat" && r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(models.ChatResponse{
+				Users: []models.ChatUser{
+					{UserName: "alice", MainExtension: "201"},
+					{UserName: "mallory", MainExtension: "202"},
+				},
+			})
+		}
+	}))
+	defer ts.Close()
+
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+	svc := NewMessageService(nil, dbi, NewTestConfigWithAuth(ts.URL))
+
+	_, err = svc.ReportPushToken(context.TODO(), &models.PushTokenReportRequest{
+		UserName: "201", Password: "testpass", Selector: "alice-selector", TokenMsgs: "alice-token", AppIDMsgs: "app",
+	})
+	require.NoError(t, err)
+
+	// Another user reporting the selector does not get the notifications of its owner
+	_, err = svc.ReportPushToken(context.TODO(), &models.PushTokenReportRequest{
+		UserName: "202", Password: "testpass", Selector: "alice-selector", TokenMsgs: "mallory-token", AppIDMsgs: "app",
+	})
+	assert.ErrorIs(t, err, ErrPushTokenOwnership)
+
+	// Nor report its device token on another selector
+	_, err = svc.ReportPushToken(context.TODO(), &models.PushTokenReportRequest{
+		UserName: "202", Password: "testpass", Selector: "mallory-selector", TokenMsgs: "alice-token", AppIDMsgs: "app",
+	})
+	assert.ErrorIs(t, err, ErrPushTokenOwnership)
+
+	// Nor can remove its token
+	_, err = svc.ReportAccountRemoval(context.TODO(), &models.AccountRemovalRequest{
+		UserName: "202", Password: "testpass", Selector: "alice-selector",
+	})
+	assert.ErrorIs(t, err, ErrPushTokenOwnership)
+
+	token, err := dbi.GetPushToken("alice-selector")
+	require.NoError(t, err)
+	require.NotNil(t, token)
+	assert.Equal(t, "@alice:example.com", token.UserID)
+	assert.Equal(t, "alice-token", token.TokenMsgs)
+}
+
 // fakeHTTPAuthClient allows controlling responses for testing.
 type fakeHTTPAuthClient struct {
 	ok bool
@@ -670,6 +807,88 @@ func TestSaveMapping_RoomAlias(t *testing.T) {
 	svc.mu.RUnlock()
 }
 
+func TestSaveMapping_PersistedAcrossRestart(t *testing.T) {
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	svc := NewMessageService(nil, dbi, NewTestConfig())
+	_, err = svc.SaveMapping(&models.MappingRequest{Number: 201, MatrixID: "@alice:example.com", SubNumbers: []int{91201}})
+	require.NoError(t, err)
+	_, err = svc.SaveMapping(&models.MappingRequest{Number: 202, MatrixID: "@bob:example.com"})
+	require.NoError(t, err)
+
+	// A new service on the same database resolves mappings without any authentication
+	restarted := NewMessageService(nil, dbi, NewTestConfig())
+	assert.Equal(t, id.UserID("@alice:example.com"), restarted.resolveMatrixUser("91201"))
+	assert.Equal(t, "202", restarted.resolveMatrixIDToIdentifier("@bob:example.com"))
+
+	resp, err := restarted.LookupMapping("201")
+	require.NoError(t, err)
+	assert.Equal(t, []int{91201}, resp.SubNumbers)
+	assert.NotEmpty(t, resp.UpdatedAt)
+}
+
+func TestSaveDirectoryMappings_SkipsUnchanged(t *testing.T) {
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	svc := NewMessageService(nil, dbi, NewTestConfig())
+	svc.now = func() time.Time { return now }
+	directory := []*models.MappingRequest{
+		{Number: 201, MatrixID: "@alice:example.com", SubNumbers: []int{91201}},
+		{Number: 202, MatrixID: "@bob:example.com"},
+	}
+	require.NoError(t, svc.saveDirectoryMappings(directory))
+
+	// The same directory later only updates the mappings that changed
+	now = now.Add(time.Hour)
+	directory[1] = &models.MappingRequest{Number: 202, MatrixID: "@bob:example.com", SubNumbers: []int{91202}}
+	require.NoError(t, svc.saveDirectoryMappings(directory))
+
+	stored, err := dbi.ListMappings()
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, 201, stored[0].Number)
+	assert.True(t, stored[0].UpdatedAt.Equal(now.Add(-time.Hour)))
+	assert.Equal(t, 202, stored[1].Number)
+	assert.True(t, stored[1].UpdatedAt.Equal(now))
+	assert.Equal(t, []int{91202}, stored[1].SubNumbers)
+	assert.Equal(t, id.UserID("@bob:example.com"), svc.resolveMatrixUser("91202"))
+
+	err = svc.saveDirectoryMappings([]*models.MappingRequest{{Number: 203}})
+	assert.Error(t, err)
+}
+
+func TestBatchTokens_PersistedAcrossRestart(t *testing.T) {
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	svc := NewMessageService(nil, dbi, NewTestConfig())
+	svc.setBatchToken("@alice:example.com", "phone", "s1")
+	svc.setBatchToken("@alice:example.com", "tablet", "s2")
+
+	restarted := NewMessageService(nil, dbi, NewTestConfig())
+	assert.Equal(t, "s1", restarted.getBatchToken("@alice:example.com", "phone"))
+	assert.Equal(t, "s2", restarted.getBatchToken("@alice:example.com", "tablet"))
+
+	restarted.clearBatchToken("@alice:example.com", "phone")
+	assert.Empty(t, restarted.getBatchToken("@alice:example.com", "phone"))
+	assert.Equal(t, "s2", restarted.getBatchToken("@alice:example.com", "tablet"))
+
+	// Tokens unused for longer than the max age are pruned
+	cfg := NewTestConfig()
+	cfg.SyncTokenMaxAge = time.Hour
+	later := NewMessageService(nil, dbi, cfg)
+	later.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	later.lastSyncPrune = time.Time{}
+	later.pruneSyncTokens()
+	assert.Empty(t, later.getBatchToken("@alice:example.com", "tablet"))
+}
+
 func TestReportPushToken_Auth401DoesNotSave(t *testing.T) {
 	// set up in-memory DB
 	dbi, err := db.NewDatabase(":memory:")
@@ -699,3 +918,140 @@ func TestReportPushToken_Auth401DoesNotSave(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, token)
 }
+
+func TestReportPushSettings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/login":
+			var login models.LoginRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&login))
+			if login.Password != "testpass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+		case "/api/chat":
+			json.NewEncoder(w).Encode(models.ChatResponse{Users: []models.ChatUser{
+				{UserName: "alice", MainExtension: "201", SubExtensions: []string{"91201"}},
+			}})
+		}
+	}))
+	defer ts.Close()
+
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+	svc := NewMessageService(nil, dbi, NewTestConfigWithAuth(ts.URL))
+
+	hide := true
+	_, err = svc.ReportPushSettings(context.TODO(), &models.PushSettingsReportRequest{UserName: "201", Password: "wrong", HideContent: &hide})
+	assert.ErrorIs(t, err, ErrAuthentication)
+	_, err = svc.ReportPushSettings(context.TODO(), &models.PushSettingsReportRequest{UserName: "201", HideContent: &hide})
+	assert.ErrorIs(t, err, ErrAuthentication)
+	stored, err := dbi.GetPushHideContent("@alice:example.com")
+	require.NoError(t, err)
+	assert.False(t, stored)
+
+	settings, err := svc.ReportPushSettings(context.TODO(), &models.PushSettingsReportRequest{UserName: "91201", Password: "testpass", HideContent: &hide})
+	require.NoError(t, err)
+	assert.Equal(t, &models.PushSettings{UserID: "@alice:example.com", HideContent: true}, settings)
+	stored, err = dbi.GetPushHideContent("@alice:example.com")
+	require.NoError(t, err)
+	assert.True(t, stored)
+
+	// Without hide_content, the current settings are returned unchanged
+	settings, err = svc.ReportPushSettings(context.TODO(), &models.PushSettingsReportRequest{UserName: "201", Password: "testpass"})
+	require.NoError(t, err)
+	assert.True(t, settings.HideContent)
+}
+
+func TestReportAccountRemoval(t *testing.T) {
+	t.Run("empty selector", func(t *testing.T) {
+		svc := NewMessageService(nil, nil, NewTestConfig())
+		resp, err := svc.ReportAccountRemoval(context.TODO(), &models.AccountRemovalRequest{UserName: "201", Password: "testpass"})
+		assert.Error(t, err)
+		assert.Nil(t, resp)
+		assert.Contains(t, err.Error(), "selector is required")
+	})
+
+	t.Run("no database", func(t *testing.T) {
+		svc := NewMessageService(nil, nil, NewTestConfig())
+		resp, err := svc.ReportAccountRemoval(context.TODO(), &models.AccountRemovalRequest{UserName: "201", Password: "testpass", Selector: "sel"})
+		assert.Error(t, err)
+		assert.Nil(t, resp)
+		assert.Contains(t, err.Error(), "push token storage not available")
+	})
+
+	t.Run("removes token, pusher and user state", func(t *testing.T) {
+		// mock external auth endpoints (2-step flow)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/login" && r.Method == "POST" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+			} else if r.URL.Path == "/api/chat" && r.Method == "GET" {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(models.ChatResponse{
+					Users: []models.ChatUser{
+						{UserName: "alice", MainExtension: "201", SubExtensions: []string{"91201"}},
+					},
+				})
+			}
+		}))
+		defer ts.Close()
+
+		var pusherReq map[string]interface{}
+		homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/_matrix/client/v3/pushers/set" {
+				assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&pusherReq))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		}))
+		defer homeserver.Close()
+
+		dbi, err := db.NewDatabase(":memory:")
+		require.NoError(t, err)
+		defer dbi.Close()
+		require.NoError(t, dbi.SavePushToken("sel", "@alice:example.com", "phone", "token123", "com.acrobits.softphone", "token456", "com.acrobits.softphone.voip"))
+		require.NoError(t, dbi.SavePushToken("sel-tablet", "@alice:example.com", "tablet", "token789", "com.acrobits.softphone", "", ""))
+
+		mc, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+		require.NoError(t, err)
+		svc := NewMessageService(mc, dbi, NewTestConfigWithAuth(ts.URL))
+		svc.setBatchToken("@alice:example.com", "tablet", "s42")
+		svc.setBatchToken("@alice:example.com", "phone", "s43")
+
+		resp, err := svc.ReportAccountRemoval(context.TODO(), &models.AccountRemovalRequest{UserName: "201", Password: "testpass", Selector: "sel"})
+		require.NoError(t, err)
+		assert.NotNil(t, resp)
+
+		require.NotNil(t, pusherReq)
+		assert.Nil(t, pusherReq["kind"])
+		assert.Equal(t, "token123", pusherReq["pushkey"])
+		assert.Equal(t, "com.acrobits.softphone", pusherReq["app_id"])
+
+		token, err := dbi.GetPushToken("sel")
+		require.NoError(t, err)
+		assert.Nil(t, token)
+
+		// The other device keeps its sync cursor and the mappings
+		assert.Empty(t, svc.getBatchToken("@alice:example.com", "phone"))
+		assert.Equal(t, "s42", svc.getBatchToken("@alice:example.com", "tablet"))
+		_, err = svc.LookupMapping("201")
+		require.NoError(t, err)
+
+		// Removing the last device removes the mappings
+		_, err = svc.ReportAccountRemoval(context.TODO(), &models.AccountRemovalRequest{UserName: "201", Password: "testpass", Selector: "sel-tablet"})
+		require.NoError(t, err)
+		assert.Empty(t, svc.getBatchToken("@alice:example.com", "tablet"))
+		_, err = svc.LookupMapping("201")
+		assert.ErrorIs(t, err, ErrMappingNotFound)
+		assert.Equal(t, id.UserID(""), svc.resolveMatrixUser("91201"))
+
+		stored, err := dbi.ListMappings()
+		require.NoError(t, err)
+		assert.Empty(t, stored)
+	})
+}
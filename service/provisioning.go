@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"maunium.net/go/mautrix/id"
+)
+
+// QueryUser answers the homeserver asking whether a user of the Application Service namespace exists.
+// Extension users known from the external directory are registered on the fly and get a display name,
+// so they can receive messages before logging into Matrix for the first time.
+func (s *MessageService) QueryUser(ctx context.Context, userID id.UserID) (bool, error) {
+	entry, ok, err := s.directoryUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		logger.Debug().Str("user_id", string(userID)).Msg("user query: not an extension user")
+		return false, nil
+	}
+	if err := s.provisionUser(ctx, entry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// QueryRoomAlias answers the homeserver asking whether a room alias of the Application Service namespace exists.
+// Aliases of direct rooms between two extension users (see generateRoomAliasKey) are created on the fly.
+func (s *MessageService) QueryRoomAlias(ctx context.Context, alias id.RoomAlias) (bool, error) {
+	localpart, server, found := strings.Cut(strings.TrimPrefix(string(alias), "#"), ":")
+	if !found || !strings.EqualFold(server, s.homeserverHost) {
+		return false, nil
+	}
+	parts := strings.Split(localpart, "|")
+	if len(parts) != 2 || localpart != generateRoomAliasKey(id.UserID("@"+parts[0]), id.UserID("@"+parts[1])) {
+		logger.Debug().Str("alias", string(alias)).Msg("room query: not a direct room alias")
+		return false, nil
+	}
+
+	users := make([]mappingEntry, 0, len(parts))
+	for _, part := range parts {
+		entry, ok, err := s.directoryUser(ctx, id.NewUserID(part, s.homeserverHost))
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			logger.Debug().Str("alias", string(alias)).Str("localpart", part).Msg("room query: not an extension user")
+			return false, nil
+		}
+		users = append(users, entry)
+	}
+	for _, entry := range users {
+		if err := s.provisionUser(ctx, entry); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := s.createDirectRoom(ctx, id.UserID(users[0].MatrixID), id.UserID(users[1].MatrixID), localpart); err != nil {
+		return false, err
+	}
+	logger.Info().Str("alias", string(alias)).Msg("room query: direct room provisioned")
+	return true, nil
+}
+
+// directoryUser returns the mapping of an extension user. Users not known yet are looked up in the external
+// directory with the service account, when configured, and the mappings read are stored.
+func (s *MessageService) directoryUser(ctx context.Context, userID id.UserID) (mappingEntry, bool, error) {
+	if entry, ok := s.knownDirectoryUser(userID); ok {
+		return entry, true, nil
+	}
+	if !s.directoryConfigured() {
+		return mappingEntry{}, false, nil
+	}
+	if err := s.loadDirectory(ctx); err != nil {
+		return mappingEntry{}, false, err
+	}
+	entry, ok := s.knownDirectoryUser(userID)
+	return entry, ok, nil
+}
+
+// directoryConfigured reports whether the external directory can be read with the service account.
+func (s *MessageService) directoryConfigured() bool {
+	return s.directoryAccount != "" && s.directoryPassword != "" && s.extAuthURL != ""
+}
+
+// loadDirectory reads the external directory with the service account and stores its mappings.
+func (s *MessageService) loadDirectory(ctx context.Context) error {
+	mappings, err := s.authClient.ListUsers(ctx, s.directoryAccount, s.directoryPassword, s.homeserverHost)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to read the external directory")
+		return fmt.Errorf("external directory request failed: %w", err)
+	}
+	return s.saveDirectoryMappings(mappings)
+}
+
+// knownDirectoryUser returns the mapping of an extension user already learned from the external directory.
+func (s *MessageService) knownDirectoryUser(userID id.UserID) (mappingEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, entry := range s.mappings {
+		if entry.UserName != "" && strings.EqualFold(entry.MatrixID, string(userID)) {
+			return entry, true
+		}
+	}
+	return mappingEntry{}, false
+}
+
+// provisionUser registers an extension user through the Application Service and sets its display name.
+func (s *MessageService) provisionUser(ctx context.Context, entry mappingEntry) error {
+	if s.matrixClient == nil {
+		return fmt.Errorf("matrix client not available")
+	}
+	userID := id.UserID(entry.MatrixID)
+	if err := s.matrixClient.RegisterUser(ctx, userID.Localpart()); err != nil {
+		return err
+	}
+	displayName := fmt.Sprintf("%s (%d)", entry.UserName, entry.Number)
+	if err := s.matrixClient.SetDisplayName(ctx, userID, displayName); err != nil {
+		return err
+	}
+	logger.Info().Str("user_id", entry.MatrixID).Str("display_name", displayName).Msg("extension user provisioned")
+	return nil
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/id"
+)
+
+// fakeProvisioningHomeserver records the registrations, display names and rooms created by the proxy.
+type fakeProvisioningHomeserver struct {
+	mu           sync.Mutex
+	registered   []string
+	displayNames map[string]string
+	rooms        []map[string]interface{}
+	joins        []string
+}
+
+func (f *fakeProvisioningHomeserver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case r.URL.Path == "/_matrix/client/v3/register":
+			f.registered = append(f.registered, body["username"].(string))
+			_, _ = w.Write([]byte(`{}`))
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/displayname"):
+			f.displayNames[r.URL.Query().Get("user_id")] = body["displayname"].(string)
+			_, _ = w.Write([]byte(`{}`))
+		case r.URL.Path == "/_matrix/client/v3/createRoom":
+			body["creator"] = r.URL.Query().Get("user_id")
+			f.rooms = append(f.rooms, body)
+			_, _ = w.Write([]byte(`{"room_id":"!dm:example.com"}`))
+		case r.URL.Path == "/_matrix/client/v3/join/!dm:example.com":
+			f.joins = append(f.joins, r.URL.Query().Get("user_id"))
+			_, _ = w.Write([]byte(`{"room_id":"!dm:example.com"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+}
+
+func newProvisioningService(t *testing.T) (*MessageService, *fakeProvisioningHomeserver) {
+	fake := &fakeProvisioningHomeserver{displayNames: make(map[string]string)}
+	server := httptest.NewServer(fake.handler(t))
+	t.Cleanup(server.Close)
+
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	svc := NewMessageService(mc, nil, NewTestConfig())
+	_, err = svc.SaveMapping(&models.MappingRequest{Number: 201, MatrixID: "@alice:example.com"})
+	require.NoError(t, err)
+	_, err = svc.SaveMapping(&models.MappingRequest{Number: 202, MatrixID: "@bob:example.com"})
+	require.NoError(t, err)
+	return svc, fake
+}
+
+func TestQueryUser(t *testing.T) {
+	svc, fake := newProvisioningService(t)
+
+	exists, err := svc.QueryUser(context.Background(), "@bob:example.com")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"bob"}, fake.registered)
+	assert.Equal(t, map[string]string{"@bob:example.com": "bob (202)"}, fake.displayNames)
+
+	exists, err = svc.QueryUser(context.Background(), "@carol:example.com")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = svc.QueryUser(context.Background(), "@bob:other.example.com")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Len(t, fake.registered, 1)
+}
+
+func TestQueryRoomAlias(t *testing.T) {
+	svc, fake := newProvisioningService(t)
+
+	exists, err := svc.QueryRoomAlias(context.Background(), "#alice|bob:example.com")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"alice", "bob"}, fake.registered)
+	require.Len(t, fake.rooms, 1)
+	assert.Equal(t, "@alice:example.com", fake.rooms[0]["creator"])
+	assert.Equal(t, "alice|bob", fake.rooms[0]["room_alias_name"])
+	assert.Equal(t, []interface{}{"@bob:example.com"}, fake.rooms[0]["invite"])
+	assert.Equal(t, []string{"@bob:example.com"}, fake.joins)
+	assert.Equal(t, "!dm:example.com", svc.roomAliasCache.Get("alice|bob"))
+
+	for _, alias := range []id.RoomAlias{
+		"#bob|alice:example.com",   // not in canonical order
+		"#alice|carol:example.com", // unknown user
+		"#alice|bob:other.example.com",
+		"#general:example.com",
+	} {
+		exists, err := svc.QueryRoomAlias(context.Background(), alias)
+		require.NoError(t, err)
+		assert.False(t, exists, alias)
+	}
+	assert.Len(t, fake.rooms, 1)
+	assert.Len(t, fake.registered, 2)
+}
+
+func TestQueryUser_Directory(t *testing.T) {
+	svc, fake := newProvisioningService(t)
+
+	var logins []string
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/login":
+			var login models.LoginRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&login))
+			logins = append(logins, login.Username)
+			_ = json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+		case "/api/chat":
+			_ = json.NewEncoder(w).Encode(models.ChatResponse{Users: []models.ChatUser{
+				{UserName: "Carol", MainExtension: "203", SubExtensions: []string{"91203"}},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer directory.Close()
+	svc.extAuthURL = directory.URL
+	svc.authClient = NewHTTPAuthClient(directory.URL, time.Second, 0)
+
+	// Without the service account, only the known users are provisioned
+	exists, err := svc.QueryUser(context.Background(), "@carol:example.com")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, logins)
+
+	svc.directoryAccount, svc.directoryPassword = "directory", "secret"
+	exists, err = svc.QueryUser(context.Background(), "@carol:example.com")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, []string{"directory"}, logins)
+	assert.Equal(t, []string{"carol"}, fake.registered)
+	assert.Equal(t, "carol (203)", fake.displayNames["@carol:example.com"])
+	assert.Equal(t, id.UserID("@carol:example.com"), svc.resolveMatrixUser("91203"))
+
+	// Known users are not looked up again
+	exists, err = svc.QueryUser(context.Background(), "@carol:example.com")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Len(t, logins, 1)
+
+	exists, err = svc.QueryUser(context.Background(), "@dave:example.com")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Len(t, logins, 2)
+}
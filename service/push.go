@@ -7,40 +7,96 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nethesis/matrix2acrobits/db"
 	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/matrix"
 	"github.com/nethesis/matrix2acrobits/models"
 )
 
-const acrobitsPushURL = "https://pnm.cloudsoftphone.com/pnm2/send"
-
 var (
-	ErrPushTokenNotFound = errors.New("push token not found")
-	ErrPushFailed        = errors.New("push notification failed")
+	ErrPushTokenNotFound  = errors.New("push token not found")
+	ErrPushFailed         = errors.New("push notification failed")
+	ErrPushRecordDisabled = errors.New("push record mode not enabled")
 )
 
 // PushService handles Matrix push notifications and forwards them to Acrobits
 type PushService struct {
-	pushTokenDB *db.Database
-	httpClient  *http.Client
+	matrixClient *matrix.MatrixClient
+	pushTokenDB  *db.Database
+	httpClient   *http.Client
+	pnmURL       string
+	// In record mode, pushes are stored instead of being sent to the PNM
+	recorder *pushRecorder
+	// Push gateway protection, see AuthorizeGateway
+	allowedNets   []*net.IPNet
+	gatewaySecret string
+	failuresMu    sync.Mutex
+	failures      map[string]uint64
+	// Ringing calls, keyed by room, call ID and callee, see trackCall
+	callsMu sync.Mutex
+	calls   map[string]*pendingCall
+	// Delivery queue, see enqueuePush
+	queueWorkers      int
+	maxAttempts       int
+	retryBackoff      time.Duration
+	queueWake         chan struct{}
+	pruneMu           sync.Mutex
+	lastDeliveryPrune time.Time
 }
 
 // NewPushService creates a new push notification service
-func NewPushService(pushTokenDB *db.Database) *PushService {
-	return &PushService{
-		pushTokenDB: pushTokenDB,
+func NewPushService(matrixClient *matrix.MatrixClient, pushTokenDB *db.Database, cfg *Config) *PushService {
+	s := &PushService{
+		matrixClient: matrixClient,
+		pushTokenDB:  pushTokenDB,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		pnmURL:        cfg.PNMURL,
+		allowedNets:   cfg.PushGatewayAllowedNets,
+		gatewaySecret: cfg.PushGatewaySecret,
+		failures:      make(map[string]uint64),
+		calls:         make(map[string]*pendingCall),
+		queueWorkers:  cfg.PushQueueWorkers,
+		maxAttempts:   cfg.PushMaxAttempts,
+		retryBackoff:  defaultPushRetryBackoff,
+		queueWake:     make(chan struct{}, 1),
+	}
+	switch cfg.PushRecordMode {
+	case PushRecordMemory:
+		s.recorder = newPushRecorder("")
+	case PushRecordFile:
+		s.recorder = newPushRecorder(cfg.PushRecordFile)
+	}
+	return s
+}
+
+// RecordedPushes returns the latest pushes stored in record mode, oldest first.
+func (s *PushService) RecordedPushes() ([]models.RecordedPush, error) {
+	if s.recorder == nil {
+		return nil, ErrPushRecordDisabled
+	}
+	return s.recorder.list(), nil
+}
+
+// ClearRecordedPushes drops the pushes stored in memory in record mode.
+func (s *PushService) ClearRecordedPushes() error {
+	if s.recorder == nil {
+		return ErrPushRecordDisabled
 	}
+	s.recorder.clear()
+	return nil
 }
 
-// HandleMatrixPushNotification processes a Matrix push notification and forwards it to Acrobits
-func (s *PushService) HandleMatrixPushNotification(ctx context.Context, req *models.MatrixPushNotifyRequest) (*models.MatrixPushNotifyResponse, error) {
+// HandleMatrixPushNotification queues a Matrix push notification for userID, turned into Acrobits pushes by
+// the delivery workers. Devices whose push token does not belong to userID are rejected.
+func (s *PushService) HandleMatrixPushNotification(ctx context.Context, userID string, req *models.MatrixPushNotifyRequest) (*models.MatrixPushNotifyResponse, error) {
 	logger.Debug().Interface("notification", req.Notification).Msg("processing matrix push notification")
 
 	rejected := make([]string, 0)
@@ -53,7 +109,7 @@ func (s *PushService) HandleMatrixPushNotification(ctx context.Context, req *mod
 			Msg("processing device for push notification")
 
 		// Look up the push token in our database using the pushkey
-		token, err := s.pushTokenDB.GetPushTokenByPushkey(device.Pushkey)
+		token, err := s.pushTokenDB.GetPushTokenByPushkey(device.Pushkey, userID)
 		if err != nil {
 			logger.Error().
 				Str("pushkey", device.Pushkey).
@@ -69,28 +125,45 @@ func (s *PushService) HandleMatrixPushNotification(ctx context.Context, req *mod
 			rejected = append(rejected, device.Pushkey)
 			continue
 		}
+		// Tokens saved before they were bound to a user have no owner: the pusher URL passed the gateway
+		// checks, so the token is bound to the notified user
+		if token.UserID == "" {
+			token, err = s.bindPushToken(token, userID)
+			if err != nil {
+				logger.Error().Str("pushkey", device.Pushkey).Err(err).Msg("failed to bind push token to its user")
+				return nil, fmt.Errorf("failed to bind push token: %w", err)
+			}
+		}
+		if token.UserID != userID {
+			logger.Warn().
+				Str("pushkey", device.Pushkey).
+				Str("user_id", userID).
+				Str("owner", token.UserID).
+				Msg("push token belongs to another user, marking as rejected")
+			s.countFailure(PushFailureOwnerMismatch)
+			rejected = append(rejected, device.Pushkey)
+			continue
+		}
+		// The queued pushes cannot reject the pushkey: the rejection is returned to the next notification,
+		// unless the token was reported again since
+		if tokenRejected, err := s.pushTokenDB.PushkeyRejected(device.Pushkey, token.UpdatedAt); err != nil {
+			logger.Warn().Str("pushkey", device.Pushkey).Err(err).Msg("failed to look up push deliveries")
+		} else if tokenRejected {
+			logger.Warn().
+				Str("pushkey", device.Pushkey).
+				Msg("push token rejected by Acrobits, marking as rejected")
+			rejected = append(rejected, device.Pushkey)
+			continue
+		}
 
-		// Translate Matrix notification to Acrobits format
-		acrobitsReq := s.translateToAcrobits(req.Notification, device, token)
-
-		// Send to Acrobits
-		if err := s.sendToAcrobits(ctx, acrobitsReq); err != nil {
+		// Queue for delivery, the homeserver retries the notification when it cannot be queued
+		if err := s.enqueueNotification(userID, req.Notification, device); err != nil {
 			logger.Error().
 				Str("pushkey", device.Pushkey).
 				Str("selector", token.Selector).
 				Err(err).
-				Msg("failed to send push notification to Acrobits")
-
-			// If Acrobits returns 404, the token is invalid
-			if errors.Is(err, ErrPushTokenNotFound) {
-				rejected = append(rejected, device.Pushkey)
-			}
-		} else {
-			logger.Info().
-				Str("pushkey", device.Pushkey).
-				Str("selector", token.Selector).
-				Str("event_id", req.Notification.EventID).
-				Msg("push notification sent successfully to Acrobits")
+				Msg("failed to queue push notification")
+			return nil, fmt.Errorf("failed to queue push notification: %w", err)
 		}
 	}
 
@@ -99,6 +172,84 @@ func (s *PushService) HandleMatrixPushNotification(ctx context.Context, req *mod
 	}, nil
 }
 
+// bindPushToken binds an ownerless token to userID and returns it as stored: when another request bound it
+// first, it keeps that owner.
+func (s *PushService) bindPushToken(token *db.PushToken, userID string) (*db.PushToken, error) {
+	if _, err := s.pushTokenDB.BindPushToken(token.Selector, userID); err != nil {
+		return nil, err
+	}
+	bound, err := s.pushTokenDB.GetPushToken(token.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if bound == nil {
+		// Removed in the meantime: nobody owns it
+		return token, nil
+	}
+	return bound, nil
+}
+
+// pushNotification queues the pushes of a notification received at receivedAt for its device, owned by userID:
+// a badge update for the counts-only notifications, a call push with the calls token for the ringing calls,
+// and a message push otherwise. Calls also ring the devices of userID without pusher.
+func (s *PushService) pushNotification(ctx context.Context, userID string, n models.MatrixNotification, receivedAt time.Time) error {
+	device := n.Devices[0]
+	token, err := s.pushTokenDB.GetPushTokenByPushkey(device.Pushkey, userID)
+	if err != nil {
+		return fmt.Errorf("failed to look up push token: %w", err)
+	}
+	// The token was removed or reported by another user since the notification was queued
+	if token == nil || token.UserID != userID {
+		logger.Info().Str("pushkey", device.Pushkey).Str("user_id", userID).Msg("push token no longer belongs to the notified user, notification dropped")
+		return nil
+	}
+
+	// Reading messages only changes the unread count: update the badge without a message
+	if isCountsOnly(n) {
+		return s.queueBadgePush(n, token)
+	}
+
+	prepared, call := s.prepareNotification(ctx, userID, n)
+	var expiresAt *time.Time
+	if call != nil {
+		ringEnd := receivedAt.Add(call.lifetime)
+		if !time.Now().Before(ringEnd) {
+			logger.Info().Str("pushkey", device.Pushkey).Str("event_id", n.EventID).Msg("call no longer ringing, notification dropped")
+			return nil
+		}
+		call.lifetime = time.Until(ringEnd)
+		expiresAt = &ringEnd
+	}
+
+	var callPushes []models.AcrobitsPushRequest
+	if call != nil && token.TokenCalls != "" {
+		// Calls ring the device through its calls token. A rejected call push does not reject the pushkey,
+		// which is the messages token.
+		callReq := s.translateCallToAcrobits(prepared, token)
+		if err := s.enqueuePush(token.TokenCalls, callReq, expiresAt); err != nil {
+			return fmt.Errorf("failed to queue call push: %w", err)
+		}
+		callPushes = append(callPushes, *callReq)
+	} else {
+		acrobitsReq := s.translateToAcrobits(prepared, device, token)
+		if call != nil && acrobitsReq.Message == "" {
+			// The device has no calls token, tell the user with a message instead
+			acrobitsReq.Message = "Incoming call"
+		}
+		if err := s.enqueuePush(device.Pushkey, acrobitsReq, nil); err != nil {
+			return fmt.Errorf("failed to queue push: %w", err)
+		}
+	}
+
+	if call != nil {
+		callPushes = append(callPushes, s.ringDevicesWithoutPusher(prepared, *call, userID, expiresAt)...)
+	}
+	if len(callPushes) > 0 {
+		s.trackCall(*call, userID, callPushes)
+	}
+	return nil
+}
+
 // translateToAcrobits converts a Matrix notification to Acrobits push format
 func (s *PushService) translateToAcrobits(notification models.MatrixNotification, device models.MatrixDevice, token *db.PushToken) *models.AcrobitsPushRequest {
 	req := &models.AcrobitsPushRequest{
@@ -120,7 +271,8 @@ func (s *PushService) translateToAcrobits(notification models.MatrixNotification
 
 	// Set badge count from unread messages
 	if notification.Counts != nil {
-		req.Badge = notification.Counts.Unread
+		unread := notification.Counts.Unread
+		req.Badge = &unread
 	}
 
 	// Set sender information
@@ -159,14 +311,19 @@ func (s *PushService) translateToAcrobits(notification models.MatrixNotification
 	return req
 }
 
-// sendToAcrobits sends a push notification to the Acrobits PNM service
+// sendToAcrobits sends a push notification to the Acrobits PNM service, or records it in record mode
 func (s *PushService) sendToAcrobits(ctx context.Context, req *models.AcrobitsPushRequest) error {
+	if s.recorder != nil {
+		logger.Debug().Str("selector", req.Selector).Str("id", req.ID).Msg("recording push notification instead of sending it")
+		return s.recorder.record(req, time.Now())
+	}
+
 	body, err := json.Marshal(req)
 	if err != nil {
 		return fmt.Errorf("failed to marshal acrobits request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", acrobitsPushURL, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.pnmURL, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("failed to create http request: %w", err)
 	}
@@ -174,7 +331,7 @@ func (s *PushService) sendToAcrobits(ctx context.Context, req *models.AcrobitsPu
 	httpReq.Header.Set("Content-Type", "application/json")
 
 	logger.Debug().
-		Str("url", acrobitsPushURL).
+		Str("url", s.pnmURL).
 		Str("selector", req.Selector).
 		Msg("sending push notification to Acrobits PNM")
 
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+// acrobitsVerbBadge is the silent push setting the app badge, without showing a notification.
+// A zero badge also clears the notifications shown by the phone.
+const acrobitsVerbBadge = "NotifyBadge"
+
+// isCountsOnly reports whether a notification only updates the unread counts: the homeserver sends them without
+// an event when the user reads messages, from any client.
+func isCountsOnly(n models.MatrixNotification) bool {
+	return n.EventID == ""
+}
+
+// translateCountsToAcrobits converts a counts-only notification to a badge push for the messages token.
+func translateCountsToAcrobits(n models.MatrixNotification, token *db.PushToken) *models.AcrobitsPushRequest {
+	badge := 0
+	if n.Counts != nil {
+		badge = n.Counts.Unread
+	}
+	return &models.AcrobitsPushRequest{
+		Verb:        acrobitsVerbBadge,
+		AppID:       token.AppIDMsgs,
+		DeviceToken: token.TokenMsgs,
+		Selector:    token.Selector,
+		Badge:       &badge,
+	}
+}
+
+// queueBadgePush queues the unread count of a counts-only notification for a device. The pending badge updates
+// of the device are cancelled first: sent after this one, they would show an outdated count.
+func (s *PushService) queueBadgePush(n models.MatrixNotification, token *db.PushToken) error {
+	if n.Counts == nil {
+		logger.Debug().Str("selector", token.Selector).Msg("notification without event nor counts, nothing to push")
+		return nil
+	}
+
+	if _, err := s.pushTokenDB.CancelPushDeliveries(acrobitsVerbBadge, "", token.TokenMsgs); err != nil {
+		logger.Warn().Str("selector", token.Selector).Err(err).Msg("failed to cancel the previous badge pushes")
+	}
+	badgeReq := translateCountsToAcrobits(n, token)
+	if err := s.enqueuePush(token.TokenMsgs, badgeReq, nil); err != nil {
+		return fmt.Errorf("failed to queue badge push: %w", err)
+	}
+	logger.Debug().Str("selector", token.Selector).Int("badge", *badgeReq.Badge).Msg("badge push queued")
+	return nil
+}
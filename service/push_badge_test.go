@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countsOnly(pushkey string, counts *models.MatrixCounts) *models.MatrixPushNotifyRequest {
+	return &models.MatrixPushNotifyRequest{
+		Notification: models.MatrixNotification{
+			Counts:  counts,
+			Devices: []models.MatrixDevice{{AppID: "com.acrobits.msgs", Pushkey: pushkey}},
+		},
+	}
+}
+
+func TestHandleMatrixPushNotification_CountsOnly(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("unread count updates the badge", func(t *testing.T) {
+		s := newCallPushService(t)
+		resp, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", countsOnly("bob-msgs", &models.MatrixCounts{Unread: 3}))
+		require.NoError(t, err)
+		assert.Empty(t, resp.Rejected)
+		assert.Equal(t, 2, deliverAll(s))
+
+		pushes, err := s.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 1)
+		push := pushes[0].Request
+		assert.Equal(t, acrobitsVerbBadge, push.Verb)
+		assert.Equal(t, "bob-msgs", push.DeviceToken)
+		assert.Equal(t, "com.acrobits.msgs", push.AppID)
+		require.NotNil(t, push.Badge)
+		assert.Equal(t, 3, *push.Badge)
+		assert.Empty(t, push.Message)
+		assert.Empty(t, push.Sound)
+	})
+
+	t.Run("all messages read clears the badge", func(t *testing.T) {
+		s := newCallPushService(t)
+		_, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", countsOnly("bob-msgs", &models.MatrixCounts{}))
+		require.NoError(t, err)
+		deliverAll(s)
+
+		pushes, err := s.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 1)
+		require.NotNil(t, pushes[0].Request.Badge)
+		assert.Equal(t, 0, *pushes[0].Request.Badge)
+	})
+
+	t.Run("notification without event nor counts is not pushed", func(t *testing.T) {
+		s := newCallPushService(t)
+		resp, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", countsOnly("bob-msgs", nil))
+		require.NoError(t, err)
+		assert.Empty(t, resp.Rejected)
+		assert.Equal(t, 1, deliverAll(s))
+
+		pushes, err := s.RecordedPushes()
+		require.NoError(t, err)
+		assert.Empty(t, pushes)
+	})
+
+	t.Run("newer count supersedes the pending badge", func(t *testing.T) {
+		s := newCallPushService(t)
+		for _, unread := range []int{3, 1} {
+			_, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", countsOnly("bob-msgs", &models.MatrixCounts{Unread: unread}))
+			require.NoError(t, err)
+		}
+		// Both notifications are turned into badge pushes before the first is sent
+		require.Equal(t, 2, s.deliverQueued(ctx))
+		assert.Equal(t, 1, deliverAll(s))
+
+		pushes, err := s.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 1)
+		assert.Equal(t, 1, *pushes[0].Request.Badge)
+	})
+}
+
+func TestTranslateCountsToAcrobits(t *testing.T) {
+	token := &db.PushToken{Selector: "selector", TokenMsgs: "msgs-token", AppIDMsgs: "app.msgs", TokenCalls: "calls-token"}
+
+	req := translateCountsToAcrobits(models.MatrixNotification{}, token)
+	// A zero badge is sent, to clear the badge and the notifications
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"verb":"NotifyBadge","AppId":"app.msgs","DeviceToken":"msgs-token","Selector":"selector","Badge":0}`, string(body))
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/event"
+)
+
+// Acrobits PNM verbs of the call pushes, sent with the calls token so the softphone rings.
+const (
+	acrobitsVerbIncomingCall = "NotifyIncomingCall"
+	acrobitsVerbCancelCall   = "NotifyCancelCall"
+)
+
+// MatrixRTC events, still sent with their unstable names by the clients: call notifications (MSC4075),
+// declines (MSC4310) and call memberships (MSC3401).
+const (
+	eventCallNotify         = "m.call.notify"
+	eventCallNotifyUnstable = "org.matrix.msc4075.call.notify"
+	eventRTCNotification    = "org.matrix.msc4075.rtc.notification"
+	eventRTCDecline         = "org.matrix.msc4310.rtc.decline"
+	eventCallMember         = "m.call.member"
+	eventCallMemberUnstable = "org.matrix.msc3401.call.member"
+)
+
+// defaultCallLifetime is how long a call rings when the invite does not say.
+const defaultCallLifetime = 60 * time.Second
+
+// Reasons of the call cancellations, logged with the cancellation push
+const (
+	callCancelMissed   = "missed"
+	callCancelAnswered = "answered"
+	callCancelRejected = "rejected"
+	callCancelHangup   = "hangup"
+)
+
+// matrixCall is a call ringing a user: a legacy m.call.invite, or a MatrixRTC ring notification.
+type matrixCall struct {
+	roomID   string
+	callID   string // empty for MatrixRTC calls, which are scoped to the room
+	caller   string
+	lifetime time.Duration
+}
+
+// pendingCall is a call whose pushes were sent to the devices of the callee, cancelled when the call
+// is answered, rejected or hung up, or when its lifetime expires.
+type pendingCall struct {
+	call   matrixCall
+	callee string
+	pushes []models.AcrobitsPushRequest
+	timer  *time.Timer
+}
+
+// callFromNotification returns the call rung by a notification, or nil for other events.
+func callFromNotification(n models.MatrixNotification) *matrixCall {
+	call := &matrixCall{roomID: n.RoomID, caller: n.Sender, lifetime: defaultCallLifetime}
+	callID, _ := n.Content["call_id"].(string)
+	switch n.Type {
+	case event.CallInvite.Type:
+		call.callID = callID
+	case eventCallNotify, eventCallNotifyUnstable:
+		if notifyType, _ := n.Content["notify_type"].(string); notifyType != "ring" {
+			return nil
+		}
+		call.callID = callID
+	case eventRTCNotification:
+		if notificationType, _ := n.Content["notification_type"].(string); notificationType != "ring" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if lifetime, ok := n.Content["lifetime"].(float64); ok && lifetime > 0 {
+		call.lifetime = time.Duration(lifetime) * time.Millisecond
+	}
+	return call
+}
+
+// translateCallToAcrobits builds the call push of a ringing call, sent with the calls token of the device.
+func (s *PushService) translateCallToAcrobits(n models.MatrixNotification, token *db.PushToken) *models.AcrobitsPushRequest {
+	req := models.AcrobitsPushRequest{
+		Verb:        acrobitsVerbIncomingCall,
+		AppID:       token.AppIDCalls,
+		DeviceToken: token.TokenCalls,
+		Selector:    token.Selector,
+		UserName:    n.Sender,
+	}
+	req.UserDisplayName = n.SenderDisplayName
+	if req.UserDisplayName == "" {
+		req.UserDisplayName = n.Sender
+	}
+	req.ID = n.EventID
+	req.ThreadID = n.RoomID
+	return &req
+}
+
+// ringDevicesWithoutPusher rings the devices of the callee that reported only a calls token: without a
+// messages token they have no pusher, so the homeserver never notifies them. The other devices get the
+// notification through their own pusher. It returns the call pushes queued, which expire at expiresAt.
+func (s *PushService) ringDevicesWithoutPusher(n models.MatrixNotification, call matrixCall, callee string, expiresAt *time.Time) []models.AcrobitsPushRequest {
+	if callee == "" || s.pushTokenDB == nil {
+		return nil
+	}
+	tokens, err := s.pushTokenDB.ListPushTokensByUser(callee)
+	if err != nil {
+		logger.Error().Str("callee", callee).Err(err).Msg("failed to list the devices of the callee")
+		return nil
+	}
+
+	var pushes []models.AcrobitsPushRequest
+	for _, token := range tokens {
+		// Each pusher of the callee notifies the call: ring these devices only once
+		if token.TokenMsgs != "" || token.TokenCalls == "" || s.callRinging(call, callee, n.EventID, token.Selector) {
+			continue
+		}
+		callReq := s.translateCallToAcrobits(n, token)
+		if err := s.enqueuePush(token.TokenCalls, callReq, expiresAt); err != nil {
+			logger.Error().Str("selector", token.Selector).Str("event_id", n.EventID).Err(err).Msg("failed to queue call push")
+			continue
+		}
+		pushes = append(pushes, *callReq)
+	}
+	return pushes
+}
+
+// callRinging reports whether the invite eventID already rang the device of selector.
+func (s *PushService) callRinging(call matrixCall, callee, eventID, selector string) bool {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	pending, ok := s.calls[callKey(call, callee)]
+	if !ok {
+		return false
+	}
+	for _, push := range pending.pushes {
+		if push.ID == eventID && push.Selector == selector {
+			return true
+		}
+	}
+	return false
+}
+
+func callKey(call matrixCall, callee string) string {
+	return call.roomID + "|" + call.callID + "|" + callee
+}
+
+// trackCall remembers the pushes queued for a call, to cancel them later. The call is cancelled as missed
+// once its lifetime expires. The pushes of the other pushers of the callee are added to the call.
+func (s *PushService) trackCall(call matrixCall, callee string, pushes []models.AcrobitsPushRequest) {
+	key := callKey(call, callee)
+	pending := &pendingCall{call: call, callee: callee, pushes: pushes}
+
+	s.callsMu.Lock()
+	if previous, ok := s.calls[key]; ok {
+		if len(previous.pushes) > 0 && previous.pushes[0].ID == pushes[0].ID {
+			previous.pushes = append(previous.pushes, pushes...)
+			s.callsMu.Unlock()
+			return
+		}
+		// A new invite for the same call rings again
+		previous.timer.Stop()
+	}
+	pending.timer = time.AfterFunc(call.lifetime, func() {
+		s.cancelCalls(func(p *pendingCall) bool { return p == pending }, callCancelMissed)
+	})
+	s.calls[key] = pending
+	s.callsMu.Unlock()
+
+	logger.Debug().Str("room_id", call.roomID).Str("call_id", call.callID).Str("callee", callee).Dur("lifetime", call.lifetime).Msg("tracking ringing call")
+}
+
+// HandleCallEvents cancels the pushes of the ringing calls answered, rejected or hung up by the events
+// of an Application Service transaction.
+func (s *PushService) HandleCallEvents(events []*event.Event) {
+	for _, evt := range events {
+		if evt == nil || evt.RoomID == "" {
+			continue
+		}
+		roomID, sender := string(evt.RoomID), string(evt.Sender)
+		callID, _ := evt.Content.Raw["call_id"].(string)
+		sameCall := func(p *pendingCall) bool { return p.call.roomID == roomID && p.call.callID == callID }
+
+		switch evt.Type.Type {
+		case event.CallAnswer.Type, event.CallSelectAnswer.Type:
+			s.cancelCalls(sameCall, callCancelAnswered)
+		case event.CallReject.Type:
+			s.cancelCalls(sameCall, callCancelRejected)
+		case event.CallHangup.Type:
+			s.cancelCalls(sameCall, callCancelHangup)
+		case eventRTCDecline:
+			s.cancelCalls(func(p *pendingCall) bool {
+				return p.call.roomID == roomID && p.call.callID == "" && p.callee == sender
+			}, callCancelRejected)
+		case eventCallMember, eventCallMemberUnstable:
+			if callMemberJoined(evt) {
+				// The callee joined the call from another client
+				s.cancelCalls(func(p *pendingCall) bool {
+					return p.call.roomID == roomID && p.call.callID == "" && p.callee == sender
+				}, callCancelAnswered)
+			} else {
+				// The caller left the call before anyone answered
+				s.cancelCalls(func(p *pendingCall) bool {
+					return p.call.roomID == roomID && p.call.callID == "" && p.call.caller == sender
+				}, callCancelHangup)
+			}
+		}
+	}
+}
+
+// callMemberJoined reports whether a call member state event means its sender is in the call:
+// leaving the call empties the content, or the memberships of the legacy format.
+func callMemberJoined(evt *event.Event) bool {
+	if len(evt.Content.Raw) == 0 {
+		return false
+	}
+	if memberships, ok := evt.Content.Raw["memberships"].([]interface{}); ok {
+		return len(memberships) > 0
+	}
+	return true
+}
+
+// cancelCalls stops tracking the calls matching match and queues the cancellation pushes of their devices.
+func (s *PushService) cancelCalls(match func(*pendingCall) bool, reason string) {
+	var cancelled []*pendingCall
+	s.callsMu.Lock()
+	for key, pending := range s.calls {
+		if match(pending) {
+			pending.timer.Stop()
+			delete(s.calls, key)
+			cancelled = append(cancelled, pending)
+		}
+	}
+	s.callsMu.Unlock()
+
+	for _, pending := range cancelled {
+		for _, push := range pending.pushes {
+			// A ring still waiting for its delivery is dropped, the cancellation is sent anyway in case it is in flight
+			if _, err := s.pushTokenDB.CancelPushDeliveries(acrobitsVerbIncomingCall, push.ID, push.DeviceToken); err != nil {
+				logger.Warn().Str("selector", push.Selector).Str("room_id", pending.call.roomID).Err(err).Msg("failed to drop the pending call push")
+			}
+			push.Verb = acrobitsVerbCancelCall
+			if err := s.enqueuePush(push.DeviceToken, &push, nil); err != nil {
+				logger.Error().Str("selector", push.Selector).Str("room_id", pending.call.roomID).Str("reason", reason).Err(err).Msg("failed to queue call cancellation")
+				continue
+			}
+			logger.Info().
+				Str("selector", push.Selector).
+				Str("room_id", pending.call.roomID).
+				Str("call_id", pending.call.callID).
+				Str("callee", pending.callee).
+				Str("reason", reason).
+				Msg("call cancellation queued")
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// newCallPushService returns a push service in record mode, with a device of @bob with a calls token,
+// and a device of @carol with only a messages token.
+func newCallPushService(t *testing.T) *PushService {
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pushTokenDB.Close() })
+	require.NoError(t, pushTokenDB.SavePushToken("bob-selector", "@bob:example.org", "", "bob-msgs", "com.acrobits.msgs", "bob-calls", "com.acrobits.calls"))
+	require.NoError(t, pushTokenDB.SavePushToken("carol-selector", "@carol:example.org", "", "carol-msgs", "com.acrobits.msgs", "", ""))
+
+	cfg := NewTestConfig()
+	cfg.PushRecordMode = PushRecordMemory
+	return NewPushService(nil, pushTokenDB, cfg)
+}
+
+func callInvite(pushkey string, lifetime int) *models.MatrixPushNotifyRequest {
+	return &models.MatrixPushNotifyRequest{
+		Notification: models.MatrixNotification{
+			Type:              "m.call.invite",
+			Content:           map[string]interface{}{"call_id": "call1", "lifetime": float64(lifetime), "version": "1"},
+			Devices:           []models.MatrixDevice{{AppID: "com.acrobits.msgs", Pushkey: pushkey}},
+			EventID:           "$invite",
+			RoomID:            "!room:example.org",
+			Sender:            "@alice:example.org",
+			SenderDisplayName: "Alice",
+		},
+	}
+}
+
+// recordedVerbs delivers the queued pushes, and returns the verbs of the pushes recorded.
+func recordedVerbs(t *testing.T, s *PushService) []string {
+	deliverAll(s)
+	pushes, err := s.RecordedPushes()
+	require.NoError(t, err)
+	verbs := make([]string, 0, len(pushes))
+	for _, push := range pushes {
+		verbs = append(verbs, push.Request.Verb)
+	}
+	return verbs
+}
+
+func TestCallFromNotification(t *testing.T) {
+	call := callFromNotification(models.MatrixNotification{Type: "m.call.invite", RoomID: "!room:example.org", Sender: "@alice:example.org", Content: map[string]interface{}{"call_id": "c1", "lifetime": float64(30000)}})
+	require.NotNil(t, call)
+	assert.Equal(t, "c1", call.callID)
+	assert.Equal(t, 30*time.Second, call.lifetime)
+	assert.Equal(t, "@alice:example.org", call.caller)
+
+	call = callFromNotification(models.MatrixNotification{Type: eventRTCNotification, Content: map[string]interface{}{"notification_type": "ring"}})
+	require.NotNil(t, call)
+	assert.Empty(t, call.callID)
+	assert.Equal(t, defaultCallLifetime, call.lifetime)
+
+	assert.NotNil(t, callFromNotification(models.MatrixNotification{Type: eventCallNotifyUnstable, Content: map[string]interface{}{"notify_type": "ring"}}))
+	assert.Nil(t, callFromNotification(models.MatrixNotification{Type: eventCallNotify, Content: map[string]interface{}{"notify_type": "notify"}}))
+	assert.Nil(t, callFromNotification(models.MatrixNotification{Type: "m.room.message", Content: map[string]interface{}{"body": "hi"}}))
+}
+
+func TestHandleMatrixPushNotification_Call(t *testing.T) {
+	t.Run("invite rings the calls token", func(t *testing.T) {
+		s := newCallPushService(t)
+		resp, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", callInvite("bob-msgs", 60000))
+		require.NoError(t, err)
+		assert.Empty(t, resp.Rejected)
+		assert.Equal(t, 2, deliverAll(s))
+
+		pushes, err := s.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 1)
+		push := pushes[0].Request
+		assert.Equal(t, acrobitsVerbIncomingCall, push.Verb)
+		assert.Equal(t, "bob-calls", push.DeviceToken)
+		assert.Equal(t, "com.acrobits.calls", push.AppID)
+		assert.Equal(t, "bob-selector", push.Selector)
+		assert.Equal(t, "Alice", push.UserDisplayName)
+		assert.Equal(t, "$invite", push.ID)
+
+		// The hangup cancels the call, only once
+		hangup := &event.Event{Type: event.CallHangup, RoomID: "!room:example.org", Sender: "@alice:example.org", Content: event.Content{Raw: map[string]interface{}{"call_id": "call1"}}}
+		s.HandleCallEvents([]*event.Event{hangup})
+		s.HandleCallEvents([]*event.Event{hangup})
+		assert.Equal(t, 1, deliverAll(s))
+		pushes, err = s.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 2)
+		assert.Equal(t, acrobitsVerbCancelCall, pushes[1].Request.Verb)
+		assert.Equal(t, "bob-calls", pushes[1].Request.DeviceToken)
+		assert.Equal(t, "$invite", pushes[1].Request.ID)
+	})
+
+	t.Run("unanswered call is cancelled as missed", func(t *testing.T) {
+		s := newCallPushService(t)
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", callInvite("bob-msgs", 50))
+		require.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			verbs := recordedVerbs(t, s)
+			return len(verbs) == 2 && verbs[1] == acrobitsVerbCancelCall
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("other calls are not cancelled", func(t *testing.T) {
+		s := newCallPushService(t)
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", callInvite("bob-msgs", 60000))
+		require.NoError(t, err)
+
+		s.HandleCallEvents([]*event.Event{
+			{Type: event.CallHangup, RoomID: "!room:example.org", Content: event.Content{Raw: map[string]interface{}{"call_id": "call2"}}},
+			{Type: event.CallHangup, RoomID: "!other:example.org", Content: event.Content{Raw: map[string]interface{}{"call_id": "call1"}}},
+			{Type: event.EventMessage, RoomID: "!room:example.org", Content: event.Content{Raw: map[string]interface{}{"call_id": "call1"}}},
+		})
+		assert.Equal(t, []string{acrobitsVerbIncomingCall}, recordedVerbs(t, s))
+	})
+
+	t.Run("device without calls token gets a message", func(t *testing.T) {
+		s := newCallPushService(t)
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@carol:example.org", callInvite("carol-msgs", 60000))
+		require.NoError(t, err)
+		assert.Equal(t, 2, deliverAll(s))
+
+		pushes, err := s.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 1)
+		assert.Equal(t, "NotifyTextMessage", pushes[0].Request.Verb)
+		assert.Equal(t, "carol-msgs", pushes[0].Request.DeviceToken)
+		assert.Equal(t, "Incoming call", pushes[0].Request.Message)
+	})
+
+	t.Run("hangup drops the pending ring", func(t *testing.T) {
+		s := newCallPushService(t)
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", callInvite("bob-msgs", 60000))
+		require.NoError(t, err)
+		// The notification is turned into a ring, not sent yet
+		require.Equal(t, 1, s.deliverQueued(context.Background()))
+
+		s.HandleCallEvents([]*event.Event{{Type: event.CallHangup, RoomID: "!room:example.org", Content: event.Content{Raw: map[string]interface{}{"call_id": "call1"}}}})
+		assert.Equal(t, []string{acrobitsVerbCancelCall}, recordedVerbs(t, s))
+	})
+
+	t.Run("call is not rung after its lifetime", func(t *testing.T) {
+		s := newCallPushService(t)
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", callInvite("bob-msgs", 20))
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond)
+		assert.Empty(t, recordedVerbs(t, s))
+	})
+
+	t.Run("ring expires in the queue", func(t *testing.T) {
+		s := newCallPushService(t)
+		expiresAt := time.Now().Add(-time.Second)
+		require.NoError(t, s.enqueuePush("bob-calls", &models.AcrobitsPushRequest{Verb: acrobitsVerbIncomingCall, ID: "$invite", DeviceToken: "bob-calls"}, &expiresAt))
+		assert.Empty(t, recordedVerbs(t, s))
+
+		cancelled, err := s.pushTokenDB.ListPushDeliveries(db.PushDeliveryCancelled, 10)
+		require.NoError(t, err)
+		require.Len(t, cancelled, 1)
+		assert.Equal(t, "expired", cancelled[0].LastError)
+	})
+}
+
+func TestHandleCallEvents_MatrixRTC(t *testing.T) {
+	ring := func(s *PushService) {
+		req := callInvite("bob-msgs", 60000)
+		req.Notification.Type = eventRTCNotification
+		req.Notification.Content = map[string]interface{}{"notification_type": "ring"}
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", req)
+		require.NoError(t, err)
+		deliverAll(s)
+	}
+	member := func(sender id.UserID, content map[string]interface{}) *event.Event {
+		stateKey := "_" + string(sender)
+		return &event.Event{Type: event.Type{Type: eventCallMember, Class: event.StateEventType}, StateKey: &stateKey, RoomID: "!room:example.org", Sender: sender, Content: event.Content{Raw: content}}
+	}
+
+	t.Run("callee joins from another client", func(t *testing.T) {
+		s := newCallPushService(t)
+		ring(s)
+		s.HandleCallEvents([]*event.Event{member("@bob:example.org", map[string]interface{}{"application": "m.call"})})
+		assert.Equal(t, []string{acrobitsVerbIncomingCall, acrobitsVerbCancelCall}, recordedVerbs(t, s))
+	})
+
+	t.Run("caller leaves", func(t *testing.T) {
+		s := newCallPushService(t)
+		ring(s)
+		// Another member leaving does not end the call
+		s.HandleCallEvents([]*event.Event{member("@dave:example.org", map[string]interface{}{})})
+		assert.Equal(t, []string{acrobitsVerbIncomingCall}, recordedVerbs(t, s))
+
+		s.HandleCallEvents([]*event.Event{member("@alice:example.org", map[string]interface{}{"memberships": []interface{}{}})})
+		assert.Equal(t, []string{acrobitsVerbIncomingCall, acrobitsVerbCancelCall}, recordedVerbs(t, s))
+	})
+
+	t.Run("callee declines", func(t *testing.T) {
+		s := newCallPushService(t)
+		ring(s)
+		s.HandleCallEvents([]*event.Event{{Type: event.Type{Type: eventRTCDecline}, RoomID: "!room:example.org", Sender: "@bob:example.org", Content: event.Content{Raw: map[string]interface{}{}}}})
+		assert.Equal(t, []string{acrobitsVerbIncomingCall, acrobitsVerbCancelCall}, recordedVerbs(t, s))
+	})
+}
+
+func TestHandleMatrixPushNotification_CallFanOut(t *testing.T) {
+	s := newCallPushService(t)
+	// A second mobile of @bob, with its own pusher, and a desk phone reporting only a calls token
+	require.NoError(t, s.pushTokenDB.SavePushToken("bob-tablet", "@bob:example.org", "install2", "tablet-msgs", "com.acrobits.msgs", "tablet-calls", "com.acrobits.calls"))
+	require.NoError(t, s.pushTokenDB.SavePushToken("bob-desk", "@bob:example.org", "install3", "", "", "desk-calls", "com.acrobits.calls"))
+
+	// The homeserver notifies each pusher of @bob
+	for _, pushkey := range []string{"bob-msgs", "tablet-msgs"} {
+		_, err := s.HandleMatrixPushNotification(context.Background(), "@bob:example.org", callInvite(pushkey, 60000))
+		require.NoError(t, err)
+	}
+	deliverAll(s)
+
+	pushes, err := s.RecordedPushes()
+	require.NoError(t, err)
+	tokens := make([]string, 0, len(pushes))
+	for _, push := range pushes {
+		assert.Equal(t, acrobitsVerbIncomingCall, push.Request.Verb)
+		tokens = append(tokens, push.Request.DeviceToken)
+	}
+	assert.ElementsMatch(t, []string{"bob-calls", "desk-calls", "tablet-calls"}, tokens)
+
+	// The hangup stops every device
+	s.HandleCallEvents([]*event.Event{{Type: event.CallHangup, RoomID: "!room:example.org", Content: event.Content{Raw: map[string]interface{}{"call_id": "call1"}}}})
+	deliverAll(s)
+	pushes, err = s.RecordedPushes()
+	require.NoError(t, err)
+	require.Len(t, pushes, 6)
+	tokens = tokens[:0]
+	for _, push := range pushes[3:] {
+		assert.Equal(t, acrobitsVerbCancelCall, push.Request.Verb)
+		tokens = append(tokens, push.Request.DeviceToken)
+	}
+	assert.ElementsMatch(t, []string{"bob-calls", "desk-calls", "tablet-calls"}, tokens)
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/id"
+)
+
+// genericPushMessage replaces the message content in the pushes of users hiding it.
+const genericPushMessage = "New message"
+
+// prepareNotification returns the notification to deliver to the devices of userID, and the call it rings if any.
+// Pushers are registered with the event_id_only format, so the homeserver sends neither the event type and content
+// nor the sender display name: they are fetched as userID through the Application Service.
+// Users who chose to hide the content get a generic text, without the sender.
+func (s *PushService) prepareNotification(ctx context.Context, userID string, notification models.MatrixNotification) (models.MatrixNotification, *matrixCall) {
+	notification = s.fillNotification(ctx, userID, notification)
+	call := callFromNotification(notification)
+	if s.hideContent(userID) {
+		logger.Debug().Str("user_id", userID).Str("event_id", notification.EventID).Msg("push content hidden by user settings")
+		notification.Content = map[string]interface{}{"body": genericPushMessage, "msgtype": "m.text"}
+		notification.Sender = ""
+		notification.SenderDisplayName = ""
+	}
+	return notification, call
+}
+
+// fillNotification fetches the event of a notification without content, and the display name of its sender.
+func (s *PushService) fillNotification(ctx context.Context, userID string, notification models.MatrixNotification) models.MatrixNotification {
+	if notification.Content != nil || notification.EventID == "" || notification.RoomID == "" || userID == "" || s.matrixClient == nil {
+		return notification
+	}
+
+	evt, err := s.matrixClient.GetEvent(ctx, id.UserID(userID), id.RoomID(notification.RoomID), id.EventID(notification.EventID))
+	if err != nil {
+		logger.Warn().Str("user_id", userID).Str("event_id", notification.EventID).Err(err).Msg("failed to fetch the event of the push notification")
+		return notification
+	}
+	notification.Content = evt.Content.Raw
+	if notification.Type == "" {
+		notification.Type = evt.Type.Type
+	}
+	if notification.Sender == "" {
+		notification.Sender = string(evt.Sender)
+	}
+	if notification.SenderDisplayName == "" && evt.Sender != "" {
+		name, err := s.matrixClient.GetDisplayName(ctx, id.UserID(userID), evt.Sender)
+		if err != nil {
+			logger.Debug().Str("user_id", userID).Str("sender", string(evt.Sender)).Err(err).Msg("failed to fetch the sender display name of the push notification")
+		}
+		notification.SenderDisplayName = name
+	}
+	logger.Debug().Str("user_id", userID).Str("event_id", notification.EventID).Msg("push notification filled with the event content")
+	return notification
+}
+
+// hideContent reports whether userID asked for pushes without the message content.
+func (s *PushService) hideContent(userID string) bool {
+	if userID == "" || s.pushTokenDB == nil {
+		return false
+	}
+	hide, err := s.pushTokenDB.GetPushHideContent(userID)
+	if err != nil {
+		logger.Warn().Str("user_id", userID).Err(err).Msg("failed to read push settings, showing the content")
+		return false
+	}
+	return hide
+}
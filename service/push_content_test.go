@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPushContentService returns a push service whose homeserver serves the $ev event to @bob, and the profile of @alice.
+func newPushContentService(t *testing.T) (*PushService, *db.Database, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:example.com/event/$ev":
+			assert.Equal(t, "@bob:example.com", r.URL.Query().Get("user_id"))
+			_, _ = w.Write([]byte(`{"type":"m.room.message","event_id":"$ev","room_id":"!room:example.com","sender":"@alice:example.com","content":{"msgtype":"m.text","body":"Hello Bob"}}`))
+		case "/_matrix/client/v3/profile/@alice:example.com/displayname":
+			_, _ = w.Write([]byte(`{"displayname":"Alice (201)"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: server.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pushTokenDB.Close() })
+	return NewPushService(mc, pushTokenDB, NewTestConfig()), pushTokenDB, &requests
+}
+
+func TestPrepareNotification(t *testing.T) {
+	eventIDOnly := models.MatrixNotification{EventID: "$ev", RoomID: "!room:example.com", Counts: &models.MatrixCounts{Unread: 2}}
+
+	t.Run("event_id_only notification is filled", func(t *testing.T) {
+		svc, _, _ := newPushContentService(t)
+
+		n, _ := svc.prepareNotification(context.Background(), "@bob:example.com", eventIDOnly)
+		assert.Equal(t, "Hello Bob", n.Content["body"])
+		assert.Equal(t, "m.text", n.Content["msgtype"])
+		assert.Equal(t, "m.room.message", n.Type)
+		assert.Equal(t, "@alice:example.com", n.Sender)
+		assert.Equal(t, "Alice (201)", n.SenderDisplayName)
+
+		req := svc.translateToAcrobits(n, models.MatrixDevice{}, &db.PushToken{})
+		assert.Equal(t, "Hello Bob", req.Message)
+		assert.Equal(t, "Alice (201)", req.UserDisplayName)
+		require.NotNil(t, req.Badge)
+		assert.Equal(t, 2, *req.Badge)
+	})
+
+	t.Run("notification with content is not fetched", func(t *testing.T) {
+		svc, _, requests := newPushContentService(t)
+		full := eventIDOnly
+		full.Content = map[string]interface{}{"body": "Already here"}
+
+		n, _ := svc.prepareNotification(context.Background(), "@bob:example.com", full)
+		assert.Equal(t, "Already here", n.Content["body"])
+		assert.Zero(t, atomic.LoadInt32(requests))
+	})
+
+	t.Run("missing event leaves the notification unchanged", func(t *testing.T) {
+		svc, _, _ := newPushContentService(t)
+		missing := eventIDOnly
+		missing.EventID = "$gone"
+
+		n, _ := svc.prepareNotification(context.Background(), "@bob:example.com", missing)
+		assert.Nil(t, n.Content)
+		assert.Empty(t, n.Sender)
+	})
+
+	t.Run("hidden content", func(t *testing.T) {
+		svc, pushTokenDB, _ := newPushContentService(t)
+		require.NoError(t, pushTokenDB.SetPushHideContent("@bob:example.com", true))
+		withContent := eventIDOnly
+		withContent.Sender = "@alice:example.com"
+		withContent.Content = map[string]interface{}{"body": "Secret"}
+
+		for _, notification := range []models.MatrixNotification{eventIDOnly, withContent} {
+			n, _ := svc.prepareNotification(context.Background(), "@bob:example.com", notification)
+			req := svc.translateToAcrobits(n, models.MatrixDevice{}, &db.PushToken{})
+			assert.Equal(t, genericPushMessage, req.Message)
+			assert.Empty(t, req.UserName)
+			assert.Empty(t, req.UserDisplayName)
+			assert.Equal(t, "!room:example.com", req.ThreadID)
+		}
+	})
+}
+
+func TestHandleMatrixPushNotification_FilledByWorkers(t *testing.T) {
+	svc, pushTokenDB, requests := newPushContentService(t)
+	svc.recorder = newPushRecorder("")
+	require.NoError(t, pushTokenDB.SavePushToken("bob-selector", "@bob:example.com", "", "bob-msgs", "com.acrobits.msgs", "", ""))
+
+	req := &models.MatrixPushNotifyRequest{Notification: models.MatrixNotification{
+		EventID: "$ev",
+		RoomID:  "!room:example.com",
+		Devices: []models.MatrixDevice{{AppID: "com.acrobits.msgs", Pushkey: "bob-msgs"}},
+	}}
+	resp, err := svc.HandleMatrixPushNotification(context.Background(), "@bob:example.com", req)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Rejected)
+	// The homeserver is acknowledged before the event is fetched
+	assert.Zero(t, atomic.LoadInt32(requests))
+
+	assert.Equal(t, 2, deliverAll(svc))
+	pushes, err := svc.RecordedPushes()
+	require.NoError(t, err)
+	require.Len(t, pushes, 1)
+	assert.Equal(t, "Hello Bob", pushes[0].Request.Message)
+	assert.Equal(t, "Alice (201)", pushes[0].Request.UserDisplayName)
+}
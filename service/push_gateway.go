@@ -0,0 +1,115 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+)
+
+const (
+	pushGatewayPath = "/_matrix/push/v1/notify"
+	// Query parameters added to the pusher URL: the Matrix user the pusher belongs to and its signature
+	pushGatewayUserParam      = "user"
+	pushGatewaySignatureParam = "sig"
+)
+
+// Reasons counted when a push gateway request or device is refused.
+const (
+	PushFailureAddressNotAllowed = "address_not_allowed"
+	PushFailureMissingUser       = "missing_user"
+	PushFailureMissingSignature  = "missing_signature"
+	PushFailureInvalidSignature  = "invalid_signature"
+	PushFailureOwnerMismatch     = "owner_mismatch"
+)
+
+var ErrPushGatewayForbidden = errors.New("push gateway request not allowed")
+
+// pushGatewayURL builds the URL registered in the homeserver pusher of userID.
+// When a secret is configured, the URL carries an HMAC of the user so the homeserver call can be
+// authenticated and bound to the user the pusher was registered for.
+func pushGatewayURL(proxyURL, secret, userID string) string {
+	query := url.Values{}
+	query.Set(pushGatewayUserParam, userID)
+	if secret != "" {
+		query.Set(pushGatewaySignatureParam, signPushGatewayUser(secret, userID))
+	}
+	return strings.TrimSuffix(proxyURL, "/") + pushGatewayPath + "?" + query.Encode()
+}
+
+// signPushGatewayUser returns the HMAC-SHA256 signature of a Matrix user ID.
+func signPushGatewayUser(secret, userID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuthorizeGateway checks a push gateway request coming from remoteIP with the user and signature
+// taken from the pusher URL, and returns the notified Matrix user. The user is required: the devices
+// of the request are only notified when their push token belongs to it.
+func (s *PushService) AuthorizeGateway(remoteIP, userID, sig string) (string, error) {
+	if len(s.allowedNets) > 0 && !ipAllowed(s.allowedNets, remoteIP) {
+		return "", s.refuseGateway(PushFailureAddressNotAllowed, remoteIP, userID)
+	}
+	if userID == "" {
+		return "", s.refuseGateway(PushFailureMissingUser, remoteIP, userID)
+	}
+	if s.gatewaySecret == "" {
+		return userID, nil
+	}
+	if sig == "" {
+		return "", s.refuseGateway(PushFailureMissingSignature, remoteIP, userID)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signPushGatewayUser(s.gatewaySecret, userID))) {
+		return "", s.refuseGateway(PushFailureInvalidSignature, remoteIP, userID)
+	}
+	return userID, nil
+}
+
+// GatewayFailures returns how many push gateway requests or devices were refused, by reason.
+func (s *PushService) GatewayFailures() map[string]uint64 {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	failures := make(map[string]uint64, len(s.failures))
+	for reason, count := range s.failures {
+		failures[reason] = count
+	}
+	return failures
+}
+
+// refuseGateway logs and counts a refused push gateway request.
+func (s *PushService) refuseGateway(reason, remoteIP, userID string) error {
+	logger.Warn().Str("reason", reason).Str("remote_ip", remoteIP).Str("user_id", userID).Msg("push gateway request refused")
+	s.countFailure(reason)
+	return ErrPushGatewayForbidden
+}
+
+// countFailure counts a refused push gateway request or device.
+func (s *PushService) countFailure(reason string) {
+	s.failuresMu.Lock()
+	s.failures[reason]++
+	s.failuresMu.Unlock()
+}
+
+// ipAllowed reports whether the address, with or without port, belongs to one of the networks.
+func ipAllowed(nets []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
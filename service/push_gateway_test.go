@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushGatewayURL(t *testing.T) {
+	t.Run("without secret", func(t *testing.T) {
+		u, err := url.Parse(pushGatewayURL("https://proxy.example.com/", "", "@alice:example.com"))
+		require.NoError(t, err)
+		assert.Equal(t, "/_matrix/push/v1/notify", u.Path)
+		assert.Equal(t, "@alice:example.com", u.Query().Get("user"))
+		assert.Empty(t, u.Query().Get("sig"))
+	})
+
+	t.Run("with secret", func(t *testing.T) {
+		u, err := url.Parse(pushGatewayURL("https://proxy.example.com", "secret", "@alice:example.com"))
+		require.NoError(t, err)
+		assert.Equal(t, signPushGatewayUser("secret", "@alice:example.com"), u.Query().Get("sig"))
+		assert.NotEqual(t, signPushGatewayUser("secret", "@bob:example.com"), u.Query().Get("sig"))
+	})
+}
+
+func TestAuthorizeGateway(t *testing.T) {
+	cfg := NewTestConfig()
+	cfg.PushGatewayAllowedNets = parseAllowedNets("10.0.0.0/8, 192.168.1.5, not-an-ip")
+	cfg.PushGatewaySecret = "secret"
+	svc := NewPushService(nil, nil, cfg)
+	sig := signPushGatewayUser("secret", "@alice:example.com")
+
+	userID, err := svc.AuthorizeGateway("10.1.2.3", "@alice:example.com", sig)
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", userID)
+
+	_, err = svc.AuthorizeGateway("192.168.1.5:4321", "@alice:example.com", sig)
+	assert.NoError(t, err)
+
+	_, err = svc.AuthorizeGateway("192.168.1.6", "@alice:example.com", sig)
+	assert.ErrorIs(t, err, ErrPushGatewayForbidden)
+
+	_, err = svc.AuthorizeGateway("10.1.2.3", "@alice:example.com", "")
+	assert.ErrorIs(t, err, ErrPushGatewayForbidden)
+
+	_, err = svc.AuthorizeGateway("10.1.2.3", "@bob:example.com", sig)
+	assert.ErrorIs(t, err, ErrPushGatewayForbidden)
+
+	assert.Equal(t, map[string]uint64{
+		PushFailureAddressNotAllowed: 1,
+		PushFailureMissingSignature:  1,
+		PushFailureInvalidSignature:  1,
+	}, svc.GatewayFailures())
+
+	t.Run("open gateway", func(t *testing.T) {
+		svc := NewPushService(nil, nil, NewTestConfig())
+		userID, err := svc.AuthorizeGateway("203.0.113.1", "@alice:example.com", "")
+		require.NoError(t, err)
+		assert.Equal(t, "@alice:example.com", userID)
+
+		// Without the user the ownership of the pushkeys cannot be checked
+		_, err = svc.AuthorizeGateway("203.0.113.1", "", "")
+		assert.ErrorIs(t, err, ErrPushGatewayForbidden)
+		assert.Equal(t, uint64(1), svc.GatewayFailures()[PushFailureMissingUser])
+	})
+}
+
+func TestHandleMatrixPushNotification_OwnerMismatch(t *testing.T) {
+	tmpDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer tmpDB.Close()
+	require.NoError(t, tmpDB.SavePushToken("bob-selector", "@bob:example.com", "", "bob-token", "com.acrobits.app", "", ""))
+	// Saved before the tokens were bound to a user
+	require.NoError(t, tmpDB.SavePushToken("legacy-selector", "", "", "legacy-token", "com.acrobits.app", "", ""))
+
+	svc := NewPushService(nil, tmpDB, NewTestConfig())
+	req := &models.MatrixPushNotifyRequest{
+		Notification: models.MatrixNotification{
+			EventID: "$event",
+			Devices: []models.MatrixDevice{{AppID: "com.acrobits.app", Pushkey: "bob-token"}, {AppID: "com.acrobits.app", Pushkey: "legacy-token"}},
+		},
+	}
+
+	resp, err := svc.HandleMatrixPushNotification(context.Background(), "@alice:example.com", req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob-token"}, resp.Rejected)
+	assert.Equal(t, uint64(1), svc.GatewayFailures()[PushFailureOwnerMismatch])
+
+	// The ownerless token is bound to the user of the pusher, and no longer accepted for others
+	token, err := tmpDB.GetPushToken("legacy-selector")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", token.UserID)
+	resp, err = svc.HandleMatrixPushNotification(context.Background(), "@bob:example.com", req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy-token"}, resp.Rejected)
+}
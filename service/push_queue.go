@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+const (
+	// Backoff before the second attempt of a delivery, doubled at each failure up to maxPushRetryBackoff
+	defaultPushRetryBackoff = 5 * time.Second
+	maxPushRetryBackoff     = 10 * time.Minute
+	// Claimed deliveries are due again after the lease, when the worker holding them died: longer than a PNM request
+	pushDeliveryLease = 2 * time.Minute
+	// Deliveries claimed at once by a worker
+	pushDeliveryBatch = 20
+	// Workers also look for due retries at this interval
+	pushQueuePollInterval = 5 * time.Second
+	// Finished deliveries are kept for this long, for deduplication and inspection
+	pushDeliveryRetention  = 7 * 24 * time.Hour
+	pushDeliveryPruneEvery = time.Hour
+)
+
+// errMalformedDelivery is returned for the deliveries whose request cannot be decoded: retrying does not help.
+var errMalformedDelivery = errors.New("malformed push delivery")
+
+// queuedNotification is a notification received from the homeserver for one device of UserID,
+// turned into pushes by the delivery workers.
+type queuedNotification struct {
+	UserID       string                    `json:"user_id"`
+	Notification models.MatrixNotification `json:"notification"`
+}
+
+// enqueueNotification queues the notification of the homeserver for device, so the homeserver is acknowledged
+// without waiting for the event, the sender profile or the PNM. The notification of an event is queued once per
+// pushkey, so the notifications retried by the homeserver are not pushed twice.
+func (s *PushService) enqueueNotification(userID string, n models.MatrixNotification, device models.MatrixDevice) error {
+	n.Devices = []models.MatrixDevice{device}
+	body, err := json.Marshal(queuedNotification{UserID: userID, Notification: n})
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	return s.enqueueDelivery(&db.PushDelivery{Kind: db.PushDeliveryNotification, EventID: n.EventID, Pushkey: device.Pushkey, Request: string(body)})
+}
+
+// enqueuePush queues a push to the Acrobits PNM for pushkey, the device token of the push, not sent after
+// expiresAt when set. The push of an event is queued once per verb and pushkey.
+func (s *PushService) enqueuePush(pushkey string, req *models.AcrobitsPushRequest, expiresAt *time.Time) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal acrobits request: %w", err)
+	}
+	return s.enqueueDelivery(&db.PushDelivery{Kind: req.Verb, EventID: req.ID, Pushkey: pushkey, Request: string(body), ExpiresAt: expiresAt})
+}
+
+// enqueueDelivery stores a delivery for the workers started by Start, and wakes one of them.
+func (s *PushService) enqueueDelivery(delivery *db.PushDelivery) error {
+	queued, err := s.pushTokenDB.EnqueuePushDelivery(delivery)
+	if err != nil {
+		return err
+	}
+	if !queued {
+		logger.Debug().Str("kind", delivery.Kind).Str("pushkey", delivery.Pushkey).Str("event_id", delivery.EventID).Msg("push already queued, skipping duplicate")
+		return nil
+	}
+	logger.Debug().Str("kind", delivery.Kind).Str("pushkey", delivery.Pushkey).Str("event_id", delivery.EventID).Msg("push queued for delivery")
+
+	// Wake a worker, the others poll
+	select {
+	case s.queueWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start starts the workers delivering the queued pushes, until ctx is done.
+func (s *PushService) Start(ctx context.Context) {
+	if s.pushTokenDB == nil {
+		logger.Warn().Msg("push token database not available, push delivery queue not started")
+		return
+	}
+	logger.Info().Int("workers", s.queueWorkers).Int("max_attempts", s.maxAttempts).Msg("starting push delivery workers")
+	for i := 0; i < s.queueWorkers; i++ {
+		go s.runQueueWorker(ctx)
+	}
+}
+
+func (s *PushService) runQueueWorker(ctx context.Context) {
+	ticker := time.NewTicker(pushQueuePollInterval)
+	defer ticker.Stop()
+	for {
+		// Drain the due deliveries before waiting
+		for ctx.Err() == nil {
+			if s.deliverQueued(ctx) == 0 {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.queueWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverQueued attempts a batch of due deliveries and returns how many were attempted.
+func (s *PushService) deliverQueued(ctx context.Context) int {
+	s.prunePushDeliveries()
+
+	deliveries, err := s.pushTokenDB.ClaimPushDeliveries(time.Now(), pushDeliveryBatch, pushDeliveryLease)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to claim queued pushes")
+		return 0
+	}
+	for _, delivery := range deliveries {
+		s.attemptDelivery(ctx, delivery)
+	}
+	return len(deliveries)
+}
+
+// attemptDelivery turns a queued notification into pushes, or sends a queued push, and records the outcome:
+// delivered, rejected when the PNM does not know the device token, cancelled when expired, dead after
+// maxAttempts failures, or pending until the next attempt.
+func (s *PushService) attemptDelivery(ctx context.Context, delivery *db.PushDelivery) {
+	attempts := delivery.Attempts + 1
+	status, next, lastError := db.PushDeliveryDelivered, time.Now(), ""
+
+	var err error
+	switch {
+	case delivery.ExpiresAt != nil && next.After(*delivery.ExpiresAt):
+		status, lastError = db.PushDeliveryCancelled, "expired"
+		logger.Info().Str("kind", delivery.Kind).Str("pushkey", delivery.Pushkey).Str("event_id", delivery.EventID).Msg("push expired before delivery, dropped")
+	case delivery.Kind == db.PushDeliveryNotification:
+		err = s.deliverNotification(ctx, delivery)
+	default:
+		err = s.deliverPush(ctx, delivery)
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrPushTokenNotFound):
+		status, lastError = db.PushDeliveryRejected, err.Error()
+		logger.Warn().Str("pushkey", delivery.Pushkey).Str("event_id", delivery.EventID).Msg("push token not found by Acrobits, pushkey rejected")
+	case errors.Is(err, errMalformedDelivery) || attempts >= s.maxAttempts:
+		status, lastError = db.PushDeliveryDead, err.Error()
+		logger.Error().Str("kind", delivery.Kind).Str("pushkey", delivery.Pushkey).Str("event_id", delivery.EventID).Int("attempts", attempts).Err(err).Msg("push notification dropped, no more attempts")
+	default:
+		status, lastError = db.PushDeliveryPending, err.Error()
+		next = next.Add(s.pushRetryBackoff(attempts))
+		logger.Warn().Str("kind", delivery.Kind).Str("pushkey", delivery.Pushkey).Str("event_id", delivery.EventID).Int("attempts", attempts).Time("next_attempt_at", next).Err(err).Msg("failed to deliver push notification, retrying later")
+	}
+
+	if err := s.pushTokenDB.UpdatePushDelivery(delivery.ID, status, attempts, next, lastError); err != nil {
+		logger.Error().Int64("delivery_id", delivery.ID).Err(err).Msg("failed to update queued push")
+	}
+}
+
+// deliverPush sends a queued push to the Acrobits PNM.
+func (s *PushService) deliverPush(ctx context.Context, delivery *db.PushDelivery) error {
+	var req models.AcrobitsPushRequest
+	if err := json.Unmarshal([]byte(delivery.Request), &req); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedDelivery, err)
+	}
+	if err := s.sendToAcrobits(ctx, &req); err != nil {
+		return err
+	}
+	logger.Info().Str("verb", req.Verb).Str("pushkey", delivery.Pushkey).Str("selector", req.Selector).Str("event_id", delivery.EventID).Int("attempts", delivery.Attempts+1).Msg("push notification sent successfully to Acrobits")
+	return nil
+}
+
+// deliverNotification turns a queued notification into the pushes of its device, see pushNotification.
+func (s *PushService) deliverNotification(ctx context.Context, delivery *db.PushDelivery) error {
+	var queued queuedNotification
+	if err := json.Unmarshal([]byte(delivery.Request), &queued); err != nil || len(queued.Notification.Devices) != 1 {
+		return fmt.Errorf("%w: %v", errMalformedDelivery, err)
+	}
+	return s.pushNotification(ctx, queued.UserID, queued.Notification, delivery.CreatedAt)
+}
+
+// pushRetryBackoff returns the wait after the given number of failed attempts.
+func (s *PushService) pushRetryBackoff(attempts int) time.Duration {
+	backoff := s.retryBackoff
+	for i := 1; i < attempts && backoff < maxPushRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxPushRetryBackoff {
+		backoff = maxPushRetryBackoff
+	}
+	return backoff
+}
+
+// prunePushDeliveries removes the finished deliveries older than pushDeliveryRetention, at most once per pushDeliveryPruneEvery.
+func (s *PushService) prunePushDeliveries() {
+	now := time.Now()
+	s.pruneMu.Lock()
+	if now.Sub(s.lastDeliveryPrune) < pushDeliveryPruneEvery {
+		s.pruneMu.Unlock()
+		return
+	}
+	s.lastDeliveryPrune = now
+	s.pruneMu.Unlock()
+
+	pruned, err := s.pushTokenDB.PrunePushDeliveries(now.Add(-pushDeliveryRetention))
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to prune push deliveries")
+		return
+	}
+	if pruned > 0 {
+		logger.Info().Int64("pruned", pruned).Msg("pruned finished push deliveries")
+	}
+}
+
+// DeadPushDeliveries returns the latest pushes dropped after too many failed attempts.
+func (s *PushService) DeadPushDeliveries(limit int) ([]*db.PushDelivery, error) {
+	if s.pushTokenDB == nil {
+		return nil, errors.New("push token database not available")
+	}
+	return s.pushTokenDB.ListPushDeliveries(db.PushDeliveryDead, limit)
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newQueuePushService returns a push service sending to a mock PNM that answers with the code stored in pnmCode.
+func newQueuePushService(t *testing.T, pnmCode *atomic.Int32, sent *atomic.Int32) (*PushService, *db.Database) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(models.AcrobitsPushResponse{Code: int(pnmCode.Load()), Response: "test"})
+	}))
+	t.Cleanup(mockServer.Close)
+
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = pushTokenDB.Close() })
+	require.NoError(t, pushTokenDB.SavePushToken("bob-selector", "@bob:example.org", "", "bob-msgs", "com.acrobits.msgs", "", ""))
+
+	cfg := NewTestConfig()
+	cfg.PNMURL = mockServer.URL
+	cfg.PushMaxAttempts = 3
+	s := NewPushService(nil, pushTokenDB, cfg)
+	s.retryBackoff = time.Millisecond
+	return s, pushTokenDB
+}
+
+// deliverAll runs the delivery workers until no delivery is due, and returns how many deliveries were attempted:
+// the queued notifications and the pushes they queued.
+func deliverAll(s *PushService) int {
+	attempted := 0
+	for {
+		n := s.deliverQueued(context.Background())
+		if n == 0 {
+			return attempted
+		}
+		attempted += n
+	}
+}
+
+func textNotification(eventID string) *models.MatrixPushNotifyRequest {
+	return &models.MatrixPushNotifyRequest{
+		Notification: models.MatrixNotification{
+			Content: map[string]interface{}{"body": "Hello", "msgtype": "m.text"},
+			Devices: []models.MatrixDevice{{AppID: "com.acrobits.msgs", Pushkey: "bob-msgs"}},
+			EventID: eventID,
+			RoomID:  "!room:example.org",
+			Sender:  "@alice:example.org",
+		},
+	}
+}
+
+func TestPushQueue(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("duplicate notifications are pushed once", func(t *testing.T) {
+		var pnmCode, sent atomic.Int32
+		pnmCode.Store(200)
+		s, _ := newQueuePushService(t, &pnmCode, &sent)
+
+		for i := 0; i < 2; i++ {
+			resp, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", textNotification("$ev1"))
+			require.NoError(t, err)
+			assert.Empty(t, resp.Rejected)
+		}
+		// Nothing is sent before the workers run
+		assert.Equal(t, int32(0), sent.Load())
+		// The notification, then its push
+		assert.Equal(t, 2, deliverAll(s))
+		assert.Equal(t, int32(1), sent.Load())
+	})
+
+	t.Run("failed pushes are retried then dead-lettered", func(t *testing.T) {
+		var pnmCode, sent atomic.Int32
+		pnmCode.Store(500)
+		s, _ := newQueuePushService(t, &pnmCode, &sent)
+
+		_, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", textNotification("$ev1"))
+		require.NoError(t, err)
+
+		// The notification, then the first attempt of its push: the retries are due quickly
+		assert.Equal(t, 1, s.deliverQueued(ctx))
+		assert.Equal(t, 1, s.deliverQueued(ctx))
+		for attempt := 2; attempt <= 3; attempt++ {
+			time.Sleep(10 * time.Millisecond)
+			assert.Equal(t, 1, s.deliverQueued(ctx))
+		}
+		assert.Equal(t, int32(3), sent.Load())
+
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 0, s.deliverQueued(ctx))
+		dead, err := s.DeadPushDeliveries(10)
+		require.NoError(t, err)
+		require.Len(t, dead, 1)
+		assert.Equal(t, "$ev1", dead[0].EventID)
+		assert.Equal(t, "bob-msgs", dead[0].Pushkey)
+		assert.Equal(t, 3, dead[0].Attempts)
+		assert.Contains(t, dead[0].LastError, "code=500")
+	})
+
+	t.Run("push succeeds after a failure", func(t *testing.T) {
+		var pnmCode, sent atomic.Int32
+		pnmCode.Store(500)
+		s, pushTokenDB := newQueuePushService(t, &pnmCode, &sent)
+
+		_, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", textNotification("$ev1"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, s.deliverQueued(ctx))
+		assert.Equal(t, 1, s.deliverQueued(ctx))
+
+		pnmCode.Store(200)
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, 1, s.deliverQueued(ctx))
+
+		delivered, err := pushTokenDB.ListPushDeliveries(db.PushDeliveryDelivered, 10)
+		require.NoError(t, err)
+		require.Len(t, delivered, 2)
+		assert.Equal(t, "NotifyTextMessage", delivered[0].Kind)
+		assert.Equal(t, 2, delivered[0].Attempts)
+	})
+
+	t.Run("pushkey unknown to the PNM is rejected on the next notification", func(t *testing.T) {
+		var pnmCode, sent atomic.Int32
+		pnmCode.Store(404)
+		s, _ := newQueuePushService(t, &pnmCode, &sent)
+
+		resp, err := s.HandleMatrixPushNotification(ctx, "@bob:example.org", textNotification("$ev1"))
+		require.NoError(t, err)
+		assert.Empty(t, resp.Rejected)
+		assert.Equal(t, 2, deliverAll(s))
+
+		resp, err = s.HandleMatrixPushNotification(ctx, "@bob:example.org", textNotification("$ev2"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bob-msgs"}, resp.Rejected)
+		assert.Equal(t, 0, s.deliverQueued(ctx))
+		assert.Equal(t, int32(1), sent.Load())
+	})
+}
+
+func TestPushRetryBackoff(t *testing.T) {
+	s := &PushService{retryBackoff: defaultPushRetryBackoff}
+	assert.Equal(t, 5*time.Second, s.pushRetryBackoff(1))
+	assert.Equal(t, 10*time.Second, s.pushRetryBackoff(2))
+	assert.Equal(t, 40*time.Second, s.pushRetryBackoff(4))
+	assert.Equal(t, maxPushRetryBackoff, s.pushRetryBackoff(20))
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/models"
+)
+
+// recordedPushesSize is how many recorded pushes are kept in memory.
+const recordedPushesSize = 200
+
+// pushRecorder keeps the latest pushes in a ring buffer, and appends them as JSON lines to a file when configured.
+type pushRecorder struct {
+	mu      sync.Mutex
+	entries []models.RecordedPush
+	next    int
+	path    string
+}
+
+func newPushRecorder(path string) *pushRecorder {
+	return &pushRecorder{entries: make([]models.RecordedPush, 0, recordedPushesSize), path: path}
+}
+
+// record stores a push. The push is kept in memory even if it cannot be written to the file.
+func (r *pushRecorder) record(req *models.AcrobitsPushRequest, now time.Time) error {
+	entry := models.RecordedPush{RecordedAt: now.UTC(), Request: *req}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < recordedPushesSize {
+		r.entries = append(r.entries, entry)
+	} else {
+		r.entries[r.next] = entry
+	}
+	r.next = (r.next + 1) % recordedPushesSize
+
+	if r.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal recorded push: %w", err)
+	}
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open push record file: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write push record file: %w", err)
+	}
+	return f.Close()
+}
+
+// list returns the pushes kept in memory, oldest first.
+func (r *pushRecorder) list() []models.RecordedPush {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pushes := make([]models.RecordedPush, 0, len(r.entries))
+	if len(r.entries) == recordedPushesSize {
+		pushes = append(pushes, r.entries[r.next:]...)
+		return append(pushes, r.entries[:r.next]...)
+	}
+	return append(pushes, r.entries...)
+}
+
+// clear drops the pushes kept in memory. The file is left untouched.
+func (r *pushRecorder) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = r.entries[:0]
+	r.next = 0
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushRecorder_RingBuffer(t *testing.T) {
+	r := newPushRecorder("")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < recordedPushesSize+5; i++ {
+		require.NoError(t, r.record(&models.AcrobitsPushRequest{ID: fmt.Sprintf("$%d", i)}, now))
+	}
+
+	pushes := r.list()
+	require.Len(t, pushes, recordedPushesSize)
+	assert.Equal(t, "$5", pushes[0].Request.ID)
+	assert.Equal(t, fmt.Sprintf("$%d", recordedPushesSize+4), pushes[len(pushes)-1].Request.ID)
+	assert.Equal(t, now, pushes[0].RecordedAt)
+
+	r.clear()
+	assert.Empty(t, r.list())
+	require.NoError(t, r.record(&models.AcrobitsPushRequest{ID: "$again"}, now))
+	assert.Equal(t, "$again", r.list()[0].Request.ID)
+}
+
+func TestPushRecorder_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pushes.jsonl")
+	r := newPushRecorder(path)
+	require.NoError(t, r.record(&models.AcrobitsPushRequest{ID: "$1", Message: "one"}, time.Now()))
+	require.NoError(t, r.record(&models.AcrobitsPushRequest{ID: "$2", Message: "two"}, time.Now()))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var messages []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry models.RecordedPush
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		messages = append(messages, entry.Request.Message)
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"one", "two"}, messages)
+	assert.Len(t, r.list(), 2)
+}
@@ -20,7 +20,7 @@ func TestHandleMatrixPushNotification(t *testing.T) {
 	defer tmpDB.Close()
 
 	// Save a test push token
-	err = tmpDB.SavePushToken("test-selector", "test-device-token", "com.acrobits.app", "test-call-token", "com.acrobits.call")
+	err = tmpDB.SavePushToken("test-selector", "@bob:example.org", "", "test-device-token", "com.acrobits.app", "test-call-token", "com.acrobits.call")
 	require.NoError(t, err)
 
 	t.Run("notification with valid pushkey", func(t *testing.T) {
@@ -50,9 +50,9 @@ func TestHandleMatrixPushNotification(t *testing.T) {
 		defer mockServer.Close()
 
 		// Create push service with mock server
-		pushSvc := NewPushService(tmpDB)
-		// Override the acrobits URL for testing (in real implementation, we'd inject this)
-		// For now, we'll skip the actual HTTP call test since acrobitsPushURL is a const
+		cfg := NewTestConfig()
+		cfg.PNMURL = mockServer.URL
+		pushSvc := NewPushService(nil, tmpDB, cfg)
 
 		req := &models.MatrixPushNotifyRequest{
 			Notification: models.MatrixNotification{
@@ -81,16 +81,45 @@ func TestHandleMatrixPushNotification(t *testing.T) {
 			},
 		}
 
-		resp, err := pushSvc.HandleMatrixPushNotification(context.Background(), req)
+		resp, err := pushSvc.HandleMatrixPushNotification(context.Background(), "@bob:example.org", req)
 		require.NoError(t, err)
 		assert.NotNil(t, resp)
-		// The rejected list should be empty if the push was sent successfully
-		// Note: In reality it will fail because we're trying to hit the real Acrobits server
-		// For a proper test, we'd need to inject the HTTP client or URL
+		// The rejected list is empty since the push was queued
+		assert.Empty(t, resp.Rejected)
+		// The queued push is sent to the mock server
+		assert.Equal(t, 2, deliverAll(pushSvc))
+	})
+
+	t.Run("record mode", func(t *testing.T) {
+		cfg := NewTestConfig()
+		cfg.PNMURL = "http://127.0.0.1:1/unreachable"
+		cfg.PushRecordMode = PushRecordMemory
+		pushSvc := NewPushService(nil, tmpDB, cfg)
+
+		req := &models.MatrixPushNotifyRequest{
+			Notification: models.MatrixNotification{
+				Content: map[string]interface{}{"body": "Recorded", "msgtype": "m.text"},
+				Devices: []models.MatrixDevice{{AppID: "com.acrobits.app", Pushkey: "test-device-token"}},
+				EventID: "$recorded",
+				RoomID:  "!room:example.org",
+				Sender:  "@alice:example.org",
+			},
+		}
+		resp, err := pushSvc.HandleMatrixPushNotification(context.Background(), "@bob:example.org", req)
+		require.NoError(t, err)
+		assert.Empty(t, resp.Rejected)
+		assert.Equal(t, 2, deliverAll(pushSvc))
+
+		pushes, err := pushSvc.RecordedPushes()
+		require.NoError(t, err)
+		require.Len(t, pushes, 1)
+		assert.Equal(t, "Recorded", pushes[0].Request.Message)
+		assert.Equal(t, "test-device-token", pushes[0].Request.DeviceToken)
+		assert.Equal(t, "$recorded", pushes[0].Request.ID)
 	})
 
 	t.Run("notification with unknown pushkey", func(t *testing.T) {
-		pushSvc := NewPushService(tmpDB)
+		pushSvc := NewPushService(nil, tmpDB, NewTestConfig())
 
 		req := &models.MatrixPushNotifyRequest{
 			Notification: models.MatrixNotification{
@@ -104,14 +133,14 @@ func TestHandleMatrixPushNotification(t *testing.T) {
 			},
 		}
 
-		resp, err := pushSvc.HandleMatrixPushNotification(context.Background(), req)
+		resp, err := pushSvc.HandleMatrixPushNotification(context.Background(), "@bob:example.org", req)
 		require.NoError(t, err)
 		assert.NotNil(t, resp)
 		assert.Contains(t, resp.Rejected, "unknown-token")
 	})
 
 	t.Run("translation to acrobits format", func(t *testing.T) {
-		pushSvc := NewPushService(tmpDB)
+		pushSvc := NewPushService(nil, tmpDB, NewTestConfig())
 
 		notification := models.MatrixNotification{
 			Content: map[string]interface{}{
@@ -151,7 +180,8 @@ func TestHandleMatrixPushNotification(t *testing.T) {
 		assert.Equal(t, "app.id.msgs", acrobitsReq.AppID)
 		assert.Equal(t, "selector123", acrobitsReq.Selector)
 		assert.Equal(t, "Test message", acrobitsReq.Message)
-		assert.Equal(t, 3, acrobitsReq.Badge)
+		require.NotNil(t, acrobitsReq.Badge)
+		assert.Equal(t, 3, *acrobitsReq.Badge)
 		assert.Equal(t, "Bob Smith", acrobitsReq.UserDisplayName)
 		assert.Equal(t, "@bob:example.org", acrobitsReq.UserName)
 		assert.Equal(t, "$xyz", acrobitsReq.ID)
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/id"
+)
+
+// ErrPusherReconcileUnavailable is returned when the pushers cannot be reconciled: the database, the Matrix
+// client or the proxy URL are missing.
+var ErrPusherReconcileUnavailable = errors.New("pusher reconciliation not available")
+
+// Reasons of the changes made by ReconcilePushers
+const (
+	pusherReasonNoToken  = "no_token" // pusher of the proxy gateway whose token is not stored
+	pusherReasonMissing  = "missing"  // stored token without pusher
+	pusherReasonOutdated = "outdated" // pusher URL not matching the gateway URL of the user, e.g. after a secret change
+)
+
+// RunPusherReconciler reconciles the pushers at startup and then every interval, until ctx is done.
+func (s *MessageService) RunPusherReconciler(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		logger.Info().Msg("pusher reconciliation disabled")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.ReconcilePushers(ctx); err != nil {
+			logger.Error().Err(err).Msg("failed to reconcile pushers")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcilePushers aligns the pushers of the homeserver with the stored push tokens. For each known user
+// (owner of a token or of a mapping), pushers sending to the proxy gateway without a matching token are
+// removed, and tokens without a pusher, or with an outdated one, are registered again. Other pushers are
+// left alone. Errors on a user are reported and do not stop the others.
+func (s *MessageService) ReconcilePushers(ctx context.Context) (*models.PusherReconcileReport, error) {
+	if s.pushTokenDB == nil || s.matrixClient == nil || s.proxyURL == "" {
+		return nil, ErrPusherReconcileUnavailable
+	}
+	s.reconcileMu.Lock()
+	defer s.reconcileMu.Unlock()
+
+	report := &models.PusherReconcileReport{
+		StartedAt:  s.now().UTC(),
+		Removed:    []models.PusherChange{},
+		Registered: []models.PusherChange{},
+		Errors:     []string{},
+	}
+
+	tokens, err := s.pushTokenDB.ListPushTokens()
+	if err != nil {
+		return nil, err
+	}
+	// The owners of the tokens saved by older versions are found from their pushers: every directory user is visited
+	if s.directoryConfigured() && slices.ContainsFunc(tokens, func(token *db.PushToken) bool { return token.UserID == "" }) {
+		if err := s.loadDirectory(ctx); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	mappings, err := s.pushTokenDB.ListMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	tokensByPushkey := make(map[string]*db.PushToken)
+	users := make(map[string]struct{})
+	for _, token := range tokens {
+		if token.TokenMsgs != "" {
+			tokensByPushkey[token.TokenMsgs] = token
+		}
+		if token.UserID != "" {
+			users[token.UserID] = struct{}{}
+		}
+	}
+	// Users whose tokens were deleted can still have pushers
+	for _, mapping := range mappings {
+		if mapping.MatrixID != "" {
+			users[mapping.MatrixID] = struct{}{}
+		}
+	}
+	userIDs := make([]string, 0, len(users))
+	for userID := range users {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	report.Users = len(userIDs)
+
+	for _, userID := range userIDs {
+		if err := s.reconcileUserPushers(ctx, id.UserID(userID), tokensByPushkey, report); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", userID, err))
+		}
+	}
+
+	logger.Info().
+		Int("users", report.Users).
+		Int("removed", len(report.Removed)).
+		Int("registered", len(report.Registered)).
+		Int("errors", len(report.Errors)).
+		Msg("pushers reconciled")
+	return report, nil
+}
+
+// reconcileUserPushers reconciles the pushers of a user with the tokens, adding its changes to report.
+func (s *MessageService) reconcileUserPushers(ctx context.Context, userID id.UserID, tokensByPushkey map[string]*db.PushToken, report *models.PusherReconcileReport) error {
+	pushers, err := s.matrixClient.GetPushers(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	gatewayPrefix := strings.TrimSuffix(s.proxyURL, "/") + pushGatewayPath
+	gatewayURL := pushGatewayURL(s.proxyURL, s.pushGatewaySecret, string(userID))
+	registered := make(map[string]bool)
+	for _, pusher := range pushers {
+		if pusher.Kind != "http" || !strings.HasPrefix(pusher.Data.URL, gatewayPrefix) {
+			continue
+		}
+		token := tokensByPushkey[pusher.Pushkey]
+		if token != nil && token.UserID == "" && token.AppIDMsgs == pusher.AppID {
+			// Tokens saved by older versions have no user: they belong to the user of their pusher
+			if err := s.bindReconciledToken(token, userID); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: pusher %s: %v", userID, pusher.Pushkey, err))
+				continue
+			}
+		}
+		if token == nil || token.AppIDMsgs != pusher.AppID || token.UserID != string(userID) {
+			s.applyPusherChange(ctx, &models.SetPusherRequest{AppID: pusher.AppID, Kind: nil, Pushkey: pusher.Pushkey}, userID, pusherReasonNoToken, &report.Removed, report)
+			continue
+		}
+		registered[pusher.Pushkey] = true
+		// Also updates the pushers registered by older versions, whose URL lacks the user
+		if pusher.Data.URL != gatewayURL {
+			s.applyPusherChange(ctx, s.newPusherRequest(userID, token.AppIDMsgs, token.TokenMsgs), userID, pusherReasonOutdated, &report.Registered, report)
+		}
+	}
+
+	for pushkey, token := range tokensByPushkey {
+		if token.UserID != string(userID) || registered[pushkey] {
+			continue
+		}
+		s.applyPusherChange(ctx, s.newPusherRequest(userID, token.AppIDMsgs, token.TokenMsgs), userID, pusherReasonMissing, &report.Registered, report)
+	}
+	return nil
+}
+
+// bindReconciledToken binds an ownerless token to the user of its pusher, and updates token with the stored owner.
+func (s *MessageService) bindReconciledToken(token *db.PushToken, userID id.UserID) error {
+	if _, err := s.pushTokenDB.BindPushToken(token.Selector, string(userID)); err != nil {
+		return err
+	}
+	stored, err := s.pushTokenDB.GetPushToken(token.Selector)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		token.UserID = stored.UserID
+	}
+	return nil
+}
+
+// applyPusherChange sends a pusher change to the homeserver, recording it in changes or the error in report.
+func (s *MessageService) applyPusherChange(ctx context.Context, req *models.SetPusherRequest, userID id.UserID, reason string, changes *[]models.PusherChange, report *models.PusherReconcileReport) {
+	if err := s.matrixClient.SetPusher(ctx, userID, req); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: pusher %s: %v", userID, req.Pushkey, err))
+		return
+	}
+	logger.Info().
+		Str("matrix_user_id", string(userID)).
+		Str("pushkey", req.Pushkey).
+		Str("reason", reason).
+		Bool("removed", req.Kind == nil).
+		Msg("pusher reconciled")
+	*changes = append(*changes, models.PusherChange{UserID: string(userID), AppID: req.AppID, Pushkey: req.Pushkey, Reason: reason})
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcilePushers(t *testing.T) {
+	cfg := NewTestConfig()
+	cfg.ProxyURL = "https://proxy.example.com"
+	gateway := func(userID string) string { return pushGatewayURL(cfg.ProxyURL, "", userID) }
+
+	pushers := map[string][]models.Pusher{
+		"@alice:example.com": {
+			{AppID: "app", Pushkey: "a1", Kind: "http", Data: models.PusherData{URL: gateway("@alice:example.com")}},
+			{AppID: "app", Pushkey: "orphan", Kind: "http", Data: models.PusherData{URL: gateway("@alice:example.com")}},
+			{AppID: "other.app", Pushkey: "foreign", Kind: "http", Data: models.PusherData{URL: "https://push.example.org/_matrix/push/v1/notify"}},
+		},
+		"@bob:example.com": {
+			{AppID: "app", Pushkey: "b1", Kind: "http", Data: models.PusherData{URL: "https://proxy.example.com/_matrix/push/v1/notify"}},
+		},
+		"@carol:example.com": {
+			{AppID: "app", Pushkey: "c1", Kind: "http", Data: models.PusherData{URL: gateway("@carol:example.com")}},
+			// Registered by an older version, without the user in the URL
+			{AppID: "app", Pushkey: "c2", Kind: "http", Data: models.PusherData{URL: "https://proxy.example.com/_matrix/push/v1/notify"}},
+		},
+	}
+	var mu sync.Mutex
+	var sets []models.SetPusherRequest
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("user_id")
+		switch r.URL.Path {
+		case "/_matrix/client/v3/pushers":
+			if userID == "@dave:example.com" {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN"}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(models.PushersResponse{Pushers: pushers[userID]})
+		case "/_matrix/client/v3/pushers/set":
+			var req models.SetPusherRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			mu.Lock()
+			sets = append(sets, req)
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer homeserver.Close()
+
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+	require.NoError(t, dbi.SavePushToken("alice-mobile", "@alice:example.com", "", "a1", "app", "", ""))
+	require.NoError(t, dbi.SavePushToken("alice-desk", "@alice:example.com", "", "a2", "app", "", ""))
+	require.NoError(t, dbi.SavePushToken("bob-mobile", "@bob:example.com", "", "b1", "app", "", ""))
+	// Saved by an older version, without a user
+	require.NoError(t, dbi.SavePushToken("carol-legacy", "", "", "c2", "app", "", ""))
+	// The other tokens of carol were reset, those of dave cannot be listed
+	require.NoError(t, dbi.SaveMapping(&db.Mapping{Number: 203, MatrixID: "@carol:example.com", SubNumbers: []int{}}))
+	require.NoError(t, dbi.SaveMapping(&db.Mapping{Number: 204, MatrixID: "@dave:example.com", SubNumbers: []int{}}))
+
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	svc := NewMessageService(mc, dbi, cfg)
+
+	report, err := svc.ReconcilePushers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Users)
+	assert.ElementsMatch(t, []models.PusherChange{
+		{UserID: "@alice:example.com", AppID: "app", Pushkey: "orphan", Reason: pusherReasonNoToken},
+		{UserID: "@carol:example.com", AppID: "app", Pushkey: "c1", Reason: pusherReasonNoToken},
+	}, report.Removed)
+	assert.ElementsMatch(t, []models.PusherChange{
+		{UserID: "@alice:example.com", AppID: "app", Pushkey: "a2", Reason: pusherReasonMissing},
+		{UserID: "@bob:example.com", AppID: "app", Pushkey: "b1", Reason: pusherReasonOutdated},
+		{UserID: "@carol:example.com", AppID: "app", Pushkey: "c2", Reason: pusherReasonOutdated},
+	}, report.Registered)
+	require.Len(t, report.Errors, 1)
+	assert.Contains(t, report.Errors[0], "@dave:example.com")
+
+	require.Len(t, sets, 5)
+	for _, req := range sets {
+		switch req.Pushkey {
+		case "orphan", "c1":
+			assert.Nil(t, req.Kind)
+		case "a2", "b1", "c2":
+			require.NotNil(t, req.Kind)
+			assert.Equal(t, "http", *req.Kind)
+			assert.True(t, req.Append)
+			assert.Equal(t, gateway(map[string]string{"a2": "@alice:example.com", "b1": "@bob:example.com", "c2": "@carol:example.com"}[req.Pushkey]), req.Data.URL)
+		default:
+			t.Errorf("unexpected pusher change for %s", req.Pushkey)
+		}
+	}
+
+	// The legacy token now belongs to the user of its pusher
+	token, err := dbi.GetPushToken("carol-legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "@carol:example.com", token.UserID)
+}
+
+func TestReconcilePushers_LegacyTokensFromDirectory(t *testing.T) {
+	cfg := NewTestConfig()
+	cfg.ProxyURL = "https://proxy.example.com"
+
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/login":
+			_ = json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+		case "/api/chat":
+			_ = json.NewEncoder(w).Encode(models.ChatResponse{Users: []models.ChatUser{{UserName: "alice", MainExtension: "201"}}})
+		}
+	}))
+	defer directory.Close()
+	cfg.ExtAuthURL = directory.URL
+	cfg.ExtAuthDirectoryUser, cfg.ExtAuthDirectoryPassword = "directory", "secret"
+
+	var registered []string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/pushers":
+			_ = json.NewEncoder(w).Encode(models.PushersResponse{Pushers: []models.Pusher{
+				{AppID: "app", Pushkey: "a1", Kind: "http", Data: models.PusherData{URL: "https://proxy.example.com/_matrix/push/v1/notify"}},
+			}})
+		case "/_matrix/client/v3/pushers/set":
+			var req models.SetPusherRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			registered = append(registered, req.Data.URL)
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer homeserver.Close()
+
+	// After an upgrade, the tokens have no user and no mapping is stored yet
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+	require.NoError(t, dbi.SavePushToken("alice-legacy", "", "", "a1", "app", "", ""))
+
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	svc := NewMessageService(mc, dbi, cfg)
+
+	report, err := svc.ReconcilePushers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Users)
+	assert.Equal(t, []string{pushGatewayURL(cfg.ProxyURL, "", "@alice:example.com")}, registered)
+	token, err := dbi.GetPushToken("alice-legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "@alice:example.com", token.UserID)
+}
+
+func TestReconcilePushers_Unavailable(t *testing.T) {
+	svc := NewMessageService(nil, nil, NewTestConfig())
+	_, err := svc.ReconcilePushers(context.Background())
+	assert.ErrorIs(t, err, ErrPusherReconcileUnavailable)
+}
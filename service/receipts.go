@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// dispositionNotificationField is the custom event content field carrying the disposition_notification
+// of messages sent from the app, so it can be returned to the app by fetch_messages.
+const dispositionNotificationField = "it.nethesis.acrobits.disposition_notification"
+
+var ErrInvalidMessage = errors.New("message is not resolvable to a Matrix event")
+
+// withDispositionNotification attaches the disposition_notification of a send_message request to
+// the content of a Matrix message event.
+func withDispositionNotification(content *event.MessageEventContent, notification string) interface{} {
+	if notification == "" {
+		return content
+	}
+	return &event.Content{
+		Parsed: content,
+		Raw:    map[string]interface{}{dispositionNotificationField: notification},
+	}
+}
+
+// dispositionNotification returns the disposition_notification stored in a Matrix message event, if any.
+func dispositionNotification(evt *event.Event) string {
+	notification, _ := evt.Content.Raw[dispositionNotificationField].(string)
+	return notification
+}
+
+// roomReceipts maps each user to the position, in a sync timeline, of the latest event they have read.
+// Read receipts are cumulative: a user has read every event up to the one the receipt points to.
+type roomReceipts map[id.UserID]int
+
+// readReceipt is an m.read or m.read.private receipt of a room.
+type readReceipt struct {
+	reader  id.UserID
+	eventID id.EventID
+	ts      int64
+}
+
+// parseReceipts extracts the m.read and m.read.private receipts from the ephemeral events of a joined room.
+func parseReceipts(ephemeral []*event.Event) []readReceipt {
+	var receipts []readReceipt
+	for _, evt := range ephemeral {
+		if evt.Type.Type != event.EphemeralEventReceipt.Type {
+			continue
+		}
+		var content event.ReceiptEventContent
+		if err := json.Unmarshal(evt.Content.VeryRaw, &content); err != nil {
+			logger.Warn().Err(err).Msg("failed to parse receipt event")
+			continue
+		}
+		for eventID, byType := range content {
+			for _, receiptType := range []event.ReceiptType{event.ReceiptTypeRead, event.ReceiptTypeReadPrivate} {
+				for userID, receipt := range byType[receiptType] {
+					receipts = append(receipts, readReceipt{reader: userID, eventID: eventID, ts: receipt.Timestamp.UnixMilli()})
+				}
+			}
+		}
+	}
+	return receipts
+}
+
+// collectReceipts maps the receipts of a joined room to the positions of their events in the timeline events.
+// Receipts pointing to events outside the timeline are ignored here, see lateReadEvents.
+func collectReceipts(events []*event.Event, receipts []readReceipt) roomReceipts {
+	positions := make(map[id.EventID]int, len(events))
+	for i, evt := range events {
+		positions[evt.ID] = i
+	}
+
+	collected := roomReceipts{}
+	for _, receipt := range receipts {
+		pos, ok := positions[receipt.eventID]
+		if !ok {
+			continue
+		}
+		if current, ok := collected[receipt.reader]; !ok || pos > current {
+			collected[receipt.reader] = pos
+		}
+	}
+	return collected
+}
+
+// lateReadEvents returns the messages read in a room whose receipt arrives in a later sync than them: the
+// receipt points outside the timeline. The messages are reported again, displayed. Each receipt is compared
+// with the latest one stored for its reader, so a receipt older than it is not reported. Messages are only
+// reported for the incremental syncs: a full sync returns the current receipts, pointing to old messages.
+func (s *MessageService) lateReadEvents(ctx context.Context, userID id.UserID, roomID id.RoomID, timeline []*event.Event, receipts []readReceipt, incremental bool) []*event.Event {
+	inTimeline := make(map[id.EventID]bool, len(timeline))
+	for _, evt := range timeline {
+		inTimeline[evt.ID] = true
+	}
+
+	var late []*event.Event
+	fetched := map[id.EventID]*event.Event{}
+	for _, receipt := range receipts {
+		if s.pushTokenDB != nil {
+			newer, err := s.pushTokenDB.SaveReadReceipt(db.ReadReceipt{RoomID: string(roomID), Reader: string(receipt.reader), EventID: string(receipt.eventID), TS: receipt.ts})
+			if err != nil {
+				logger.Warn().Str("room_id", string(roomID)).Str("reader", string(receipt.reader)).Err(err).Msg("failed to save read receipt")
+			} else if !newer {
+				continue
+			}
+		}
+		if !incremental || inTimeline[receipt.eventID] {
+			continue
+		}
+
+		evt, ok := fetched[receipt.eventID]
+		if !ok {
+			var err error
+			evt, err = s.matrixClient.GetEvent(ctx, userID, roomID, receipt.eventID)
+			if err != nil {
+				logger.Debug().Str("room_id", string(roomID)).Str("event_id", string(receipt.eventID)).Err(err).Msg("failed to fetch the event of a read receipt")
+				evt = nil
+			} else if evt.Type != event.EventMessage {
+				evt = nil
+			}
+			fetched[receipt.eventID] = evt
+		}
+		if evt == nil {
+			continue
+		}
+		// Only the receipts telling the user something: their own on received messages, the others' on sent ones
+		sent := isSentBy(string(evt.Sender), string(userID))
+		if sent == (receipt.reader == userID) {
+			continue
+		}
+		if evt.RoomID == "" {
+			evt.RoomID = roomID
+		}
+		late = append(late, evt)
+		// Reported once, whoever else read it
+		fetched[receipt.eventID] = nil
+	}
+	sort.SliceStable(late, func(i, j int) bool { return late[i].Timestamp < late[j].Timestamp })
+	return late
+}
+
+// readBy reports whether userID has read the timeline event at position pos.
+func (r roomReceipts) readBy(userID id.UserID, pos int) bool {
+	read, ok := r[userID]
+	return ok && read >= pos
+}
+
+// readByOthers reports whether anyone but userID has read the timeline event at position pos.
+func (r roomReceipts) readByOthers(userID id.UserID, pos int) bool {
+	for reader, read := range r {
+		if reader != userID && read >= pos {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkDisplayed marks a message, and every message before it in the same stream, as displayed.
+// The m.read receipt and the m.fully_read marker of the room are moved to the message as the user,
+// so other Matrix clients see the message as read.
+func (s *MessageService) MarkDisplayed(ctx context.Context, req *models.MarkDisplayedRequest) (*models.MarkDisplayedResponse, error) {
+	if req == nil {
+		return nil, errors.New("request cannot be nil")
+	}
+
+	userName := strings.TrimSpace(req.UserName)
+	if userName == "" || strings.TrimSpace(req.Password) == "" {
+		logger.Warn().Msg("mark displayed: empty username or password")
+		return nil, ErrAuthentication
+	}
+
+	roomID := id.RoomID(strings.TrimSpace(req.StreamID))
+	eventID := id.EventID(strings.TrimSpace(req.SMSID))
+	if !strings.HasPrefix(string(roomID), "!") || !strings.HasPrefix(string(eventID), "$") {
+		logger.Warn().Str("stream_id", string(roomID)).Str("sms_id", string(eventID)).Msg("mark displayed: invalid stream_id or sms_id")
+		return nil, ErrInvalidMessage
+	}
+
+	if err := s.authenticateAndPersistMappings(ctx, userName, req.Password); err != nil {
+		return nil, err
+	}
+
+	userID := s.resolveMatrixUser(userName)
+	if userID == "" {
+		logger.Warn().Str("username", userName).Msg("resolved to empty Matrix user ID")
+		return nil, ErrAuthentication
+	}
+
+	if err := s.matrixClient.MarkRead(ctx, userID, roomID, eventID); err != nil {
+		if errors.Is(err, mautrix.MForbidden) || errors.Is(err, mautrix.MNotFound) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		return nil, fmt.Errorf("mark displayed: %w", mapAuthErr(err))
+	}
+
+	logger.Debug().Str("user_id", string(userID)).Str("room_id", string(roomID)).Str("event_id", string(eventID)).Msg("message marked as displayed")
+	return &models.MarkDisplayedResponse{}, nil
+}
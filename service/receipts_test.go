@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/matrix"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maunium.net/go/mautrix/event"
+)
+
+func TestSendMessage_DispositionNotification(t *testing.T) {
+	hs := &fakeHomeserver{}
+	homeserver := httptest.NewServer(hs.handler(t))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "hello"}
+	_, err := svc.matrixClient.SendMessage(context.Background(), "@alice:example.com", "!room:example.com", withDispositionNotification(content, "positive-delivery, display"))
+	require.NoError(t, err)
+	_, err = svc.matrixClient.SendMessage(context.Background(), "@alice:example.com", "!room:example.com", withDispositionNotification(content, ""))
+	require.NoError(t, err)
+
+	require.Len(t, hs.events, 2)
+	assert.Equal(t, "hello", hs.events[0]["body"])
+	assert.Equal(t, "positive-delivery, display", hs.events[0][dispositionNotificationField])
+	assert.NotContains(t, hs.events[1], dispositionNotificationField)
+}
+
+func TestFetchMessages_Receipts(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_matrix/client/v3/directory/room/#@alice:example.com|@bob:example.com:example.com",
+			"/_matrix/client/v3/directory/room/#@bob:example.com|@alice:example.com:example.com":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		case "/_matrix/client/v3/rooms/!dm:example.com/joined_members":
+			_, _ = w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{}}}`))
+		case "/_matrix/client/v3/sync":
+			_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!dm:example.com":{
+				"timeline":{"events":[
+					{"type":"m.room.message","event_id":"$1","sender":"@bob:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"one"}},
+					{"type":"m.room.message","event_id":"$2","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"two","it.nethesis.acrobits.disposition_notification":"display"}},
+					{"type":"m.room.message","event_id":"$3","sender":"@bob:example.com","origin_server_ts":3000,"content":{"msgtype":"m.text","body":"three"}},
+					{"type":"m.room.message","event_id":"$4","sender":"@alice:example.com","origin_server_ts":4000,"content":{"msgtype":"m.text","body":"four"}}
+				]},
+				"ephemeral":{"events":[
+					{"type":"m.receipt","content":{
+						"$1":{"m.read":{"@alice:example.com":{"ts":1500}}},
+						"$2":{"m.read":{"@bob:example.com":{"ts":2500}}},
+						"$old":{"m.read":{"@bob:example.com":{"ts":100}}}
+					}}
+				]}
+			}}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"aliases":[]}`))
+		}
+	}))
+	defer homeserver.Close()
+
+	svc := newMediaTestService(t, homeserver.URL)
+
+	resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{Username: "@alice:example.com"})
+	require.NoError(t, err)
+
+	byID := map[string]models.SMS{}
+	for _, sms := range append(resp.ReceivedSMSs, resp.SentSMSs...) {
+		byID[sms.SMSID] = sms
+	}
+	require.Len(t, byID, 4)
+	assert.True(t, byID["$1"].Displayed, "received and read by alice")
+	assert.True(t, byID["$2"].Displayed, "sent and read by bob")
+	assert.False(t, byID["$3"].Displayed, "received after alice's receipt")
+	assert.False(t, byID["$4"].Displayed, "sent after bob's receipt")
+	assert.Equal(t, "display", byID["$2"].DispositionNotification)
+	assert.Empty(t, byID["$4"].DispositionNotification)
+}
+
+func TestMarkDisplayed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/login" {
+			json.NewEncoder(w).Encode(models.LoginResponse{Token: createTestJWT(true)})
+		} else if r.URL.Path == "/api/chat" {
+			json.NewEncoder(w).Encode(models.ChatResponse{
+				Users: []models.ChatUser{
+					{UserName: "alice", MainExtension: "201", SubExtensions: []string{"91201"}},
+				},
+			})
+		}
+	}))
+	defer ts.Close()
+
+	var markers map[string]string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:example.com/read_markers":
+			assert.Equal(t, "@alice:example.com", r.URL.Query().Get("user_id"))
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&markers))
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"not in room"}`))
+		}
+	}))
+	defer homeserver.Close()
+
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	svc := NewMessageService(mc, nil, NewTestConfigWithAuth(ts.URL))
+
+	t.Run("marks read", func(t *testing.T) {
+		resp, err := svc.MarkDisplayed(context.TODO(), &models.MarkDisplayedRequest{UserName: "201", Password: "testpass", StreamID: "!room:example.com", SMSID: "$event"})
+		require.NoError(t, err)
+		assert.NotNil(t, resp)
+		assert.Equal(t, map[string]string{"m.read": "$event", "m.fully_read": "$event"}, markers)
+	})
+
+	t.Run("room not joined", func(t *testing.T) {
+		_, err := svc.MarkDisplayed(context.TODO(), &models.MarkDisplayedRequest{UserName: "201", Password: "testpass", StreamID: "!other:example.com", SMSID: "$event"})
+		assert.ErrorIs(t, err, ErrInvalidMessage)
+	})
+
+	t.Run("invalid ids", func(t *testing.T) {
+		_, err := svc.MarkDisplayed(context.TODO(), &models.MarkDisplayedRequest{UserName: "201", Password: "testpass", StreamID: "202", SMSID: "$event"})
+		assert.ErrorIs(t, err, ErrInvalidMessage)
+	})
+
+	t.Run("missing password", func(t *testing.T) {
+		_, err := svc.MarkDisplayed(context.TODO(), &models.MarkDisplayedRequest{UserName: "201", StreamID: "!room:example.com", SMSID: "$event"})
+		assert.ErrorIs(t, err, ErrAuthentication)
+	})
+}
+
+func TestFetchMessages_LateReceipts(t *testing.T) {
+	var receipts string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_matrix/client/v3/directory/room/#@alice:example.com|@bob:example.com:example.com",
+			"/_matrix/client/v3/directory/room/#@bob:example.com|@alice:example.com:example.com":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		case "/_matrix/client/v3/rooms/!dm:example.com/joined_members":
+			_, _ = w.Write([]byte(`{"joined":{"@alice:example.com":{},"@bob:example.com":{}}}`))
+		case "/_matrix/client/v3/rooms/!dm:example.com/event/$1":
+			_, _ = w.Write([]byte(`{"type":"m.room.message","event_id":"$1","room_id":"!dm:example.com","sender":"@bob:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"one"}}`))
+		case "/_matrix/client/v3/rooms/!dm:example.com/event/$2":
+			_, _ = w.Write([]byte(`{"type":"m.room.message","event_id":"$2","room_id":"!dm:example.com","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"two"}}`))
+		case "/_matrix/client/v3/sync":
+			if r.URL.Query().Get("since") == "" {
+				_, _ = w.Write([]byte(`{"next_batch":"s1","rooms":{"join":{"!dm:example.com":{"timeline":{"events":[
+					{"type":"m.room.message","event_id":"$1","sender":"@bob:example.com","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"one"}},
+					{"type":"m.room.message","event_id":"$2","sender":"@alice:example.com","origin_server_ts":2000,"content":{"msgtype":"m.text","body":"two"}}
+				]}}}}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"next_batch":"s2","rooms":{"join":{"!dm:example.com":{"timeline":{"events":[]},
+				"ephemeral":{"events":[{"type":"m.receipt","content":` + receipts + `}]}}}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"aliases":[]}`))
+		}
+	}))
+	defer homeserver.Close()
+
+	mc, err := matrix.NewClient(matrix.Config{HomeserverURL: homeserver.URL, AsUserID: "@proxy:example.com", AsToken: "test_token"})
+	require.NoError(t, err)
+	pushTokenDB, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer pushTokenDB.Close()
+	svc := NewMessageService(mc, pushTokenDB, NewTestConfig())
+	fetch := func() *models.FetchMessagesResponse {
+		resp, err := svc.FetchMessages(context.Background(), &models.FetchMessagesRequest{Username: "@alice:example.com", Device: "phone"})
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The messages are fetched before anyone reads them
+	resp := fetch()
+	require.Len(t, resp.ReceivedSMSs, 1)
+	require.Len(t, resp.SentSMSs, 1)
+	assert.False(t, resp.ReceivedSMSs[0].Displayed)
+	assert.False(t, resp.SentSMSs[0].Displayed)
+
+	// Both read: the messages are reported again, displayed
+	receipts = `{"$1":{"m.read":{"@alice:example.com":{"ts":3000}}},"$2":{"m.read":{"@bob:example.com":{"ts":3500}}}}`
+	resp = fetch()
+	require.Len(t, resp.ReceivedSMSs, 1)
+	require.Len(t, resp.SentSMSs, 1)
+	assert.Equal(t, "$1", resp.ReceivedSMSs[0].SMSID)
+	assert.True(t, resp.ReceivedSMSs[0].Displayed)
+	assert.Equal(t, "one", resp.ReceivedSMSs[0].SMSText)
+	assert.Equal(t, "$2", resp.SentSMSs[0].SMSID)
+	assert.True(t, resp.SentSMSs[0].Displayed)
+
+	stored, err := pushTokenDB.GetReadReceipt("!dm:example.com", "@bob:example.com")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "$2", stored.EventID)
+
+	// Receipts older than the stored ones, and receipts telling nothing to the user, are not reported
+	receipts = `{"$1":{"m.read":{"@bob:example.com":{"ts":1500}}},"$2":{"m.read":{"@alice:example.com":{"ts":4000}}}}`
+	resp = fetch()
+	assert.Empty(t, resp.ReceivedSMSs)
+	assert.Empty(t, resp.SentSMSs)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix/id"
+)
+
+// Registration is the Application Service registration file loaded by Synapse (app_service_config_files).
+type Registration struct {
+	ID              string                 `yaml:"id"`
+	URL             string                 `yaml:"url"`
+	AsToken         string                 `yaml:"as_token"`
+	HsToken         string                 `yaml:"hs_token"`
+	SenderLocalpart string                 `yaml:"sender_localpart"`
+	RateLimited     bool                   `yaml:"rate_limited"`
+	Namespaces      RegistrationNamespaces `yaml:"namespaces"`
+}
+
+// RegistrationNamespaces lists the user IDs and room aliases the Application Service is interested in.
+type RegistrationNamespaces struct {
+	Users   []RegistrationNamespace `yaml:"users"`
+	Aliases []RegistrationNamespace `yaml:"aliases"`
+}
+
+// RegistrationNamespace is a regular expression on user IDs or room aliases.
+type RegistrationNamespace struct {
+	Exclusive bool   `yaml:"exclusive"`
+	Regex     string `yaml:"regex"`
+}
+
+// NewRegistration builds a registration with random tokens for the proxy reachable at proxyURL.
+// The namespaces match what the proxy acts on: every user of homeserverHost, which it impersonates
+// without owning them, and the direct room aliases created by ensureDirectRoom (see generateRoomAliasKey).
+func NewRegistration(registrationID string, asUserID id.UserID, homeserverHost, proxyURL string) (*Registration, error) {
+	localpart, _, err := asUserID.Parse()
+	if err != nil || localpart == "" {
+		return nil, fmt.Errorf("invalid application service user ID %q", asUserID)
+	}
+	if homeserverHost == "" {
+		return nil, fmt.Errorf("homeserver host is required")
+	}
+	if proxyURL == "" {
+		return nil, fmt.Errorf("proxy URL is required")
+	}
+	asToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	hsToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	host := regexp.QuoteMeta(homeserverHost)
+	return &Registration{
+		ID:              registrationID,
+		URL:             strings.TrimSuffix(proxyURL, "/"),
+		AsToken:         asToken,
+		HsToken:         hsToken,
+		SenderLocalpart: localpart,
+		RateLimited:     false,
+		Namespaces: RegistrationNamespaces{
+			Users: []RegistrationNamespace{
+				{Exclusive: false, Regex: "^@[^:]+:" + host + "$"},
+			},
+			Aliases: []RegistrationNamespace{
+				{Exclusive: true, Regex: `^#[^:|]+\|[^:|]+:` + host + "$"},
+			},
+		},
+	}, nil
+}
+
+// YAML returns the registration file content.
+func (r *Registration) YAML() ([]byte, error) {
+	return yaml.Marshal(r)
+}
+
+// randomToken returns 32 random bytes, hex encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
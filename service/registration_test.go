@@ -0,0 +1,46 @@
+package service
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestNewRegistration(t *testing.T) {
+	reg, err := NewRegistration("acrobits-proxy", "@_acrobits_proxy:example.com", "example.com", "https://proxy.example.com/m2a/")
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://proxy.example.com/m2a", reg.URL)
+	assert.Equal(t, "_acrobits_proxy", reg.SenderLocalpart)
+	assert.Len(t, reg.AsToken, 64)
+	assert.Len(t, reg.HsToken, 64)
+	assert.NotEqual(t, reg.AsToken, reg.HsToken)
+
+	users := regexp.MustCompile(reg.Namespaces.Users[0].Regex)
+	assert.True(t, users.MatchString("@giacomo:example.com"))
+	assert.True(t, users.MatchString("@_acrobits_proxy:example.com"))
+	assert.False(t, users.MatchString("@giacomo:other.com"))
+	assert.False(t, users.MatchString("@giacomo:example.com.evil"))
+
+	aliases := regexp.MustCompile(reg.Namespaces.Aliases[0].Regex)
+	assert.True(t, aliases.MatchString("#"+generateRoomAliasKey("@mario:example.com", "@giacomo:example.com")+":example.com"))
+	assert.False(t, aliases.MatchString("#general:example.com"))
+	assert.False(t, aliases.MatchString("#giacomo|mario:other.com"))
+
+	data, err := reg.YAML()
+	require.NoError(t, err)
+	var parsed map[string]interface{}
+	require.NoError(t, yaml.Unmarshal(data, &parsed))
+	assert.Equal(t, reg.HsToken, parsed["hs_token"])
+	assert.Equal(t, false, parsed["rate_limited"])
+
+	other, err := NewRegistration("acrobits-proxy", "@_acrobits_proxy:example.com", "example.com", "https://proxy.example.com")
+	require.NoError(t, err)
+	assert.NotEqual(t, reg.AsToken, other.AsToken)
+
+	_, err = NewRegistration("acrobits-proxy", "invalid", "example.com", "https://proxy.example.com")
+	assert.Error(t, err)
+}
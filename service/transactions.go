@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nethesis/matrix2acrobits/logger"
+	"github.com/nethesis/matrix2acrobits/models"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// transactionRetention is how long processed transaction IDs are kept to detect retries from the homeserver.
+const transactionRetention = 7 * 24 * time.Hour
+
+// HandleTransaction processes a transaction pushed by the homeserver to the Application Service.
+// Transactions are deduplicated on their ID, so retries from the homeserver are processed only once, even
+// when they arrive concurrently: the ID is recorded before the events are handled.
+// Membership, alias, name and message events keep the room caches up to date.
+func (s *MessageService) HandleTransaction(ctx context.Context, txnID string, txn *models.AppServiceTransaction) error {
+	if s.pushTokenDB != nil {
+		recorded, err := s.pushTokenDB.MarkTransactionProcessed(txnID)
+		if err != nil {
+			return fmt.Errorf("handle transaction: %w", err)
+		}
+		if !recorded {
+			logger.Debug().Str("txn_id", txnID).Msg("transaction already processed, skipping")
+			return nil
+		}
+		s.pruneTransactions()
+	}
+
+	for _, evt := range txn.Events {
+		if evt == nil || evt.RoomID == "" {
+			continue
+		}
+		s.handleTransactionEvent(evt)
+	}
+
+	logger.Debug().Str("txn_id", txnID).Int("events", len(txn.Events)).Msg("transaction processed")
+	return nil
+}
+
+// handleTransactionEvent invalidates or updates the cached information of the room of an event.
+func (s *MessageService) handleTransactionEvent(evt *event.Event) {
+	roomID := string(evt.RoomID)
+	switch evt.Type.Type {
+	case event.StateMember.Type:
+		membership, _ := evt.Content.Raw["membership"].(string)
+		logger.Debug().Str("room_id", roomID).Str("state_key", evt.GetStateKey()).Str("membership", membership).Msg("transaction: membership changed")
+		s.roomParticipantCache.DeleteRoom(roomID)
+		s.roomGroupCache.Delete(roomID)
+		// Direct rooms are kept: their alias still points to them on the homeserver, even after a member left
+
+	case event.StateCanonicalAlias.Type, event.StateAliases.Type:
+		s.roomAliasesCache.Delete(roomID)
+		s.roomParticipantCache.DeleteRoom(roomID)
+		for _, alias := range eventAliases(evt) {
+			key := normalizeLocalpart(alias)
+			if strings.Contains(key, "|") {
+				// Direct room created by the proxy or by another instance
+				s.roomAliasCache.Set(key, roomID)
+				logger.Debug().Str("room_id", roomID).Str("alias", key).Msg("transaction: recorded direct room")
+			}
+		}
+
+	case event.StateRoomName.Type:
+		s.roomGroupCache.Delete(roomID)
+
+	case event.EventMessage.Type:
+		// A message from someone who is not a known member means the cached members are stale
+		if group, ok := s.roomGroupCache.Get(roomID); ok && !containsMember(group.Members, evt.Sender) {
+			logger.Debug().Str("room_id", roomID).Str("sender", string(evt.Sender)).Msg("transaction: message from unknown member, refreshing room")
+			s.roomGroupCache.Delete(roomID)
+			s.roomParticipantCache.DeleteRoom(roomID)
+		}
+	}
+}
+
+// eventAliases returns the aliases carried by an m.room.canonical_alias or m.room.aliases event.
+func eventAliases(evt *event.Event) []string {
+	var aliases []string
+	if alias, ok := evt.Content.Raw["alias"].(string); ok && alias != "" {
+		aliases = append(aliases, alias)
+	}
+	for _, key := range []string{"alt_aliases", "aliases"} {
+		list, _ := evt.Content.Raw[key].([]interface{})
+		for _, item := range list {
+			if alias, ok := item.(string); ok && alias != "" {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	return aliases
+}
+
+func containsMember(members []string, userID id.UserID) bool {
+	for _, member := range members {
+		if isSentBy(member, string(userID)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneTransactions removes the processed transaction IDs older than transactionRetention.
+// It runs at most once per syncTokenPruneInterval.
+func (s *MessageService) pruneTransactions() {
+	now := s.now()
+	s.mu.Lock()
+	if !s.lastTxnPrune.IsZero() && now.Sub(s.lastTxnPrune) < syncTokenPruneInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastTxnPrune = now
+	s.mu.Unlock()
+
+	if _, err := s.pushTokenDB.PruneTransactions(now.Add(-transactionRetention)); err != nil {
+		logger.Error().Err(err).Msg("failed to prune processed transactions")
+	}
+}
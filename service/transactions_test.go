@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nethesis/matrix2acrobits/db"
+	"github.com/nethesis/matrix2acrobits/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTransaction(t *testing.T, data string) *models.AppServiceTransaction {
+	t.Helper()
+	var txn models.AppServiceTransaction
+	require.NoError(t, json.Unmarshal([]byte(data), &txn))
+	return &txn
+}
+
+func TestHandleTransaction_Caches(t *testing.T) {
+	svc := NewMessageService(nil, nil, NewTestConfig())
+
+	seed := func() {
+		svc.roomAliasCache.Set("alice|bob", "!dm:example.com")
+		svc.roomAliasesCache.Set("!dm:example.com", []string{"#alice|bob:example.com"})
+		svc.roomParticipantCache.Set("!dm:example.com|@alice:example.com", "202")
+		svc.roomParticipantCache.Set("!other:example.com|@alice:example.com", "203")
+		svc.roomGroupCache.Set("!dm:example.com", RoomGroup{Members: []string{"@alice:example.com", "@bob:example.com"}})
+	}
+
+	t.Run("join invalidates members", func(t *testing.T) {
+		seed()
+		require.NoError(t, svc.HandleTransaction(context.Background(), "t1", parseTransaction(t, `{"events":[
+			{"type":"m.room.member","room_id":"!dm:example.com","state_key":"@carol:example.com","sender":"@carol:example.com","content":{"membership":"join"}}
+		]}`)))
+		_, ok := svc.roomGroupCache.Get("!dm:example.com")
+		assert.False(t, ok)
+		assert.Empty(t, svc.roomParticipantCache.Get("!dm:example.com|@alice:example.com"))
+		assert.Equal(t, "203", svc.roomParticipantCache.Get("!other:example.com|@alice:example.com"))
+		assert.Equal(t, "!dm:example.com", svc.roomAliasCache.Get("alice|bob"))
+	})
+
+	t.Run("leave keeps the direct room", func(t *testing.T) {
+		seed()
+		require.NoError(t, svc.HandleTransaction(context.Background(), "t2", parseTransaction(t, `{"events":[
+			{"type":"m.room.member","room_id":"!dm:example.com","state_key":"@bob:example.com","sender":"@bob:example.com","content":{"membership":"leave"}}
+		]}`)))
+		assert.Equal(t, "!dm:example.com", svc.roomAliasCache.Get("alice|bob"))
+		assert.Empty(t, svc.roomParticipantCache.Get("!dm:example.com|@alice:example.com"))
+	})
+
+	t.Run("canonical alias records direct rooms", func(t *testing.T) {
+		seed()
+		require.NoError(t, svc.HandleTransaction(context.Background(), "t3", parseTransaction(t, `{"events":[
+			{"type":"m.room.canonical_alias","room_id":"!new:example.com","state_key":"","sender":"@alice:example.com","content":{"alias":"#alice|carol:example.com"}}
+		]}`)))
+		assert.Equal(t, "!new:example.com", svc.roomAliasCache.Get("alice|carol"))
+		assert.Nil(t, svc.roomAliasesCache.Get("!new:example.com"))
+	})
+
+	t.Run("message from unknown member refreshes group", func(t *testing.T) {
+		seed()
+		require.NoError(t, svc.HandleTransaction(context.Background(), "t4", parseTransaction(t, `{"events":[
+			{"type":"m.room.message","room_id":"!dm:example.com","sender":"@bob:example.com","content":{"msgtype":"m.text","body":"hi"}}
+		]}`)))
+		_, ok := svc.roomGroupCache.Get("!dm:example.com")
+		assert.True(t, ok, "known sender keeps the cache")
+
+		require.NoError(t, svc.HandleTransaction(context.Background(), "t5", parseTransaction(t, `{"events":[
+			{"type":"m.room.message","room_id":"!dm:example.com","sender":"@carol:example.com","content":{"msgtype":"m.text","body":"hi"}}
+		]}`)))
+		_, ok = svc.roomGroupCache.Get("!dm:example.com")
+		assert.False(t, ok)
+	})
+}
+
+func TestHandleTransaction_Dedupe(t *testing.T) {
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	svc := NewMessageService(nil, dbi, NewTestConfig())
+	txn := parseTransaction(t, `{"events":[
+		{"type":"m.room.name","room_id":"!group:example.com","state_key":"","sender":"@alice:example.com","content":{"name":"Team"}}
+	]}`)
+
+	svc.roomGroupCache.Set("!group:example.com", RoomGroup{Name: "Old"})
+	require.NoError(t, svc.HandleTransaction(context.Background(), "txn1", txn))
+	_, ok := svc.roomGroupCache.Get("!group:example.com")
+	assert.False(t, ok)
+
+	// A retry of the same transaction is not processed again, even after a restart
+	restarted := NewMessageService(nil, dbi, NewTestConfig())
+	restarted.roomGroupCache.Set("!group:example.com", RoomGroup{Name: "Team"})
+	require.NoError(t, restarted.HandleTransaction(context.Background(), "txn1", txn))
+	_, ok = restarted.roomGroupCache.Get("!group:example.com")
+	assert.True(t, ok)
+
+	recorded, err := dbi.MarkTransactionProcessed("txn1")
+	require.NoError(t, err)
+	assert.False(t, recorded)
+}
+
+func TestHandleTransaction_ConcurrentRetries(t *testing.T) {
+	dbi, err := db.NewDatabase(":memory:")
+	require.NoError(t, err)
+	defer dbi.Close()
+
+	svc := NewMessageService(nil, dbi, NewTestConfig())
+	txn := parseTransaction(t, `{"events":[
+		{"type":"m.room.name","room_id":"!group:example.com","state_key":"","sender":"@alice:example.com","content":{"name":"Team"}}
+	]}`)
+
+	// Only one of the concurrent deliveries of a transaction handles its events
+	var wg sync.WaitGroup
+	var handled atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorded, err := dbi.MarkTransactionProcessed("txn1")
+			assert.NoError(t, err)
+			if recorded {
+				handled.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), handled.Load())
+
+	// The transaction is recorded before its events are handled
+	svc.roomGroupCache.Set("!group:example.com", RoomGroup{Name: "Team"})
+	require.NoError(t, svc.HandleTransaction(context.Background(), "txn1", txn))
+	_, ok := svc.roomGroupCache.Get("!group:example.com")
+	assert.True(t, ok)
+}